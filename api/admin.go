@@ -0,0 +1,127 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// adminUserView is what admins see about a user when moderating
+type adminUserView struct {
+	ID           uint
+	FirstName    string
+	LastName     string
+	PrimaryEmail string
+	Role         string
+	SuspendedAt  *time.Time
+	CreatedAt    time.Time
+}
+
+func newAdminUserView(user User) adminUserView {
+	return adminUserView{
+		ID:           user.ID,
+		FirstName:    user.FirstName,
+		LastName:     user.LastName,
+		PrimaryEmail: user.PrimaryEmail,
+		Role:         user.Role,
+		SuspendedAt:  user.SuspendedAt,
+		CreatedAt:    user.CreatedAt,
+	}
+}
+
+// moderateUserRequest is the body of an admin's change to a user. Only the
+// fields present are changed
+type moderateUserRequest struct {
+	Role      *string `json:"role"`
+	Suspended *bool   `json:"suspended"`
+}
+
+func (request moderateUserRequest) validate() (errs fieldErrors) {
+	if request.Role != nil && !isRole(*request.Role) {
+		errs.add("role", fmt.Sprintf("must be %s, %s or %s", RoleWorker, RoleFarmOwner, RoleAdmin))
+	}
+	return
+}
+
+// ListUsers lists every user for admins optionally filtered by role
+func ListUsers(env *AppContext, w http.ResponseWriter, r *http.Request) {
+	query := env.DB.Order("id")
+	if role := r.URL.Query().Get("role"); role != "" {
+		query = query.Where(User{Role: role})
+	}
+
+	users := []User{}
+	if err := query.Find(&users).Error; err != nil {
+		log.WithFields(log.Fields{"action": "ListUsers"}).Error(err)
+		writeError(w, r, errServer)
+		return
+	}
+
+	views := []adminUserView{}
+	for _, user := range users {
+		views = append(views, newAdminUserView(user))
+	}
+	writeJSON(w, http.StatusOK, views)
+}
+
+// ModerateUser lets an admin change a user's role or suspend them. Suspending a
+// user signs them out of every device
+func ModerateUser(env *AppContext, w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "userid")
+	if err != nil {
+		writeError(w, r, badRequest(err.Error()))
+		return
+	}
+
+	request := moderateUserRequest{}
+	if err := decodeRequest(r, &request); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	if id == env.User.ID {
+		writeError(w, r, forbidden("Admins cannot moderate their own account"))
+		return
+	}
+
+	user := User{}
+	if env.DB.First(&user, id).RecordNotFound() {
+		writeError(w, r, notFound("User not found"))
+		return
+	}
+
+	if request.Role != nil {
+		user.Role = *request.Role
+	}
+	if request.Suspended != nil {
+		if !*request.Suspended {
+			user.SuspendedAt = nil
+		} else if !user.IsSuspended() {
+			now := time.Now()
+			user.SuspendedAt = &now
+		}
+	}
+
+	tx := env.DB.Begin()
+	err = tx.Save(&user).Error
+	if err == nil && user.IsSuspended() {
+		err = tx.Where("user_id = ?", user.ID).Delete(&AuthToken{}).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		log.WithFields(log.Fields{"action": "ModerateUser"}).Error(err)
+		writeError(w, r, errServer)
+		return
+	}
+	tx.Commit()
+
+	log.WithFields(log.Fields{
+		"admin_id":  env.User.ID,
+		"user_id":   user.ID,
+		"role":      user.Role,
+		"suspended": user.IsSuspended(),
+	}).Info("User moderated")
+	writeJSON(w, http.StatusOK, newAdminUserView(user))
+}
@@ -0,0 +1,164 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func moderateTestUser(t *testing.T, adminToken string, userID uint, field, value string) *http.Response {
+	data := url.Values{}
+	data.Add(field, value)
+	return doWithToken(t, "PUT", fmt.Sprintf("%s/%d", adminUsersURL, userID), adminToken, data)
+}
+
+func TestRequireRoleLetsAdminsThrough(t *testing.T) {
+	var testCases = []struct {
+		user     User
+		roles    []string
+		expected bool
+	}{
+		{User{Role: RoleWorker}, []string{RoleWorker}, true},
+		{User{Role: RoleWorker}, []string{RoleFarmOwner}, false},
+		{User{Role: RoleFarmOwner}, []string{RoleWorker, RoleFarmOwner}, true},
+		{User{Role: RoleAdmin}, []string{RoleFarmOwner}, true},
+		{User{}, []string{RoleWorker}, false},
+	}
+
+	for _, testCase := range testCases {
+		called := false
+		handler := RequireRole(testCase.roles...)(func(env *AppContext, w http.ResponseWriter, r *http.Request) {
+			called = true
+		})
+		test := GenerateHandleTester(t, func(env *AppContext, w http.ResponseWriter, r *http.Request) {
+			env.User = testCase.user
+			handler(env, w, r)
+		})
+		w := test("GET", url.Values{})
+		if called != testCase.expected {
+			t.Errorf("Expected %s passing RequireRole(%v) to be %v", testCase.user.Role, testCase.roles, testCase.expected)
+		}
+		if !called && w.Code != http.StatusForbidden {
+			t.Error("Expected status code 403 but got: ", w.Code)
+		}
+	}
+}
+
+func TestRolesGuardRoutes(t *testing.T) {
+	workerToken := signupAndSignin(t, "worker@farm.com", "some password")
+	ownerToken := signupAndSigninAs(t, "owner@farm.com", "some password", RoleFarmOwner)
+	adminToken := signupAndSigninAs(t, "admin@farm.com", "some password", RoleAdmin)
+	farm := Farm{}
+	postJSON(t, ownerToken, farmsURL, map[string]interface{}{"name": "Green Acres"}, &farm)
+	posting := JobPosting{}
+	postJSON(t, ownerToken, fmt.Sprintf("%s/%d/jobs", farmsURL, farm.ID), jobPostingJSON(1), &posting)
+
+	data := url.Values{}
+	data.Add("name", "Brown Acres")
+
+	var testCases = []struct {
+		method             string
+		target             string
+		token              string
+		expectedStatusCode int
+		reason             string
+	}{
+		{"POST", farmsURL, workerToken, http.StatusForbidden, "Workers cannot create farms"},
+		{"POST", farmsURL, adminToken, http.StatusCreated, "Admins can do anything"},
+		{"POST", fmt.Sprintf("%s/%d/applications", jobsURL, posting.ID), ownerToken, http.StatusForbidden, "Farm owners cannot apply to jobs"},
+		{"GET", adminUsersURL, workerToken, http.StatusForbidden, "Workers cannot moderate"},
+		{"GET", adminUsersURL, ownerToken, http.StatusForbidden, "Farm owners cannot moderate"},
+		{"GET", adminUsersURL, adminToken, http.StatusOK, "Admins can moderate"},
+	}
+
+	for _, testCase := range testCases {
+		response := doWithToken(t, testCase.method, testCase.target, testCase.token, data)
+		if response.StatusCode != testCase.expectedStatusCode {
+			t.Errorf("Expected %d but got %d reason %s", testCase.expectedStatusCode, response.StatusCode, testCase.reason)
+		}
+	}
+
+	tearDown()
+}
+
+func TestSignupCannotChooseAdminRole(t *testing.T) {
+	data := url.Values{}
+	data.Add("firstname", "Mark")
+	data.Add("lastname", "Twain")
+	data.Add("email", "mark@twain.com")
+	data.Add("password", "Huckelberry")
+	data.Add("role", RoleAdmin)
+
+	request, _ := http.NewRequest("POST", signupURL, strings.NewReader(data.Encode()))
+	request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if apiError := errorResponse(t, response); response.StatusCode != http.StatusBadRequest || apiError.Fields[0].Field != "role" {
+		t.Error("Expected the role to be rejected got:", response.StatusCode, apiError)
+	}
+
+	tearDown()
+}
+
+func TestAdminsModerateUsers(t *testing.T) {
+	workerToken := signupAndSignin(t, "worker@farm.com", "some password")
+	adminToken := signupAndSigninAs(t, "admin@farm.com", "some password", RoleAdmin)
+	workerID := userIDByEmail("worker@farm.com")
+
+	response := doWithToken(t, "GET", adminUsersURL+"?role="+RoleWorker, adminToken, url.Values{})
+	users := []adminUserView{}
+	json.NewDecoder(response.Body).Decode(&users)
+	if len(users) != 1 || users[0].ID != workerID {
+		t.Error("Expected to list only the worker got:", users)
+	}
+
+	var testCases = []struct {
+		token              string
+		userID             uint
+		field              string
+		value              string
+		expectedStatusCode int
+		reason             string
+	}{
+		{adminToken, workerID, "role", "superuser", http.StatusBadRequest, "Unknown role"},
+		{adminToken, userIDByEmail("admin@farm.com"), "suspended", "true", http.StatusForbidden, "Admins cannot suspend themselves"},
+		{adminToken, workerID + 1000, "suspended", "true", http.StatusNotFound, "Unknown user"},
+		{adminToken, workerID, "role", RoleFarmOwner, http.StatusOK, "Promote the worker"},
+	}
+
+	for _, testCase := range testCases {
+		response := moderateTestUser(t, testCase.token, testCase.userID, testCase.field, testCase.value)
+		if response.StatusCode != testCase.expectedStatusCode {
+			t.Errorf("Expected %d but got %d reason %s", testCase.expectedStatusCode, response.StatusCode, testCase.reason)
+		}
+	}
+
+	postJSON(t, workerToken, farmsURL, map[string]interface{}{"name": "Promoted Acres"}, &Farm{})
+
+	response = moderateTestUser(t, adminToken, workerID, "suspended", "true")
+	if response.StatusCode != http.StatusOK {
+		t.Fatal("Expected status code 200 but got: ", response.StatusCode)
+	}
+
+	response = doWithToken(t, "GET", farmsURL, workerToken, url.Values{})
+	if response.StatusCode != http.StatusUnauthorized {
+		t.Error("Expected suspended user to be signed out but got: ", response.StatusCode)
+	}
+
+	request, _ := http.NewRequest("POST", signinURL, nil)
+	request.SetBasicAuth("worker@farm.com", "some password")
+	response, _ = http.DefaultClient.Do(request)
+	if response.StatusCode != http.StatusUnauthorized {
+		t.Error("Expected suspended user to be unable to sign in but got: ", response.StatusCode)
+	}
+
+	moderateTestUser(t, adminToken, workerID, "suspended", "false")
+	signin(t, "worker@farm.com", "some password", "")
+
+	tearDown()
+}
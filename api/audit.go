@@ -0,0 +1,28 @@
+package api
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/jinzhu/gorm"
+)
+
+// Audit event actions
+const (
+	AuditSigninLockout     = "signin.lockout"
+	AuditTwoFactorEnabled  = "twofactor.enabled"
+	AuditTwoFactorDisabled = "twofactor.disabled"
+	AuditRecoveryCodeUsed  = "twofactor.recovery_code_used"
+)
+
+// recordAuditEvent saves the event and writes it to the log. Failing to save it
+// must not fail the request so the error is only logged
+func recordAuditEvent(db *gorm.DB, event AuditEvent) {
+	log.WithFields(log.Fields{
+		"audit":   event.Action,
+		"user_id": event.UserID,
+		"ip":      event.IP,
+	}).Warn(event.Detail)
+
+	if err := db.Create(&event).Error; err != nil {
+		log.WithFields(log.Fields{"action": "recordAuditEvent"}).Error(err)
+	}
+}
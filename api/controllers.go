@@ -1,13 +1,18 @@
 package api
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
-	"encoding/json"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io/ioutil"
-	"math/rand"
+	"net"
 	"net/http"
+	"net/mail"
+	"regexp"
 	"strings"
 	"time"
 
@@ -18,13 +23,38 @@ import (
 	"golang.org/x/crypto/bcrypt"
 )
 
-var requiredSignupFields = []string{"firstname", "lastname", "email", "password"}
+// signupRequest is the body of a Signup request
+type signupRequest struct {
+	FirstName string `json:"firstname" validate:"required"`
+	LastName  string `json:"lastname" validate:"required"`
+	Email     string `json:"email" validate:"required"`
+	Password  string `json:"password" validate:"required"`
+	Role      string `json:"role"` // worker or farm_owner, defaults to worker
+}
 
-// AppContext contains state that is passed between requests
+func (request signupRequest) validate() (errs fieldErrors) {
+	if address, err := mail.ParseAddress(request.Email); err != nil || address.Address != request.Email {
+		errs.add("email", "must be an email address")
+	}
+	if request.Role != "" && request.Role != RoleWorker && request.Role != RoleFarmOwner {
+		errs.add("role", fmt.Sprintf("must be %s or %s", RoleWorker, RoleFarmOwner))
+	}
+	return
+}
+
+// AppContext contains state that is passed between requests. Each request is
+// handed its own copy so the fields set while handling it, like the
+// authenticated User, are never seen by any other request
 type AppContext struct {
-	DB     *gorm.DB
-	Apikey string
-	User   User
+	DB             *gorm.DB
+	Apikey         string
+	User           User
+	AuthToken      AuthToken // the session the user authenticated with
+	Mailer         Mailer
+	Attempts       AttemptStore  // failed signins used to lock out brute force attempts
+	OIDC           *OIDCProvider // nil when OpenID Connect login is not configured
+	TOTPKey        string        // encrypts TOTP secrets, empty when two factor authentication is not configured
+	TrustedProxies []*net.IPNet  // proxies whose X-Forwarded-For header is believed
 }
 
 // AppHandler contains global state for processing the request
@@ -72,35 +102,32 @@ func comparePassword(password, hashedPassword string) (err error) {
 	return bcrypt.CompareHashAndPassword(b, a)
 }
 
-func randomString(strlen int) string {
-	rand.Seed(time.Now().UTC().UnixNano())
-	const chars = "abcdefghijklmnopqrstuvwxyz0123456789"
-	result := make([]byte, strlen)
-	for i := 0; i < strlen; i++ {
-		result[i] = chars[rand.Intn(len(chars))]
+// tokenBytes is the number of random bytes in every token we hand out
+const tokenBytes = 32
+
+// generateToken returns a url safe token made from tokenBytes of crypto/rand
+func generateToken() (string, error) {
+	b := make([]byte, tokenBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
 	}
-	return string(result)
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashToken is the SHA-256 digest of a token which is all we keep in the
+// database so a leaked table cannot be used to sign in
+func hashToken(token string) string {
+	digest := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(digest[:])
 }
 
 // Signup route for a user. Takes and validates the sign in information
-// returns user information json blob
+// returns the new user's own view of their account
 func Signup(env *AppContext, w http.ResponseWriter, r *http.Request) {
-	missingFields := []string{}
-	signupFields := map[string]string{}
-
-	for _, field := range requiredSignupFields {
-		value := r.PostFormValue(field)
-		if value == "" {
-			missingFields = append(missingFields, field)
-		} else {
-			signupFields[field] = value
-		}
-	}
-
-	if len(missingFields) != 0 {
-		errorMessage := fmt.Sprintf("Signup was missing required fields %q", missingFields)
-		log.Error(errorMessage)
-		http.Error(w, errorMessage, http.StatusBadRequest)
+	request := signupRequest{}
+	if err := decodeRequest(r, &request); err != nil {
+		log.WithFields(log.Fields{"action": "signup"}).Error(err)
+		writeError(w, r, err)
 		return
 	}
 
@@ -108,44 +135,41 @@ func Signup(env *AppContext, w http.ResponseWriter, r *http.Request) {
 	// decryptedPassword, err := encrypt.AESDecrypt(apiKey, encryptedPassword)
 	// if err != nil {
 	// 	log.Println(err)
-	// 	http.Error(w, "ServerError", http.StatusInternalServerError)
+	// 	writeError(w, r, errServer)
 	// 	return
 	// }
 	//
-	saltedPassword, err := saltPassword(signupFields["password"])
+	saltedPassword, err := saltPassword(request.Password)
 	if err != nil {
 		log.Error(err)
-		http.Error(w, "ServerError", http.StatusInternalServerError)
+		writeError(w, r, errServer)
 		return
 	}
 
-	user := User{FirstName: signupFields["firstname"],
-		LastName:     signupFields["lastname"],
+	user := User{FirstName: request.FirstName,
+		LastName:     request.LastName,
 		Password:     saltedPassword,
-		PrimaryEmail: signupFields["email"],
-	}
-
-	js, err := user.toJSON()
-	if err != nil {
-		log.Error(err)
-		http.Error(w, "ServerError", http.StatusInternalServerError)
-		return
+		PrimaryEmail: request.Email,
+		Role:         request.Role,
 	}
 
 	err = user.Save(env.DB)
 	if err != nil {
 		log.Error(err)
-		http.Error(w, "Bad Request", http.StatusBadRequest)
+		writeError(w, r, err)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(js)
+	// The account exists either way, if the mail fails they can ask for it again
+	if err := sendEmailVerification(env.DB, env.Mailer, user); err != nil {
+		log.WithFields(log.Fields{"action": "signup"}).Error(err)
+	}
+	writeJSON(w, http.StatusOK, newSelfView(user))
 }
 
 func authenticateUser(db *gorm.DB, email, password string) (user User, err error) {
 	db.Where(User{PrimaryEmail: email}).First(&user)
-	if user.PrimaryEmail == email && comparePassword(password, user.Password) == nil {
+	if user.PrimaryEmail == email && comparePassword(password, user.Password) == nil && !user.IsSuspended() {
 		return
 	}
 
@@ -153,16 +177,41 @@ func authenticateUser(db *gorm.DB, email, password string) (user User, err error
 	return user, AuthenticationError{"Authorization denied"}
 }
 
-func authenticateTokenUser(db *gorm.DB, token string) (user User, err error) {
-	db.Preload("AuthToken", "token = ?", token).First(&user)
-	empty := User{}
-	if user == empty {
+// authenticateTokenUser resolves the user signed in with the token along with
+// the session it belongs to. Revoked and expired sessions are rejected
+func authenticateTokenUser(db *gorm.DB, token string) (user User, session AuthToken, err error) {
+	db.Where("token = ?", hashToken(token)).First(&session)
+	if session.ID == 0 || session.isExpired() {
+		err = AuthenticationError{"No user found for token"}
+		log.Error(err)
+		return
+	}
+
+	if db.First(&user, session.UserID).RecordNotFound() || user.IsSuspended() {
 		err = AuthenticationError{"No user found for token"}
 		log.Error(err)
 	}
 	return
 }
 
+// sessionTouchInterval is how stale a session's last use can get before it is
+// written again. Writing on every request would cost a write per request
+const sessionTouchInterval = time.Minute
+
+// touchSession records when and where a session was last used
+func touchSession(db *gorm.DB, session *AuthToken, ip string) {
+	now := time.Now()
+	if now.Sub(session.LastUsedAt) < sessionTouchInterval && session.IP == ip {
+		return
+	}
+	session.LastUsedAt = now
+	session.IP = ip
+	db.Model(session).UpdateColumns(map[string]interface{}{
+		"last_used_at": session.LastUsedAt,
+		"ip":           session.IP,
+	})
+}
+
 func parseAuthTokenFromRequest(r *http.Request) (token string, err error) {
 	if r.Header["Authorization"] == nil {
 		return "", errors.New("Authorization Header was not found")
@@ -194,57 +243,70 @@ func parseBasicAuthHeader(r *http.Request) (username, password string, err error
 	return pair[0], pair[1], err
 }
 
-// Signin checks user to see if valid auth token if yes generates new auth token and expires
-// old
+// signinRequest is the optional body of a Signin request naming the device
+type signinRequest struct {
+	Device string `json:"device"`
+}
+
+// Signin starts a new session for the authenticated user and returns its auth
+// token along with a refresh token. Each device signs in with its own session
+// labelled by the device field. Users with two factor authentication enabled
+// are given a challenge to complete at /signin/twofactor instead
 func Signin(env *AppContext, w http.ResponseWriter, r *http.Request) {
 	user := env.User // Get the authenticated user
-	if user.AuthToken.isExpired() {
-		newToken := AuthToken{Token: randomString(20),
-			Expiry: oneDayFromNow()}
-		env.DB.Model(&user).Update("AuthToken", newToken)
+	request := signinRequest{}
+	if err := decodeRequest(r, &request); err != nil {
+		log.WithFields(log.Fields{"action": "signin"}).Error(err)
+		writeError(w, r, err)
+		return
 	}
 
-	token := struct {
-		Token  string
-		Expiry time.Time
-	}{
-		user.AuthToken.Token,
-		user.AuthToken.Expiry,
+	// The password alone is not enough, hand out a challenge to be completed
+	// with a code from the user's authenticator
+	if user.HasTwoFactor() {
+		challenge, err := issueTwoFactorChallenge(env.DB, user, request.Device)
+		if err != nil {
+			log.WithFields(log.Fields{"action": "signin"}).Error(err)
+			writeError(w, r, errServer)
+			return
+		}
+		writeJSON(w, http.StatusOK, challenge)
+		return
 	}
-	js, err := json.Marshal(token)
+
+	familyID, err := generateToken()
 	if err != nil {
 		log.WithFields(log.Fields{
 			"action": "signin",
 		}).Error(err)
-		http.Error(w, "ServerError", http.StatusInternalServerError)
+		writeError(w, r, errServer)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(js)
-}
-
-func resetPassword(w http.ResponseWriter, r *http.Request) {
-	// do nothing atm
-	// require username and secret token
-	// THings to do:
-	//  need a new password
-	// validate current password
-	// setup new password
-	// save
+	tokens, err := startSession(env.DB, user, request.Device, remoteIP(env, r), familyID)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"action": "signin",
+		}).Error(err)
+		writeError(w, r, errServer)
+		return
+	}
+	writeJSON(w, http.StatusOK, tokens)
 }
 
+// clearToken signs out the session used to make the request leaving the user's
+// other devices signed in
 func clearToken(env *AppContext, w http.ResponseWriter, r *http.Request) {
-	user := env.User
-	if user.AuthToken.isExpired() == false {
-		db.Where("token = ?", user.AuthToken.Token).Delete(&AuthToken{})
+	session := env.AuthToken
+	if session.isExpired() == false {
+		env.DB.Delete(&session)
 
 		// expire the token and update the database
 		w.Header().Set("Content-Type", "application/text")
 		w.Write([]byte("Token Cleared"))
 		return
 	}
-	http.Error(w, "authorization failed", http.StatusUnauthorized)
+	writeError(w, r, AuthenticationError{"authorization failed"})
 	return
 }
 
@@ -253,18 +315,21 @@ func authenticateAuthToken(h Handler) Handler {
 		token, err := parseAuthTokenFromRequest(r)
 		if err != nil {
 			log.Println(err)
-			http.Error(w, "authorization failed", http.StatusUnauthorized)
+			writeError(w, r, AuthenticationError{"authorization failed"})
 			return
 		}
 
-		user, err := authenticateTokenUser(env.DB, token)
+		user, session, err := authenticateTokenUser(env.DB, token)
 		if err != nil {
 			log.Println(err)
-			http.Error(w, "authorization failed", http.StatusUnauthorized)
+			writeError(w, r, AuthenticationError{"authorization failed"})
 			return
 		}
+		touchSession(env.DB, &session, remoteIP(env, r))
+
 		// lookup user with token and attach to authenticated request
 		env.User = user
+		env.AuthToken = session
 		h(env, w, r)
 	}
 }
@@ -275,48 +340,79 @@ func BasicAuth(h Handler) Handler {
 		email, password, err := parseBasicAuthHeader(r)
 		if err != nil {
 			log.WithFields(log.Fields{"action": "BasicAuth"}).Error(err)
-			http.Error(w, "authorization failed", http.StatusUnauthorized)
+			writeError(w, r, AuthenticationError{"authorization failed"})
 			return
 		}
+
+		keys := signinKeys(env, email, remoteIP(env, r))
+		until, err := lockedOutUntil(env.Attempts, keys)
+		if err != nil {
+			log.WithFields(log.Fields{"action": "BasicAuth"}).Error(err)
+			writeError(w, r, errServer)
+			return
+		}
+		if until.After(time.Now()) {
+			log.WithFields(log.Fields{"action": "BasicAuth", "ip": remoteIP(env, r)}).Error("Signin attempted while locked out")
+			writeLockedOut(w, r, until)
+			return
+		}
+
 		user, err := authenticateUser(env.DB, email, password)
 		if err != nil {
 			log.WithFields(log.Fields{"action": "BasicAuth"}).Error(err)
-			http.Error(w, "authorization failed", http.StatusUnauthorized)
+			until, err := recordSigninFailure(env, keys, email, remoteIP(env, r))
+			if err != nil {
+				log.WithFields(log.Fields{"action": "BasicAuth"}).Error(err)
+			}
+			if until.After(time.Now()) {
+				writeLockedOut(w, r, until)
+				return
+			}
+			writeError(w, r, AuthenticationError{"authorization failed"})
 			return
 		}
 
+		// Users with two factor authentication keep their failures until they
+		// also get the code right otherwise every signin would allow a fresh
+		// round of guesses at it
+		if !user.HasTwoFactor() {
+			if err := env.Attempts.Reset(keys[0].key); err != nil {
+				log.WithFields(log.Fields{"action": "BasicAuth"}).Error(err)
+			}
+		}
+
 		env.User = user
 		h(env, w, r)
 
 	}
 }
 
-// PostOnly middleware for filtering non post requests
-func PostOnly(h Handler) Handler {
-	return func(env *AppContext, w http.ResponseWriter, r *http.Request) {
-		if r.Method != "POST" {
-			log.WithFields(log.Fields{
-				"url":         r.URL,
-				"http_method": r.Method,
-				"datetime":    time.Now(),
-			}).Error("POST requests only")
-			http.Error(w, "POST requests only", http.StatusMethodNotAllowed)
-			return
+// RequireRole middleware only lets users with one of the roles through. Admins
+// are always let through. It must run after the user has been authenticated
+func RequireRole(roles ...string) func(Handler) Handler {
+	return func(h Handler) Handler {
+		return func(env *AppContext, w http.ResponseWriter, r *http.Request) {
+			if !env.User.HasRole(roles...) && !env.User.HasRole(RoleAdmin) {
+				log.WithFields(log.Fields{
+					"user_id": env.User.ID,
+					"role":    env.User.Role,
+					"url":     r.URL,
+				}).Error("User does not have the required role")
+				writeError(w, r, forbidden(fmt.Sprintf("Requires the %s role", strings.Join(roles, " or "))))
+				return
+			}
+			h(env, w, r)
 		}
-		h(env, w, r)
 	}
 }
 
-// GetOnly middleware for filtering non get requests
-func GetOnly(h Handler) Handler {
+// RequireVerifiedEmail middleware only lets users who have verified their email
+// address through. It must run after the user has been authenticated
+func RequireVerifiedEmail(h Handler) Handler {
 	return func(env *AppContext, w http.ResponseWriter, r *http.Request) {
-		if r.Method != "GET" {
-			log.WithFields(log.Fields{
-				"url":         r.URL,
-				"http_method": r.Method,
-				"datetime":    time.Now(),
-			}).Error("GET requests only")
-			http.Error(w, "GET requests only", http.StatusMethodNotAllowed)
+		if !env.User.IsVerified() {
+			log.WithFields(log.Fields{"user_id": env.User.ID, "url": r.URL}).Error("User has not verified their email")
+			writeError(w, r, forbidden("Verify your email address first"))
 			return
 		}
 		h(env, w, r)
@@ -324,17 +420,55 @@ func GetOnly(h Handler) Handler {
 }
 
 func checkResponseBody(response *http.Request) string {
+	// Requests built in tests without a body have none to read
+	if response.Body == nil {
+		return ""
+	}
 	body, _ := ioutil.ReadAll(response.Body)
 	return string(body)
 }
 
+type contextKey int
+
+const (
+	requestIDKey contextKey = iota
+	pathParamsKey
+)
+
+// requestIDHeader carries the ID of a request so it can be matched up with the
+// logs. Clients may send their own otherwise one is generated
+const requestIDHeader = "X-Request-ID"
+
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// withRequestID tags the request with its ID and echoes it back in the response
+func withRequestID(w http.ResponseWriter, r *http.Request) *http.Request {
+	id := r.Header.Get(requestIDHeader)
+	if !validRequestID.MatchString(id) {
+		b := make([]byte, 16)
+		rand.Read(b)
+		id = hex.EncodeToString(b)
+	}
+	w.Header().Set(requestIDHeader, id)
+	return r.WithContext(context.WithValue(r.Context(), requestIDKey, id))
+}
+
+// requestID returns the ID the request was tagged with when it was received
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey).(string)
+	return id
+}
+
 func (h AppHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	start := time.Now()
-	h.HandlerFunc(h.AppContext, w, r)
+	r = withRequestID(w, r)
+	env := *h.AppContext
+	h.HandlerFunc(&env, w, r)
 	end := time.Now()
 	latency := end.Sub(start)
 	log.WithFields(log.Fields{
 		"datetime":           start,
+		"request_id":         requestID(r),
 		"url":                r.URL,
 		"ip":                 r.RemoteAddr,
 		"latency_nanesecond": latency.Nanoseconds(),
@@ -346,11 +480,69 @@ func (h AppHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 // Handlers register api routes here
-func Handlers() *http.ServeMux {
-	context := &AppContext{DB: GetDB(), Apikey: "15c035e1cd738ee91910a3d19f93cb92"}
-	mux := http.NewServeMux()
-	mux.Handle("/signup", AppHandler{context, PostOnly(Signup)})
-	mux.Handle("/signin", AppHandler{context, PostOnly(BasicAuth(Signin))})
-	mux.Handle("/clearToken", AppHandler{context, PostOnly(authenticateAuthToken(clearToken))})
-	return mux
+func Handlers() http.Handler {
+	db := GetDB()
+	context := &AppContext{DB: db, Apikey: "15c035e1cd738ee91910a3d19f93cb92", Mailer: newMailer(), Attempts: DBAttemptStore{DB: db}, OIDC: newOIDCProvider(), TOTPKey: newTOTPKey(), TrustedProxies: newTrustedProxies()}
+	limits := routeRateLimits
+	publicThrottle := Throttle(limits.Public)
+	// Every IP has a budget for the routes needing a signed in user that is
+	// spent before the token is looked up so made up tokens are throttled too.
+	// Signed in users then share one budget across every route they call
+	ipThrottle := Throttle(limits.Auth)
+	userThrottle := Throttle(limits.User)
+	auth := func(h Handler) Handler {
+		return ipThrottle(authenticateAuthToken(userThrottle(h)))
+	}
+
+	router := NewRouter()
+	router.Handle("POST", "/signup", Throttle(limits.Signup)(Signup))
+	router.Handle("POST", "/signin", Throttle(limits.Signin)(BasicAuth(Signin)))
+	router.Handle("POST", "/signin/twofactor", Throttle(limits.Signin)(CompleteTwoFactorSignin))
+	router.Handle("GET", "/oidc/login", publicThrottle(StartOIDCLogin))
+	router.Handle("GET", "/oidc/callback", publicThrottle(OIDCCallback))
+	router.Handle("POST", "/clearToken", auth(clearToken))
+	router.Handle("POST", "/token/refresh", publicThrottle(RefreshToken))
+	router.Handle("GET", "/sessions", auth(ListSessions))
+	router.Handle("DELETE", "/sessions/:sessionid", auth(RevokeSession))
+	router.Handle("POST", "/password/reset", Throttle(limits.Mail)(RequestPasswordReset))
+	router.Handle("POST", "/password/reset/confirm", publicThrottle(ConfirmPasswordReset))
+	router.Handle("POST", "/verify", publicThrottle(VerifyEmail))
+	router.Handle("POST", "/verify/resend", auth(Throttle(limits.Mail)(ResendEmailVerification)))
+	router.Handle("POST", "/twofactor", auth(EnrollTwoFactor))
+	router.Handle("POST", "/twofactor/confirm", auth(ConfirmTwoFactor))
+	router.Handle("POST", "/twofactor/disable", auth(DisableTwoFactor))
+
+	router.Handle("GET", "/farms", auth(listFarms))
+	router.Handle("POST", "/farms", auth(RequireRole(RoleFarmOwner)(createFarm)))
+	router.Handle("GET", "/farms/search", auth(SearchFarms))
+	router.Handle("GET", "/farms/:farmid", auth(showFarm))
+	router.Handle("PUT", "/farms/:farmid", auth(updateFarm))
+	router.Handle("DELETE", "/farms/:farmid", auth(deleteFarm))
+	router.Handle("GET", "/farms/:farmid/crops", auth(listCrops))
+	router.Handle("POST", "/farms/:farmid/crops", auth(createCrop))
+	router.Handle("PUT", "/farms/:farmid/crops/:cropid", auth(updateCrop))
+	router.Handle("DELETE", "/farms/:farmid/crops/:cropid", auth(deleteCrop))
+	router.Handle("GET", "/farms/:farmid/engagements", auth(listEngagements))
+	router.Handle("POST", "/farms/:farmid/engagements", auth(createEngagement))
+	router.Handle("PUT", "/farms/:farmid/engagements/:engagementid", auth(completeEngagement))
+	router.Handle("GET", "/farms/:farmid/reviews", auth(FarmReviews))
+	router.Handle("GET", "/farms/:farmid/tasks", auth(listFarmTasks))
+	router.Handle("POST", "/farms/:farmid/tasks", auth(createTask))
+	router.Handle("PUT", "/farms/:farmid/tasks/:taskid", auth(updateTask))
+	router.Handle("GET", "/farms/:farmid/jobs", auth(listFarmJobPostings))
+	router.Handle("POST", "/farms/:farmid/jobs", auth(createJobPosting))
+
+	router.Handle("POST", "/reviews", auth(CreateReview))
+	router.Handle("GET", "/jobs", auth(JobPostings))
+	router.Handle("GET", "/jobs/:jobid", auth(showJobPosting))
+	router.Handle("GET", "/jobs/:jobid/applications", auth(listApplications))
+	router.Handle("POST", "/jobs/:jobid/applications", auth(RequireRole(RoleWorker)(RequireVerifiedEmail(createApplication))))
+	router.Handle("PUT", "/jobs/:jobid/applications/:applicationid", auth(updateApplication))
+	router.Handle("GET", "/tasks", auth(AssignedTasks))
+	router.Handle("GET", "/users/me", auth(ShowSelf))
+	router.Handle("GET", "/users/:userid", auth(ShowUser))
+
+	router.Handle("GET", "/admin/users", auth(RequireRole(RoleAdmin)(ListUsers)))
+	router.Handle("PUT", "/admin/users/:userid", auth(RequireRole(RoleAdmin)(ModerateUser)))
+	return AppHandler{context, router.Dispatch}
 }
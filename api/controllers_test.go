@@ -1,6 +1,7 @@
 package api
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -10,6 +11,7 @@ import (
 	"net/url"
 	"os"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -23,18 +25,45 @@ var (
 	signinURL     string
 	getTokenURL   string
 	clearTokenURL string
+	adminUsersURL string // set here as admin_test.go is initialised before this file
 )
 
+// testTOTPKey encrypts TOTP secrets for the test server
+const testTOTPKey = "0123456789abcdef0123456789abcdef"
+
 func init() {
 	os.Setenv("GOENV", "test")
+	os.Setenv("TOTP_ENCRYPTION_KEY", testTOTPKey)
+	// The whole suite signs up and signs in from one address which would trip
+	// the real limits, the limits themselves are tested in ratelimit_test.go
+	generous := RateLimit{Requests: 100000, Per: time.Minute}
+	routeRateLimits = rateLimits{Signup: generous, Signin: generous, Mail: generous, Public: generous, Auth: generous, User: generous}
 	server = httptest.NewServer(Handlers())                  //Creating new server with the user handlers
 	signupURL = fmt.Sprintf("%s/signup", server.URL)         //Grab the address for the API endpoint
 	signinURL = fmt.Sprintf("%s/signin", server.URL)         //Grab the address for the API endpoint
 	getTokenURL = fmt.Sprintf("%s/getToken", server.URL)     //Grab the address for the API endpoint
 	clearTokenURL = fmt.Sprintf("%s/clearToken", server.URL) //Grab the address for the API endpoint
+	adminUsersURL = fmt.Sprintf("%s/admin/users", server.URL)
 }
 
 func tearDown() {
+	GetDB().Exec("DELETE FROM applications;")
+	GetDB().Exec("DELETE FROM job_postings;")
+	GetDB().Exec("DELETE FROM tasks;")
+	GetDB().Exec("DELETE FROM reviews;")
+	GetDB().Exec("DELETE FROM engagements;")
+	GetDB().Exec("DELETE FROM crops;")
+	GetDB().Exec("DELETE FROM addresses;")
+	GetDB().Exec("DELETE FROM farms;")
+	GetDB().Exec("DELETE FROM password_resets;")
+	GetDB().Exec("DELETE FROM email_verifications;")
+	GetDB().Exec("DELETE FROM login_attempts;")
+	GetDB().Exec("DELETE FROM audit_events;")
+	GetDB().Exec("DELETE FROM recovery_codes;")
+	GetDB().Exec("DELETE FROM two_factor_challenges;")
+	GetDB().Exec("DELETE FROM external_identities;")
+	GetDB().Exec("DELETE FROM oidc_states;")
+	GetDB().Exec("DELETE FROM auth_tokens;")
 	GetDB().Exec("DELETE FROM users;")
 }
 
@@ -61,6 +90,96 @@ func setupUser() (expected User) {
 	return
 }
 
+// signupAndSignin creates a user with the given credentials and returns the auth
+// token issued when signing in as them
+func signupAndSignin(t *testing.T, email, password string) string {
+	return signupAndSigninAs(t, email, password, RoleWorker)
+}
+
+// signupAndSigninAs creates a verified user with the given role and returns the
+// auth token issued when signing in as them. Admins cannot sign up so they are
+// promoted directly in the database
+func signupAndSigninAs(t *testing.T, email, password, role string) string {
+	data := url.Values{}
+	data.Add("firstname", "test")
+	data.Add("lastname", "test")
+	data.Add("email", email)
+	data.Add("password", password)
+	if role != RoleAdmin {
+		data.Add("role", role)
+	}
+
+	request, _ := http.NewRequest("POST", signupURL, strings.NewReader(data.Encode()))
+	request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	if _, err := http.DefaultClient.Do(request); err != nil {
+		t.Fatal(err)
+	}
+	if role == RoleAdmin {
+		GetDB().Model(&User{}).Where(User{PrimaryEmail: email}).UpdateColumn("role", RoleAdmin)
+	}
+	GetDB().Model(&User{}).Where(User{PrimaryEmail: email}).UpdateColumn("email_verified_at", time.Now())
+
+	return signin(t, email, password, "")
+}
+
+// signin starts a new session for the user on the labelled device and returns
+// its auth token
+func signin(t *testing.T, email, password, device string) string {
+	data := url.Values{}
+	data.Add("device", device)
+
+	request, _ := http.NewRequest("POST", signinURL, strings.NewReader(data.Encode()))
+	request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	request.SetBasicAuth(email, password)
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	var jsonResponse map[string]interface{}
+	if err := json.NewDecoder(response.Body).Decode(&jsonResponse); err != nil {
+		t.Fatal(err)
+	}
+	return jsonResponse["Token"].(string)
+}
+
+// postJSON creates something by posting body as JSON authenticated with the
+// bearer token. The test fails unless it is created and the response is
+// decoded into out
+func postJSON(t *testing.T, token, target string, body interface{}, out interface{}) {
+	encoded, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request, _ := http.NewRequest("POST", target, bytes.NewReader(encoded))
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Authorization", "Bearer "+token)
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusCreated {
+		t.Fatal("Expected status code 201 but got: ", response.StatusCode)
+	}
+	if err := json.NewDecoder(response.Body).Decode(out); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// doWithToken issues a form encoded request authenticated with the bearer token
+func doWithToken(t *testing.T, method, target, token string, data url.Values) *http.Response {
+	request, _ := http.NewRequest(method, target, strings.NewReader(data.Encode()))
+	request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Authorization", "Bearer "+token)
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
+
 type HandleTester func(
 	method string,
 	params url.Values,
@@ -77,7 +196,7 @@ func GenerateHandleTester(t *testing.T, handleFunc Handler) HandleTester {
 			"application/x-www-form-urlencoded; param=value",
 		)
 		w := httptest.NewRecorder()
-		context := &AppContext{DB: GetDB(), Apikey: "15c035e1cd738ee91910a3d19f93cb92"}
+		context := &AppContext{DB: GetDB(), Apikey: "15c035e1cd738ee91910a3d19f93cb92", Mailer: LogMailer{}, Attempts: NewMemoryAttemptStore()}
 		appHandle := AppHandler{AppContext: context, HandlerFunc: handleFunc}
 		appHandle.ServeHTTP(w, req)
 		return w
@@ -96,37 +215,13 @@ func GenerateBasicAuthHandleTester(t *testing.T, handleFunc Handler, username, p
 		)
 		req.SetBasicAuth(username, password)
 		w := httptest.NewRecorder()
-		context := &AppContext{DB: GetDB(), Apikey: "15c035e1cd738ee91910a3d19f93cb92"}
+		context := &AppContext{DB: GetDB(), Apikey: "15c035e1cd738ee91910a3d19f93cb92", Mailer: LogMailer{}, Attempts: NewMemoryAttemptStore()}
 		appHandle := AppHandler{AppContext: context, HandlerFunc: handleFunc}
 		appHandle.ServeHTTP(w, req)
 		return w
 	}
 }
 
-func TestFilteringRouteHandlers(t *testing.T) {
-	var testCases = []struct {
-		handler            func(Handler) Handler
-		method             string
-		expectedStatusCode int
-	}{
-		{handler: GetOnly, method: "GET", expectedStatusCode: http.StatusOK},
-		{handler: GetOnly, method: "POST", expectedStatusCode: http.StatusMethodNotAllowed},
-		{handler: PostOnly, method: "POST", expectedStatusCode: http.StatusOK},
-		{handler: PostOnly, method: "GET", expectedStatusCode: http.StatusMethodNotAllowed},
-	}
-
-	for _, testCase := range testCases {
-		getHandler := testCase.handler(func(env *AppContext, w http.ResponseWriter, r *http.Request) {
-			return
-		})
-		test := GenerateHandleTester(t, getHandler)
-		w := test(testCase.method, url.Values{})
-		if w.Code != testCase.expectedStatusCode {
-			t.Errorf("Expected %d but got %d when method %s", testCase.expectedStatusCode, w.Code, testCase.method)
-		}
-	}
-}
-
 func TestAuthTokenIsNotExpiredWhenStillInFuture(t *testing.T) {
 	now := time.Now()
 	oneSecondInTheFuture := now.Add(time.Duration(1) * time.Second)
@@ -182,7 +277,7 @@ func TestSignUpHandler(t *testing.T) {
 		Reason             string
 	}{
 		{"valid first name", "valid last name", "valid@email.com", "valid password", http.StatusOK, "Should be success"},
-		{"valid first name", "valid last name", "valid@email.com", "valid password", http.StatusBadRequest, "Should fail because user exists"},
+		{"valid first name", "valid last name", "valid@email.com", "valid password", http.StatusConflict, "Should fail because user exists"},
 		{"", "valid last name", "valid@email.com", "valid password", http.StatusBadRequest, "Missing first name"},
 		{"valid first name", "", "valid@email.com", "valid password", http.StatusBadRequest, "Missing last name "},
 		{"valid first name", "valid last name", "", "valid password", http.StatusBadRequest, "Missing email"},
@@ -329,3 +424,85 @@ func Test401IsReturnedWhenInvalidTokenIsSent(t *testing.T) {
 
 	tearDown()
 }
+
+func TestGenerateTokenIsUniqueAndUrlSafe(t *testing.T) {
+	seen := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		token, err := generateToken()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seen[token] {
+			t.Fatal("Generated duplicate token:", token)
+		}
+		seen[token] = true
+
+		if len(token) != 43 || strings.ContainsAny(token, "+/=") {
+			t.Error("Expected 43 url safe characters got:", token)
+		}
+	}
+}
+
+func TestHashTokenIsSHA256Hex(t *testing.T) {
+	expected := "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	if result := hashToken(""); result != expected {
+		t.Error("expected:", expected, "got:", result)
+	}
+	if hashToken("a") == hashToken("b") {
+		t.Error("Expected different tokens to have different digests")
+	}
+}
+
+// TestConcurrentRequestsKeepTheirOwnUser fires authenticated requests for
+// several users in parallel and checks each one is answered as the user who
+// made it. Run with -race to also catch unsynchronised access to shared state
+func TestConcurrentRequestsKeepTheirOwnUser(t *testing.T) {
+	tokens := map[string]string{}
+	for i := 0; i < 5; i++ {
+		email := fmt.Sprintf("worker%d@farm.com", i)
+		tokens[email] = signupAndSignin(t, email, "some password")
+	}
+
+	var wg sync.WaitGroup
+	for email, token := range tokens {
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func(email, token string) {
+				defer wg.Done()
+				request, _ := http.NewRequest("GET", server.URL+"/users/me", nil)
+				request.Header.Set("Authorization", "Bearer "+token)
+				response, err := http.DefaultClient.Do(request)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				defer response.Body.Close()
+
+				self := selfView{}
+				json.NewDecoder(response.Body).Decode(&self)
+				if self.PrimaryEmail != email {
+					t.Errorf("Expected request made by %s to be answered as them but got %q", email, self.PrimaryEmail)
+				}
+			}(email, token)
+		}
+	}
+	wg.Wait()
+
+	tearDown()
+}
+
+func TestAppHandlerGivesEachRequestItsOwnContext(t *testing.T) {
+	shared := &AppContext{DB: GetDB()}
+	handler := AppHandler{shared, func(env *AppContext, w http.ResponseWriter, r *http.Request) {
+		if env == shared || env.DB != shared.DB {
+			t.Error("Expected the handler to get a copy of the shared context")
+		}
+		env.User = User{FirstName: "Mark"}
+	}}
+
+	r, _ := http.NewRequest("GET", "/", nil)
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	if shared.User.FirstName != "" {
+		t.Error("Expected the shared context to be left untouched got:", shared.User)
+	}
+}
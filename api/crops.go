@@ -0,0 +1,177 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// dateFormat is the layout dates are submitted in
+const dateFormat = "2006-01-02"
+
+func parseDate(field, value string) (*time.Time, error) {
+	date, err := time.Parse(dateFormat, value)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid %s %q expected format YYYY-MM-DD", field, value)
+	}
+	return &date, nil
+}
+
+// cropRequest is the body of a request adding or changing a crop. Only the
+// fields present are changed when updating
+type cropRequest struct {
+	Name         *string `json:"name"`
+	Season       *string `json:"season"`
+	HarvestStart *string `json:"harveststart"`
+	HarvestEnd   *string `json:"harvestend"`
+}
+
+func (request cropRequest) validate() (errs fieldErrors) {
+	if request.Name != nil && *request.Name == "" {
+		errs.add("name", "cannot be blank")
+	}
+	if request.HarvestStart != nil {
+		if _, err := parseDate("harveststart", *request.HarvestStart); err != nil {
+			errs.add("harveststart", "must be a date formatted YYYY-MM-DD")
+		}
+	}
+	if request.HarvestEnd != nil {
+		if _, err := parseDate("harvestend", *request.HarvestEnd); err != nil {
+			errs.add("harvestend", "must be a date formatted YYYY-MM-DD")
+		}
+	}
+	return
+}
+
+// apply copies the fields present in the request onto the crop making sure
+// the harvest window still ends after it starts
+func (request cropRequest) apply(crop *Crop) error {
+	if request.Name != nil {
+		crop.Name = *request.Name
+	}
+	if request.Season != nil {
+		crop.Season = *request.Season
+	}
+	if request.HarvestStart != nil {
+		crop.HarvestStart, _ = parseDate("harveststart", *request.HarvestStart)
+	}
+	if request.HarvestEnd != nil {
+		crop.HarvestEnd, _ = parseDate("harvestend", *request.HarvestEnd)
+	}
+
+	if crop.HarvestStart != nil && crop.HarvestEnd != nil && crop.HarvestEnd.Before(*crop.HarvestStart) {
+		return ValidationError{Fields: []FieldError{{Field: "harvestend", Message: "must be after harveststart"}}}
+	}
+	return nil
+}
+
+func listCrops(env *AppContext, w http.ResponseWriter, r *http.Request) {
+	farm, ok := findFarm(env, w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, farm.Crops)
+}
+
+func createCrop(env *AppContext, w http.ResponseWriter, r *http.Request) {
+	farm, ok := findOwnedFarm(env, w, r)
+	if !ok {
+		return
+	}
+
+	request := cropRequest{}
+	err := decodeRequest(r, &request)
+	if err == nil && request.Name == nil {
+		err = ValidationError{Fields: []FieldError{{Field: "name", Message: "is required"}}}
+	}
+
+	crop := Crop{FarmID: farm.ID}
+	if err == nil {
+		err = request.apply(&crop)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{"action": "createCrop"}).Error(err)
+		writeError(w, r, err)
+		return
+	}
+
+	if err := env.DB.Create(&crop).Error; err != nil {
+		log.WithFields(log.Fields{"action": "createCrop"}).Error(err)
+		writeError(w, r, errServer)
+		return
+	}
+	writeJSON(w, http.StatusCreated, crop)
+}
+
+// findFarmCrop looks up the crop referenced in the request path making sure it
+// belongs to the given farm
+func findFarmCrop(env *AppContext, w http.ResponseWriter, r *http.Request, farm Farm) (crop Crop, ok bool) {
+	id, err := pathID(r, "cropid")
+	if err != nil {
+		writeError(w, r, badRequest(err.Error()))
+		return
+	}
+
+	query := env.DB.Where(Crop{FarmID: farm.ID}).First(&crop, id)
+	if query.RecordNotFound() {
+		writeError(w, r, notFound("Crop not found"))
+		return
+	}
+	if query.Error != nil {
+		log.WithFields(log.Fields{"action": "findFarmCrop"}).Error(query.Error)
+		writeError(w, r, errServer)
+		return
+	}
+	return crop, true
+}
+
+func updateCrop(env *AppContext, w http.ResponseWriter, r *http.Request) {
+	farm, ok := findOwnedFarm(env, w, r)
+	if !ok {
+		return
+	}
+
+	crop, ok := findFarmCrop(env, w, r, farm)
+	if !ok {
+		return
+	}
+
+	request := cropRequest{}
+	err := decodeRequest(r, &request)
+	if err == nil {
+		err = request.apply(&crop)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{"action": "updateCrop"}).Error(err)
+		writeError(w, r, err)
+		return
+	}
+
+	if err := env.DB.Save(&crop).Error; err != nil {
+		log.WithFields(log.Fields{"action": "updateCrop"}).Error(err)
+		writeError(w, r, errServer)
+		return
+	}
+	writeJSON(w, http.StatusOK, crop)
+}
+
+func deleteCrop(env *AppContext, w http.ResponseWriter, r *http.Request) {
+	farm, ok := findOwnedFarm(env, w, r)
+	if !ok {
+		return
+	}
+
+	crop, ok := findFarmCrop(env, w, r, farm)
+	if !ok {
+		return
+	}
+
+	if err := env.DB.Delete(&crop).Error; err != nil {
+		log.WithFields(log.Fields{"action": "deleteCrop"}).Error(err)
+		writeError(w, r, errServer)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
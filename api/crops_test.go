@@ -0,0 +1,109 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestCreateCropIsListedForFarm(t *testing.T) {
+	ownerToken := signupAndSigninAs(t, "owner@farm.com", "some password", RoleFarmOwner)
+	workerToken := signupAndSignin(t, "worker@farm.com", "some password")
+	farm := Farm{}
+	postJSON(t, ownerToken, farmsURL, map[string]interface{}{"name": "Green Acres"}, &farm)
+	expected := Crop{}
+	postJSON(t, ownerToken, fmt.Sprintf("%s/%d/crops", farmsURL, farm.ID), map[string]interface{}{
+		"name":         "Strawberries",
+		"season":       "summer",
+		"harveststart": "2016-07-01",
+		"harvestend":   "2016-08-15",
+	}, &expected)
+
+	if expected.HarvestStart == nil || expected.HarvestEnd == nil {
+		t.Error("Expected harvest window to be saved got:", expected)
+	}
+
+	response := doWithToken(t, "GET", fmt.Sprintf("%s/%d/crops", farmsURL, farm.ID), workerToken, url.Values{})
+	crops := []Crop{}
+	json.NewDecoder(response.Body).Decode(&crops)
+	if len(crops) != 1 || crops[0].Name != "Strawberries" || crops[0].Season != "summer" {
+		t.Error("Expected to list the created crop got:", crops)
+	}
+
+	tearDown()
+}
+
+func TestCreateCropValidatesInput(t *testing.T) {
+	token := signupAndSigninAs(t, "owner@farm.com", "some password", RoleFarmOwner)
+	farm := Farm{}
+	postJSON(t, token, farmsURL, map[string]interface{}{"name": "Green Acres"}, &farm)
+
+	var testCases = []struct {
+		Name         string
+		HarvestStart string
+		HarvestEnd   string
+		Reason       string
+	}{
+		{"", "", "", "Missing name"},
+		{"Corn", "July", "", "Unparseable harvest start"},
+		{"Corn", "2016-09-01", "2016-08-01", "Harvest window ends before it starts"},
+	}
+
+	for _, testCase := range testCases {
+		data := url.Values{}
+		data.Add("name", testCase.Name)
+		data.Add("harveststart", testCase.HarvestStart)
+		data.Add("harvestend", testCase.HarvestEnd)
+
+		response := doWithToken(t, "POST", fmt.Sprintf("%s/%d/crops", farmsURL, farm.ID), token, data)
+		if response.StatusCode != http.StatusBadRequest {
+			t.Errorf("Expected %d but got %d reason %s", http.StatusBadRequest, response.StatusCode, testCase.Reason)
+		}
+	}
+
+	tearDown()
+}
+
+func TestOnlyOwnerCanManageCrops(t *testing.T) {
+	ownerToken := signupAndSigninAs(t, "owner@farm.com", "some password", RoleFarmOwner)
+	workerToken := signupAndSignin(t, "worker@farm.com", "some password")
+	farm := Farm{}
+	postJSON(t, ownerToken, farmsURL, map[string]interface{}{"name": "Green Acres"}, &farm)
+	crop := Crop{}
+	postJSON(t, ownerToken, fmt.Sprintf("%s/%d/crops", farmsURL, farm.ID), map[string]interface{}{
+		"name":         "Strawberries",
+		"season":       "summer",
+		"harveststart": "2016-07-01",
+		"harvestend":   "2016-08-15",
+	}, &crop)
+	cropURL := fmt.Sprintf("%s/%d/crops/%d", farmsURL, farm.ID, crop.ID)
+
+	data := url.Values{}
+	data.Add("name", "Blueberries")
+
+	var testCases = []struct {
+		method             string
+		url                string
+		token              string
+		expectedStatusCode int
+		reason             string
+	}{
+		{"POST", fmt.Sprintf("%s/%d/crops", farmsURL, farm.ID), workerToken, http.StatusForbidden, "Only the owner can add crops"},
+		{"PUT", cropURL, workerToken, http.StatusForbidden, "Only the owner can rename crops"},
+		{"DELETE", cropURL, workerToken, http.StatusForbidden, "Only the owner can remove crops"},
+		{"PUT", cropURL, ownerToken, http.StatusOK, "Owner can rename crops"},
+		{"DELETE", cropURL, ownerToken, http.StatusNoContent, "Owner can remove crops"},
+		{"DELETE", cropURL, ownerToken, http.StatusNotFound, "Removed crop is gone"},
+	}
+
+	for _, testCase := range testCases {
+		response := doWithToken(t, testCase.method, testCase.url, testCase.token, data)
+		if response.StatusCode != testCase.expectedStatusCode {
+			t.Errorf("Expected %d but got %d reason %s", testCase.expectedStatusCode, response.StatusCode, testCase.reason)
+		}
+	}
+
+	tearDown()
+}
@@ -7,7 +7,7 @@ import (
 	log "github.com/Sirupsen/logrus"
 
 	"github.com/jinzhu/gorm"
-	_ "github.com/lib/pq" // We are using postgres
+	"github.com/lib/pq" // We are using postgres
 )
 
 var db *gorm.DB
@@ -46,3 +46,16 @@ func connectToDatabase() *gorm.DB {
 	verifyDatabaseConnection(&db)
 	return &db
 }
+
+// isUniqueViolation checks whether postgres refused a row because it would
+// break a unique index. Checking first and then saving races with concurrent
+// requests so the index has the final say
+func isUniqueViolation(err error) bool {
+	switch e := err.(type) {
+	case *pq.Error:
+		return e.Code.Name() == "unique_violation"
+	case pq.Error:
+		return e.Code.Name() == "unique_violation"
+	}
+	return false
+}
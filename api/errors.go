@@ -0,0 +1,93 @@
+package api
+
+import (
+	"net/http"
+)
+
+// Error codes returned in the code field of every error response. Clients
+// should switch on these rather than the message which is meant for people
+const (
+	CodeBadRequest        = "bad_request"
+	CodeValidationFailed  = "validation_failed"
+	CodeAuthFailed        = "auth_failed"
+	CodeForbidden         = "forbidden"
+	CodeNotFound          = "not_found"
+	CodeMethodNotAllowed  = "method_not_allowed"
+	CodeConflict          = "conflict"
+	CodeUserExists        = "user_exists"
+	CodeReviewExists      = "review_exists"
+	CodeInvalidTransition = "invalid_transition"
+	CodeTooManyRequests   = "too_many_requests"
+	CodeServerError       = "server_error"
+)
+
+// APIError is the error returned to clients whenever a request fails
+type APIError struct {
+	Status    int          `json:"-"`
+	Code      string       `json:"code"`
+	Message   string       `json:"message"`
+	RequestID string       `json:"request_id,omitempty"`
+	Fields    []FieldError `json:"fields,omitempty"`
+}
+
+func (e APIError) Error() string {
+	return e.Message
+}
+
+// errServer is returned for failures the client cannot do anything about. The
+// underlying error is logged rather than shown to the client
+var errServer = APIError{Status: http.StatusInternalServerError, Code: CodeServerError, Message: "Internal server error"}
+
+func badRequest(message string) APIError {
+	return APIError{Status: http.StatusBadRequest, Code: CodeBadRequest, Message: message}
+}
+
+func forbidden(message string) APIError {
+	return APIError{Status: http.StatusForbidden, Code: CodeForbidden, Message: message}
+}
+
+func notFound(message string) APIError {
+	return APIError{Status: http.StatusNotFound, Code: CodeNotFound, Message: message}
+}
+
+func methodNotAllowed(message string) APIError {
+	return APIError{Status: http.StatusMethodNotAllowed, Code: CodeMethodNotAllowed, Message: message}
+}
+
+func conflict(message string) APIError {
+	return APIError{Status: http.StatusConflict, Code: CodeConflict, Message: message}
+}
+
+func tooManyRequests(message string) APIError {
+	return APIError{Status: http.StatusTooManyRequests, Code: CodeTooManyRequests, Message: message}
+}
+
+// toAPIError maps the errors raised by the api package on to the status and
+// code the client sees. Anything unrecognised is treated as a server error
+func toAPIError(err error) APIError {
+	switch e := err.(type) {
+	case APIError:
+		return e
+	case ValidationError:
+		return APIError{Status: http.StatusBadRequest, Code: CodeValidationFailed, Message: "Request has invalid fields", Fields: e.Fields}
+	case AuthenticationError:
+		return APIError{Status: http.StatusUnauthorized, Code: CodeAuthFailed, Message: "Authorization failed"}
+	case UserExistsError:
+		return APIError{Status: http.StatusConflict, Code: CodeUserExists, Message: "An account with that email already exists"}
+	case ReviewExistsError:
+		return APIError{Status: http.StatusConflict, Code: CodeReviewExists, Message: "Engagement has already been reviewed"}
+	case TaskTransitionError, ApplicationTransitionError:
+		return APIError{Status: http.StatusConflict, Code: CodeInvalidTransition, Message: e.Error()}
+	}
+	return errServer
+}
+
+// writeError responds to the request with err as a JSON error envelope tagged
+// with the request's ID
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	apiError := toAPIError(err)
+	apiError.RequestID = requestID(r)
+	writeJSON(w, apiError.Status, struct {
+		Error APIError `json:"error"`
+	}{apiError})
+}
@@ -0,0 +1,142 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// errorResponse decodes the error envelope written by writeError
+func errorResponse(t *testing.T, response *http.Response) APIError {
+	defer response.Body.Close()
+	result := struct {
+		Error APIError `json:"error"`
+	}{}
+	if err := json.NewDecoder(response.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	return result.Error
+}
+
+func TestTypedErrorsMapToStableCodes(t *testing.T) {
+	var testCases = []struct {
+		err                error
+		expectedStatusCode int
+		expectedCode       string
+	}{
+		{AuthenticationError{"Authorization denied"}, http.StatusUnauthorized, CodeAuthFailed},
+		{UserExistsError{"exists"}, http.StatusConflict, CodeUserExists},
+		{ReviewExistsError{"reviewed"}, http.StatusConflict, CodeReviewExists},
+		{TaskTransitionError{"Task cannot move from done to open"}, http.StatusConflict, CodeInvalidTransition},
+		{ApplicationTransitionError{"Application cannot move"}, http.StatusConflict, CodeInvalidTransition},
+		{ValidationError{Fields: []FieldError{{"email", "is required"}}}, http.StatusBadRequest, CodeValidationFailed},
+		{notFound("Farm not found"), http.StatusNotFound, CodeNotFound},
+		{errors.New("pq: connection refused"), http.StatusInternalServerError, CodeServerError},
+	}
+
+	for _, testCase := range testCases {
+		apiError := toAPIError(testCase.err)
+		if apiError.Status != testCase.expectedStatusCode || apiError.Code != testCase.expectedCode {
+			t.Errorf("Expected %d %s for %T but got %d %s", testCase.expectedStatusCode, testCase.expectedCode, testCase.err, apiError.Status, apiError.Code)
+		}
+	}
+
+	if message := toAPIError(errors.New("pq: connection refused")).Message; strings.Contains(message, "pq") {
+		t.Error("Expected server errors to hide the underlying error got:", message)
+	}
+}
+
+func TestWriteErrorIncludesRequestID(t *testing.T) {
+	r, _ := http.NewRequest("GET", "/farms/1", nil)
+	r.Header.Set(requestIDHeader, "abc-123")
+	w := httptest.NewRecorder()
+	r = withRequestID(w, r)
+
+	writeError(w, r, notFound("Farm not found"))
+
+	if w.Code != http.StatusNotFound || w.Header().Get("Content-Type") != "application/json" {
+		t.Error("Expected a 404 JSON response got:", w.Code, w.Header())
+	}
+	apiError := errorResponse(t, w.Result())
+	if apiError.Code != CodeNotFound || apiError.Message != "Farm not found" || apiError.RequestID != "abc-123" {
+		t.Error("Expected the error envelope to carry the code, message and request ID got:", apiError)
+	}
+}
+
+func TestRequestIDIsGeneratedWhenMissingOrInvalid(t *testing.T) {
+	for _, sent := range []string{"", "not a valid id!", strings.Repeat("a", 65)} {
+		r, _ := http.NewRequest("GET", "/", nil)
+		r.Header.Set(requestIDHeader, sent)
+		w := httptest.NewRecorder()
+		r = withRequestID(w, r)
+
+		id := requestID(r)
+		if id == "" || id == sent || w.Header().Get(requestIDHeader) != id {
+			t.Errorf("Expected a generated request ID for %q got %q", sent, id)
+		}
+	}
+}
+
+func TestDuplicateSignupIsToldApartFromBadRequest(t *testing.T) {
+	setupUser()
+
+	data := url.Values{}
+	data.Add("firstname", "Mark")
+	data.Add("lastname", "Twain")
+	data.Add("email", "mark@twain.com")
+	data.Add("password", "Huckelberry")
+
+	request, _ := http.NewRequest("POST", signupURL, strings.NewReader(data.Encode()))
+	request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set(requestIDHeader, "duplicate-signup")
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if response.StatusCode != http.StatusConflict || response.Header.Get(requestIDHeader) != "duplicate-signup" {
+		t.Error("Expected status code 409 with the request ID echoed but got: ", response.StatusCode, response.Header)
+	}
+	if apiError := errorResponse(t, response); apiError.Code != CodeUserExists || apiError.RequestID != "duplicate-signup" {
+		t.Error("Expected user_exists error got:", apiError)
+	}
+
+	tearDown()
+}
+
+func TestConcurrentSignupsWithOneEmailConflict(t *testing.T) {
+	requests := []*http.Request{}
+	for i := 0; i < 4; i++ {
+		data := url.Values{}
+		data.Add("firstname", "Mark")
+		data.Add("lastname", "Twain")
+		data.Add("email", "mark@twain.com")
+		data.Add("password", "Huckelberry")
+		request, _ := http.NewRequest("POST", signupURL, strings.NewReader(data.Encode()))
+		request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		requests = append(requests, request)
+	}
+	statuses := sendConcurrently(requests)
+
+	// The losers of the race pass the Exists check and are stopped by the
+	// unique index, they should be told the user exists rather than get a 500
+	if statuses[http.StatusOK] != 1 || statuses[http.StatusConflict] != len(requests)-1 {
+		t.Error("Expected one signup to succeed and the rest to conflict got:", statuses)
+	}
+
+	tearDown()
+}
+
+func TestInvalidTokenReturnsAuthFailed(t *testing.T) {
+	response := doWithToken(t, "GET", farmsURL, "A MADE UP TOKEN", url.Values{})
+	if response.StatusCode != http.StatusUnauthorized {
+		t.Error("Expected status code 401 but got: ", response.StatusCode)
+	}
+	if apiError := errorResponse(t, response); apiError.Code != CodeAuthFailed || apiError.RequestID == "" {
+		t.Error("Expected auth_failed error with a request ID got:", apiError)
+	}
+}
@@ -0,0 +1,312 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// farmRequest is the body of a request creating or updating a farm. Only the
+// fields present are changed when updating
+type farmRequest struct {
+	Name        *string  `json:"name"`
+	Description *string  `json:"description"`
+	City        *string  `json:"city"`
+	PostalCode  *string  `json:"postalcode"`
+	Province    *string  `json:"province"`
+	Latitude    *float64 `json:"latitude"`
+	Longitude   *float64 `json:"longitude"`
+}
+
+func (request farmRequest) validate() (errs fieldErrors) {
+	if request.Name != nil && *request.Name == "" {
+		errs.add("name", "cannot be blank")
+	}
+	if request.Latitude != nil && (*request.Latitude < -90 || *request.Latitude > 90) {
+		errs.add("latitude", "must be between -90 and 90")
+	}
+	if request.Longitude != nil && (*request.Longitude < -180 || *request.Longitude > 180) {
+		errs.add("longitude", "must be between -180 and 180")
+	}
+	return
+}
+
+// apply copies the fields present in the request onto the farm
+func (request farmRequest) apply(farm *Farm) {
+	if request.Name != nil {
+		farm.Name = *request.Name
+	}
+	if request.Description != nil {
+		farm.Description = *request.Description
+	}
+	if request.City != nil {
+		farm.Address.City = *request.City
+	}
+	if request.PostalCode != nil {
+		farm.Address.PostalOrZipCode = *request.PostalCode
+	}
+	if request.Province != nil {
+		farm.Address.ProvinceOrState = *request.Province
+	}
+	if request.Latitude != nil {
+		farm.Address.Latitude = *request.Latitude
+	}
+	if request.Longitude != nil {
+		farm.Address.Longitude = *request.Longitude
+	}
+}
+
+// parseCoordinate parses a coordinate in decimal degrees making sure it is
+// within +/- limit
+func parseCoordinate(field, value string, limit float64) (float64, error) {
+	coordinate, err := strconv.ParseFloat(value, 64)
+	if err != nil || coordinate < -limit || coordinate > limit {
+		return 0, fmt.Errorf("Invalid %s %q", field, value)
+	}
+	return coordinate, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	js, err := json.Marshal(v)
+	if err != nil {
+		log.Error(err)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error":{"code":"server_error","message":"Internal server error"}}`))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(js)
+}
+
+func listFarms(env *AppContext, w http.ResponseWriter, r *http.Request) {
+	farms := []Farm{}
+	if err := env.DB.Preload("Address").Order("id").Find(&farms).Error; err != nil {
+		log.WithFields(log.Fields{"action": "listFarms"}).Error(err)
+		writeError(w, r, errServer)
+		return
+	}
+
+	for i := range farms {
+		rating, err := FarmRating(env.DB, farms[i].ID)
+		if err != nil {
+			log.WithFields(log.Fields{"action": "listFarms"}).Error(err)
+			writeError(w, r, errServer)
+			return
+		}
+		farms[i].Rating = rating
+	}
+	writeJSON(w, http.StatusOK, farms)
+}
+
+func createFarm(env *AppContext, w http.ResponseWriter, r *http.Request) {
+	request := farmRequest{}
+	err := decodeRequest(r, &request)
+	if err == nil && request.Name == nil {
+		err = ValidationError{Fields: []FieldError{{Field: "name", Message: "is required"}}}
+	}
+	if err != nil {
+		log.WithFields(log.Fields{"action": "createFarm"}).Error(err)
+		writeError(w, r, err)
+		return
+	}
+
+	farm := Farm{OwnerID: env.User.ID}
+	request.apply(&farm)
+
+	if err := env.DB.Create(&farm).Error; err != nil {
+		log.WithFields(log.Fields{"action": "createFarm"}).Error(err)
+		writeError(w, r, errServer)
+		return
+	}
+	writeJSON(w, http.StatusCreated, farm)
+}
+
+// findFarm looks up the farm referenced in the request path writing the
+// appropriate error response when it cannot be found
+func findFarm(env *AppContext, w http.ResponseWriter, r *http.Request) (farm Farm, ok bool) {
+	id, err := pathID(r, "farmid")
+	if err != nil {
+		log.Error(err)
+		writeError(w, r, badRequest(err.Error()))
+		return
+	}
+
+	query := env.DB.Preload("Address").Preload("Crops").First(&farm, id)
+	if query.RecordNotFound() {
+		writeError(w, r, notFound("Farm not found"))
+		return
+	}
+	if query.Error != nil {
+		log.WithFields(log.Fields{"action": "findFarm"}).Error(query.Error)
+		writeError(w, r, errServer)
+		return
+	}
+	return farm, true
+}
+
+// findOwnedFarm looks up the farm referenced in the request path and makes sure
+// the authenticated user owns it
+func findOwnedFarm(env *AppContext, w http.ResponseWriter, r *http.Request) (farm Farm, ok bool) {
+	farm, ok = findFarm(env, w, r)
+	if !ok {
+		return
+	}
+
+	if !farm.IsOwnedBy(env.User) {
+		log.WithFields(log.Fields{"farm_id": farm.ID, "user_id": env.User.ID}).Error("User does not own farm")
+		writeError(w, r, forbidden("Only the farm owner can make changes to a farm"))
+		return farm, false
+	}
+	return farm, true
+}
+
+func showFarm(env *AppContext, w http.ResponseWriter, r *http.Request) {
+	farm, ok := findFarm(env, w, r)
+	if !ok {
+		return
+	}
+
+	rating, err := FarmRating(env.DB, farm.ID)
+	if err != nil {
+		log.WithFields(log.Fields{"action": "showFarm"}).Error(err)
+		writeError(w, r, errServer)
+		return
+	}
+	farm.Rating = rating
+	writeJSON(w, http.StatusOK, farm)
+}
+
+func updateFarm(env *AppContext, w http.ResponseWriter, r *http.Request) {
+	farm, ok := findOwnedFarm(env, w, r)
+	if !ok {
+		return
+	}
+
+	request := farmRequest{}
+	if err := decodeRequest(r, &request); err != nil {
+		log.WithFields(log.Fields{"action": "updateFarm"}).Error(err)
+		writeError(w, r, err)
+		return
+	}
+	request.apply(&farm)
+
+	if err := env.DB.Save(&farm).Error; err != nil {
+		log.WithFields(log.Fields{"action": "updateFarm"}).Error(err)
+		writeError(w, r, errServer)
+		return
+	}
+	writeJSON(w, http.StatusOK, farm)
+}
+
+func deleteFarm(env *AppContext, w http.ResponseWriter, r *http.Request) {
+	farm, ok := findOwnedFarm(env, w, r)
+	if !ok {
+		return
+	}
+
+	if err := env.DB.Delete(&farm).Error; err != nil {
+		log.WithFields(log.Fields{"action": "deleteFarm"}).Error(err)
+		writeError(w, r, errServer)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// earthRadiusKm is the mean radius of the earth used for great-circle distances
+const earthRadiusKm = 6371.0
+
+// farmDistanceSQL selects the id of every farm within a radius of a point along
+// with its great-circle distance using the haversine formula. Arguments are the
+// latitude, latitude and longitude of the point followed by the radius in km.
+// Rounding can push the square root just past 1 near antipodal points where
+// asin is undefined so it is clamped
+var farmDistanceSQL = fmt.Sprintf(`SELECT farm_id, distance_km FROM (
+	SELECT farms.id AS farm_id,
+		%f * 2 * asin(least(1, sqrt(
+			power(sin(radians(addresses.latitude - ?) / 2), 2) +
+			cos(radians(?)) * cos(radians(addresses.latitude)) *
+			power(sin(radians(addresses.longitude - ?) / 2), 2)
+		))) AS distance_km
+	FROM farms
+	JOIN addresses ON addresses.farm_id = farms.id AND addresses.deleted_at IS NULL
+	WHERE farms.deleted_at IS NULL
+) AS distances
+WHERE distance_km <= ?
+ORDER BY distance_km, farm_id`, earthRadiusKm)
+
+// FarmSearchResult is a farm found by a search along with its distance from
+// the point searched around
+type FarmSearchResult struct {
+	Farm
+	DistanceKm float64
+}
+
+// SearchFarms finds the farms within radius_km of the lat and lng query
+// parameters ordered from nearest to furthest
+func SearchFarms(env *AppContext, w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	lat, err := parseCoordinate("lat", query.Get("lat"), 90)
+	if err != nil {
+		writeError(w, r, badRequest(err.Error()))
+		return
+	}
+	lng, err := parseCoordinate("lng", query.Get("lng"), 180)
+	if err != nil {
+		writeError(w, r, badRequest(err.Error()))
+		return
+	}
+	radius, err := strconv.ParseFloat(query.Get("radius_km"), 64)
+	if err != nil || radius <= 0 {
+		writeError(w, r, badRequest(fmt.Sprintf("Invalid radius_km %q", query.Get("radius_km"))))
+		return
+	}
+
+	rows, err := env.DB.Raw(farmDistanceSQL, lat, lat, lng, radius).Rows()
+	if err != nil {
+		log.WithFields(log.Fields{"action": "SearchFarms"}).Error(err)
+		writeError(w, r, errServer)
+		return
+	}
+	defer rows.Close()
+
+	results := []FarmSearchResult{}
+	for rows.Next() {
+		result := FarmSearchResult{}
+		if err := rows.Scan(&result.ID, &result.DistanceKm); err != nil {
+			log.WithFields(log.Fields{"action": "SearchFarms"}).Error(err)
+			writeError(w, r, errServer)
+			return
+		}
+		results = append(results, result)
+	}
+
+	if len(results) == 0 {
+		writeJSON(w, http.StatusOK, results)
+		return
+	}
+
+	ids := make([]uint, len(results))
+	for i, result := range results {
+		ids[i] = result.ID
+	}
+	farms := []Farm{}
+	if err := env.DB.Preload("Address").Where("id IN (?)", ids).Find(&farms).Error; err != nil {
+		log.WithFields(log.Fields{"action": "SearchFarms"}).Error(err)
+		writeError(w, r, errServer)
+		return
+	}
+	byID := map[uint]Farm{}
+	for _, farm := range farms {
+		byID[farm.ID] = farm
+	}
+	for i := range results {
+		results[i].Farm = byID[results[i].ID]
+	}
+	writeJSON(w, http.StatusOK, results)
+}
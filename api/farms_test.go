@@ -0,0 +1,210 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+var farmsURL string
+
+func init() {
+	farmsURL = fmt.Sprintf("%s/farms", server.URL)
+}
+
+func TestCreateFarmAssignsAuthenticatedUserAsOwner(t *testing.T) {
+	token := signupAndSigninAs(t, "owner@farm.com", "some password", RoleFarmOwner)
+	farm := Farm{}
+	postJSON(t, token, farmsURL, map[string]interface{}{"name": "Green Acres", "city": "Guelph"}, &farm)
+
+	result := Farm{}
+	GetDB().Preload("Address").First(&result, farm.ID)
+	if result.Name != "Green Acres" || result.Address.City != "Guelph" {
+		t.Error("Unable to find saved farm expected:", farm, "got:", result)
+	}
+
+	owner := User{}
+	GetDB().Where(User{PrimaryEmail: "owner@farm.com"}).First(&owner)
+	if result.OwnerID != owner.ID {
+		t.Errorf("Expected farm to be owned by %d but got %d", owner.ID, result.OwnerID)
+	}
+
+	tearDown()
+}
+
+func TestCreateFarmRequiresName(t *testing.T) {
+	token := signupAndSigninAs(t, "owner@farm.com", "some password", RoleFarmOwner)
+
+	response := doWithToken(t, "POST", farmsURL, token, url.Values{})
+	if response.StatusCode != http.StatusBadRequest {
+		t.Error("Expected status code 400 but got: ", response.StatusCode)
+	}
+
+	tearDown()
+}
+
+func TestFarmRoutesRequireAuthToken(t *testing.T) {
+	response := doWithToken(t, "GET", farmsURL, "A MADE UP TOKEN", url.Values{})
+	if response.StatusCode != http.StatusUnauthorized {
+		t.Error("Expected status code 401 but got: ", response.StatusCode)
+	}
+}
+
+func TestAnyUserCanReadAFarm(t *testing.T) {
+	ownerToken := signupAndSigninAs(t, "owner@farm.com", "some password", RoleFarmOwner)
+	workerToken := signupAndSignin(t, "worker@farm.com", "some password")
+	farm := Farm{}
+	postJSON(t, ownerToken, farmsURL, map[string]interface{}{"name": "Green Acres"}, &farm)
+
+	response := doWithToken(t, "GET", fmt.Sprintf("%s/%d", farmsURL, farm.ID), workerToken, url.Values{})
+	if response.StatusCode != http.StatusOK {
+		t.Error("Expected status code 200 but got: ", response.StatusCode)
+	}
+
+	response = doWithToken(t, "GET", farmsURL, workerToken, url.Values{})
+	farms := []Farm{}
+	json.NewDecoder(response.Body).Decode(&farms)
+	if len(farms) != 1 || farms[0].ID != farm.ID {
+		t.Error("Expected to list the created farm got:", farms)
+	}
+
+	response = doWithToken(t, "GET", fmt.Sprintf("%s/%d", farmsURL, farm.ID+1), workerToken, url.Values{})
+	if response.StatusCode != http.StatusNotFound {
+		t.Error("Expected status code 404 but got: ", response.StatusCode)
+	}
+
+	tearDown()
+}
+
+func TestOnlyOwnerCanModifyFarm(t *testing.T) {
+	ownerToken := signupAndSigninAs(t, "owner@farm.com", "some password", RoleFarmOwner)
+	workerToken := signupAndSignin(t, "worker@farm.com", "some password")
+	farm := Farm{}
+	postJSON(t, ownerToken, farmsURL, map[string]interface{}{"name": "Green Acres"}, &farm)
+	farmURL := fmt.Sprintf("%s/%d", farmsURL, farm.ID)
+
+	data := url.Values{}
+	data.Add("name", "Brown Acres")
+
+	var testCases = []struct {
+		method             string
+		token              string
+		expectedStatusCode int
+		reason             string
+	}{
+		{"PUT", workerToken, http.StatusForbidden, "Only the owner can update"},
+		{"DELETE", workerToken, http.StatusForbidden, "Only the owner can delete"},
+		{"PUT", ownerToken, http.StatusOK, "Owner can update"},
+		{"DELETE", ownerToken, http.StatusNoContent, "Owner can delete"},
+		{"GET", ownerToken, http.StatusNotFound, "Deleted farm is gone"},
+	}
+
+	for _, testCase := range testCases {
+		response := doWithToken(t, testCase.method, farmURL, testCase.token, data)
+		if response.StatusCode != testCase.expectedStatusCode {
+			t.Errorf("Expected %d but got %d reason %s", testCase.expectedStatusCode, response.StatusCode, testCase.reason)
+		}
+	}
+
+	tearDown()
+}
+
+func TestCreateFarmValidatesCoordinates(t *testing.T) {
+	token := signupAndSigninAs(t, "owner@farm.com", "some password", RoleFarmOwner)
+
+	var testCases = []struct {
+		Latitude  string
+		Longitude string
+		Reason    string
+	}{
+		{"north", "-80.2482", "Latitude is not a number"},
+		{"90.5", "-80.2482", "Latitude out of range"},
+		{"43.5448", "-180.5", "Longitude out of range"},
+	}
+
+	for _, testCase := range testCases {
+		data := url.Values{}
+		data.Add("name", "Green Acres")
+		data.Add("latitude", testCase.Latitude)
+		data.Add("longitude", testCase.Longitude)
+
+		response := doWithToken(t, "POST", farmsURL, token, data)
+		if response.StatusCode != http.StatusBadRequest {
+			t.Errorf("Expected %d but got %d reason %s", http.StatusBadRequest, response.StatusCode, testCase.Reason)
+		}
+	}
+
+	tearDown()
+}
+
+func TestSearchFarmsByRadiusOrdersByDistance(t *testing.T) {
+	token := signupAndSigninAs(t, "owner@farm.com", "some password", RoleFarmOwner)
+	toronto := Farm{}
+	postJSON(t, token, farmsURL, map[string]interface{}{"name": "Toronto", "latitude": 43.653200, "longitude": -79.383200}, &toronto)
+	guelph := Farm{}
+	postJSON(t, token, farmsURL, map[string]interface{}{"name": "Guelph", "latitude": 43.544800, "longitude": -80.248200}, &guelph)
+	postJSON(t, token, farmsURL, map[string]interface{}{"name": "Vancouver", "latitude": 49.282700, "longitude": -123.120700}, &Farm{})
+
+	if guelph.Address.Latitude != 43.5448 {
+		t.Error("Expected latitude to keep its decimal precision got:", guelph.Address.Latitude)
+	}
+
+	response := doWithToken(t, "GET", farmsURL+"/search?lat=43.5448&lng=-80.2482&radius_km=100", token, url.Values{})
+	if response.StatusCode != http.StatusOK {
+		t.Fatal("Expected status code 200 but got: ", response.StatusCode)
+	}
+
+	results := []FarmSearchResult{}
+	json.NewDecoder(response.Body).Decode(&results)
+	if len(results) != 2 || results[0].ID != guelph.ID || results[1].ID != toronto.ID {
+		t.Fatal("Expected Guelph then Toronto got:", results)
+	}
+
+	if results[0].DistanceKm > 0.001 || results[1].DistanceKm < 65 || results[1].DistanceKm > 75 {
+		t.Error("Expected distances of roughly 0km and 70km got:", results[0].DistanceKm, results[1].DistanceKm)
+	}
+
+	tearDown()
+}
+
+func TestSearchFarmsValidatesParameters(t *testing.T) {
+	token := signupAndSigninAs(t, "owner@farm.com", "some password", RoleFarmOwner)
+
+	var testCases = []struct {
+		query  string
+		reason string
+	}{
+		{"lng=-80&radius_km=10", "Missing lat"},
+		{"lat=91&lng=-80&radius_km=10", "Latitude out of range"},
+		{"lat=43&lng=-80", "Missing radius"},
+		{"lat=43&lng=-80&radius_km=-1", "Negative radius"},
+	}
+
+	for _, testCase := range testCases {
+		response := doWithToken(t, "GET", farmsURL+"/search?"+testCase.query, token, url.Values{})
+		if response.StatusCode != http.StatusBadRequest {
+			t.Errorf("Expected %d but got %d reason %s", http.StatusBadRequest, response.StatusCode, testCase.reason)
+		}
+	}
+
+	tearDown()
+}
+
+func TestSearchFarmsAtTheAntipode(t *testing.T) {
+	token := signupAndSigninAs(t, "owner@farm.com", "some password", RoleFarmOwner)
+	postJSON(t, token, farmsURL, map[string]interface{}{"name": "Null Island", "latitude": 0, "longitude": 0}, &Farm{})
+
+	response := doWithToken(t, "GET", farmsURL+"/search?lat=0&lng=180&radius_km=30000", token, url.Values{})
+	if response.StatusCode != http.StatusOK {
+		t.Fatal("Expected status code 200 but got: ", response.StatusCode)
+	}
+	results := []FarmSearchResult{}
+	json.NewDecoder(response.Body).Decode(&results)
+	if len(results) != 1 || results[0].Name != "Null Island" || results[0].Address.Latitude != 0 {
+		t.Error("Expected the farm on the other side of the earth got:", results)
+	}
+
+	tearDown()
+}
@@ -0,0 +1,327 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+type jobPostingRequest struct {
+	Role            string `json:"role" validate:"required"`
+	Description     string `json:"description"`
+	StartDate       string `json:"startdate" validate:"required"`
+	EndDate         string `json:"enddate" validate:"required"`
+	Headcount       int    `json:"headcount" validate:"required"`
+	Compensation    string `json:"compensation" validate:"required"`
+	HourlyWageCents int    `json:"hourlywagecents"`
+}
+
+func (request jobPostingRequest) validate() (errs fieldErrors) {
+	startDate, err := parseDate("startdate", request.StartDate)
+	if err != nil {
+		errs.add("startdate", "must be a date formatted YYYY-MM-DD")
+	}
+	endDate, err := parseDate("enddate", request.EndDate)
+	if err != nil {
+		errs.add("enddate", "must be a date formatted YYYY-MM-DD")
+	}
+	if startDate != nil && endDate != nil && endDate.Before(*startDate) {
+		errs.add("enddate", "must not be before startdate")
+	}
+
+	if request.Headcount < 1 {
+		errs.add("headcount", "must be at least 1")
+	}
+
+	switch request.Compensation {
+	case CompensationWage:
+		if request.HourlyWageCents < 1 {
+			errs.add("hourlywagecents", "is required for wage postings")
+		}
+	case CompensationRoomAndBoard:
+	default:
+		errs.add("compensation", fmt.Sprintf("must be %s or %s", CompensationWage, CompensationRoomAndBoard))
+	}
+	return
+}
+
+// jobPosting builds a job posting for the farm from a validated request
+func (request jobPostingRequest) jobPosting(farm Farm) JobPosting {
+	startDate, _ := parseDate("startdate", request.StartDate)
+	endDate, _ := parseDate("enddate", request.EndDate)
+	posting := JobPosting{
+		FarmID:       farm.ID,
+		Role:         request.Role,
+		Description:  request.Description,
+		StartDate:    *startDate,
+		EndDate:      *endDate,
+		Headcount:    request.Headcount,
+		Compensation: request.Compensation,
+	}
+	if request.Compensation == CompensationWage {
+		posting.HourlyWageCents = request.HourlyWageCents
+	}
+	return posting
+}
+
+type applicationRequest struct {
+	Message string `json:"message"`
+}
+
+type applicationStatusRequest struct {
+	Status string `json:"status" validate:"required"`
+}
+
+func listFarmJobPostings(env *AppContext, w http.ResponseWriter, r *http.Request) {
+	farm, ok := findFarm(env, w, r)
+	if !ok {
+		return
+	}
+
+	postings := []JobPosting{}
+	if err := env.DB.Where(JobPosting{FarmID: farm.ID}).Order("start_date").Find(&postings).Error; err != nil {
+		log.WithFields(log.Fields{"action": "listFarmJobPostings"}).Error(err)
+		writeError(w, r, errServer)
+		return
+	}
+	writeJSON(w, http.StatusOK, postings)
+}
+
+func createJobPosting(env *AppContext, w http.ResponseWriter, r *http.Request) {
+	farm, ok := findOwnedFarm(env, w, r)
+	if !ok {
+		return
+	}
+
+	request := jobPostingRequest{}
+	if err := decodeRequest(r, &request); err != nil {
+		log.WithFields(log.Fields{"action": "createJobPosting"}).Error(err)
+		writeError(w, r, err)
+		return
+	}
+
+	posting := request.jobPosting(farm)
+	if err := env.DB.Create(&posting).Error; err != nil {
+		log.WithFields(log.Fields{"action": "createJobPosting"}).Error(err)
+		writeError(w, r, errServer)
+		return
+	}
+	writeJSON(w, http.StatusCreated, posting)
+}
+
+// JobPostings lists the job postings that have not yet finished
+func JobPostings(env *AppContext, w http.ResponseWriter, r *http.Request) {
+	postings := []JobPosting{}
+	if err := env.DB.Where("end_date >= ?", time.Now()).Order("start_date").Find(&postings).Error; err != nil {
+		log.WithFields(log.Fields{"action": "JobPostings"}).Error(err)
+		writeError(w, r, errServer)
+		return
+	}
+	writeJSON(w, http.StatusOK, postings)
+}
+
+// findJobPosting looks up the job posting referenced in the request path along
+// with the farm that posted it
+func findJobPosting(env *AppContext, w http.ResponseWriter, r *http.Request) (posting JobPosting, farm Farm, ok bool) {
+	id, err := pathID(r, "jobid")
+	if err != nil {
+		writeError(w, r, badRequest(err.Error()))
+		return
+	}
+
+	if env.DB.First(&posting, id).RecordNotFound() {
+		writeError(w, r, notFound("Job posting not found"))
+		return
+	}
+	if env.DB.First(&farm, posting.FarmID).RecordNotFound() {
+		writeError(w, r, notFound("Job posting not found"))
+		return
+	}
+	return posting, farm, true
+}
+
+func showJobPosting(env *AppContext, w http.ResponseWriter, r *http.Request) {
+	posting, _, ok := findJobPosting(env, w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, posting)
+}
+
+func listApplications(env *AppContext, w http.ResponseWriter, r *http.Request) {
+	posting, farm, ok := findJobPosting(env, w, r)
+	if !ok {
+		return
+	}
+
+	if !farm.IsOwnedBy(env.User) {
+		writeError(w, r, forbidden("Only the farm owner can review applicants"))
+		return
+	}
+
+	applications := []Application{}
+	if err := env.DB.Where(Application{JobPostingID: posting.ID}).Order("id").Find(&applications).Error; err != nil {
+		log.WithFields(log.Fields{"action": "listApplications"}).Error(err)
+		writeError(w, r, errServer)
+		return
+	}
+	writeJSON(w, http.StatusOK, applications)
+}
+
+func createApplication(env *AppContext, w http.ResponseWriter, r *http.Request) {
+	posting, farm, ok := findJobPosting(env, w, r)
+	if !ok {
+		return
+	}
+
+	if farm.IsOwnedBy(env.User) {
+		writeError(w, r, forbidden("Farm owners cannot apply to their own job postings"))
+		return
+	}
+
+	request := applicationRequest{}
+	if err := decodeRequest(r, &request); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	application := Application{
+		JobPostingID: posting.ID,
+		ApplicantID:  env.User.ID,
+		Status:       ApplicationApplied,
+		Message:      request.Message,
+	}
+
+	count := 0
+	env.DB.Model(&Application{}).Where(&Application{JobPostingID: posting.ID, ApplicantID: env.User.ID}).Count(&count)
+	if count != 0 {
+		writeError(w, r, conflict("Already applied to this job posting"))
+		return
+	}
+
+	if err := env.DB.Create(&application).Error; err != nil {
+		// A concurrent application from the same worker got in first
+		if isUniqueViolation(err) {
+			writeError(w, r, conflict("Already applied to this job posting"))
+			return
+		}
+		log.WithFields(log.Fields{"action": "createApplication"}).Error(err)
+		writeError(w, r, errServer)
+		return
+	}
+	writeJSON(w, http.StatusCreated, application)
+}
+
+// updateApplication moves an application on to a new status. The farm owner
+// accepts or rejects applicants while applicants can withdraw. Accepting an
+// applicant records their engagement with the farm
+func updateApplication(env *AppContext, w http.ResponseWriter, r *http.Request) {
+	posting, farm, ok := findJobPosting(env, w, r)
+	if !ok {
+		return
+	}
+
+	id, err := pathID(r, "applicationid")
+	if err != nil {
+		writeError(w, r, badRequest(err.Error()))
+		return
+	}
+
+	application := Application{}
+	if env.DB.Where(Application{JobPostingID: posting.ID}).First(&application, id).RecordNotFound() {
+		writeError(w, r, notFound("Application not found"))
+		return
+	}
+
+	request := applicationStatusRequest{}
+	if err := decodeRequest(r, &request); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	status := request.Status
+	switch status {
+	case ApplicationAccepted, ApplicationRejected:
+		if !farm.IsOwnedBy(env.User) {
+			writeError(w, r, forbidden("Only the farm owner can accept or reject applicants"))
+			return
+		}
+	case ApplicationWithdrawn:
+		if application.ApplicantID != env.User.ID {
+			writeError(w, r, forbidden("Only the applicant can withdraw an application"))
+			return
+		}
+	default:
+		writeError(w, r, badRequest(fmt.Sprintf("Unknown application status %q", status)))
+		return
+	}
+
+	previousStatus := application.Status
+	if err := application.Transition(status); err != nil {
+		log.WithFields(log.Fields{"action": "updateApplication"}).Error(err)
+		writeError(w, r, err)
+		return
+	}
+
+	if err := saveApplication(env, &application, previousStatus, posting); err != nil {
+		log.WithFields(log.Fields{"action": "updateApplication"}).Error(err)
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, application)
+}
+
+// saveApplication saves the application status change in a single transaction
+// creating the applicant's engagement when they are accepted and removing it
+// again if they withdraw before it was completed
+func saveApplication(env *AppContext, application *Application, previousStatus string, posting JobPosting) (err error) {
+	tx := env.DB.Begin()
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		err = tx.Commit().Error
+	}()
+
+	// Only move the application on from the status it was read with. This
+	// locks the row so a concurrent change to the same application waits and
+	// then finds the status gone instead of applying a second time
+	query := tx.Model(&Application{}).Where("id = ? AND status = ?", application.ID, previousStatus).UpdateColumn("status", application.Status)
+	if err = query.Error; err != nil {
+		return
+	}
+	if query.RowsAffected != 1 {
+		return ApplicationTransitionError{"Application was changed by another request"}
+	}
+
+	switch {
+	case application.Status == ApplicationAccepted:
+		// Lock the posting so concurrent accepts count one at a time and
+		// cannot both see a free place
+		if err = tx.Exec("SELECT id FROM job_postings WHERE id = ? FOR UPDATE", posting.ID).Error; err != nil {
+			return
+		}
+		accepted := 0
+		err = tx.Model(&Application{}).Where(&Application{JobPostingID: posting.ID, Status: ApplicationAccepted}).Count(&accepted).Error
+		if err != nil {
+			return
+		}
+		if accepted >= posting.Headcount {
+			return ApplicationTransitionError{"Job posting has already been filled"}
+		}
+
+		engagement := Engagement{FarmID: posting.FarmID, WorkerID: application.ApplicantID}
+		if err = tx.Create(&engagement).Error; err != nil {
+			return
+		}
+		application.EngagementID = engagement.ID
+	case previousStatus == ApplicationAccepted:
+		if err = tx.Where("id = ? AND completed_at IS NULL", application.EngagementID).Delete(&Engagement{}).Error; err != nil {
+			return
+		}
+	}
+	return tx.Save(application).Error
+}
@@ -0,0 +1,261 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+var jobsURL string
+
+func init() {
+	jobsURL = fmt.Sprintf("%s/jobs", server.URL)
+}
+
+func jobPostingData(headcount string) url.Values {
+	data := url.Values{}
+	data.Add("role", "Picker")
+	data.Add("startdate", time.Now().Format(dateFormat))
+	data.Add("enddate", time.Now().AddDate(0, 1, 0).Format(dateFormat))
+	data.Add("headcount", headcount)
+	data.Add("compensation", CompensationRoomAndBoard)
+	return data
+}
+
+// jobPostingJSON is a valid job posting as a JSON body
+func jobPostingJSON(headcount int) map[string]interface{} {
+	return map[string]interface{}{
+		"role":         "Picker",
+		"startdate":    time.Now().Format(dateFormat),
+		"enddate":      time.Now().AddDate(0, 1, 0).Format(dateFormat),
+		"headcount":    headcount,
+		"compensation": CompensationRoomAndBoard,
+	}
+}
+
+// sendConcurrently sends the requests all at once and counts the responses by
+// status code. Failed requests are counted under 0. doWithToken cannot be used
+// off the test goroutine as it calls t.Fatal
+func sendConcurrently(requests []*http.Request) map[int]int {
+	results := make(chan int, len(requests))
+	for _, request := range requests {
+		go func(request *http.Request) {
+			response, err := http.DefaultClient.Do(request)
+			if err != nil {
+				results <- 0
+				return
+			}
+			response.Body.Close()
+			results <- response.StatusCode
+		}(request)
+	}
+
+	statuses := map[int]int{}
+	for range requests {
+		statuses[<-results]++
+	}
+	return statuses
+}
+
+func newApplicationStatusRequest(applicationsURL string, application Application, token, status string) *http.Request {
+	request, _ := http.NewRequest("PUT", fmt.Sprintf("%s/%d", applicationsURL, application.ID), strings.NewReader("status="+status))
+	request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Authorization", "Bearer "+token)
+	return request
+}
+
+func TestCreateJobPostingValidatesInput(t *testing.T) {
+	ownerToken := signupAndSigninAs(t, "owner@farm.com", "some password", RoleFarmOwner)
+	workerToken := signupAndSignin(t, "worker@farm.com", "some password")
+	farm := Farm{}
+	postJSON(t, ownerToken, farmsURL, map[string]interface{}{"name": "Green Acres"}, &farm)
+
+	var testCases = []struct {
+		token              string
+		field              string
+		value              string
+		expectedStatusCode int
+		reason             string
+	}{
+		{ownerToken, "role", "", http.StatusBadRequest, "Missing role"},
+		{ownerToken, "headcount", "0", http.StatusBadRequest, "Headcount must be positive"},
+		{ownerToken, "enddate", "2000-01-01", http.StatusBadRequest, "Posting ends before it starts"},
+		{ownerToken, "compensation", "exposure", http.StatusBadRequest, "Unknown compensation"},
+		{ownerToken, "compensation", CompensationWage, http.StatusBadRequest, "Wage postings need a wage"},
+		{workerToken, "role", "Picker", http.StatusForbidden, "Only the owner can post jobs"},
+		{ownerToken, "role", "Picker", http.StatusCreated, "Valid posting"},
+	}
+
+	for _, testCase := range testCases {
+		data := jobPostingData("2")
+		data.Set(testCase.field, testCase.value)
+		response := doWithToken(t, "POST", fmt.Sprintf("%s/%d/jobs", farmsURL, farm.ID), testCase.token, data)
+		if response.StatusCode != testCase.expectedStatusCode {
+			t.Errorf("Expected %d but got %d reason %s", testCase.expectedStatusCode, response.StatusCode, testCase.reason)
+		}
+	}
+
+	response := doWithToken(t, "GET", jobsURL, workerToken, url.Values{})
+	postings := []JobPosting{}
+	json.NewDecoder(response.Body).Decode(&postings)
+	if len(postings) != 1 {
+		t.Error("Expected to list the open job posting got:", postings)
+	}
+
+	tearDown()
+}
+
+func TestWorkersApplyAndOwnersReviewApplicants(t *testing.T) {
+	ownerToken := signupAndSigninAs(t, "owner@farm.com", "some password", RoleFarmOwner)
+	workerToken := signupAndSignin(t, "worker@farm.com", "some password")
+	otherToken := signupAndSignin(t, "other@farm.com", "some password")
+	farm := Farm{}
+	postJSON(t, ownerToken, farmsURL, map[string]interface{}{"name": "Green Acres"}, &farm)
+	posting := JobPosting{}
+	postJSON(t, ownerToken, fmt.Sprintf("%s/%d/jobs", farmsURL, farm.ID), jobPostingJSON(1), &posting)
+	applicationsURL := fmt.Sprintf("%s/%d/applications", jobsURL, posting.ID)
+
+	response := doWithToken(t, "POST", applicationsURL, ownerToken, url.Values{})
+	if response.StatusCode != http.StatusForbidden {
+		t.Error("Expected owner to be unable to apply but got: ", response.StatusCode)
+	}
+
+	application, other := Application{}, Application{}
+	postJSON(t, workerToken, applicationsURL, map[string]interface{}{}, &application)
+	postJSON(t, otherToken, applicationsURL, map[string]interface{}{}, &other)
+
+	response = doWithToken(t, "POST", applicationsURL, workerToken, url.Values{})
+	if response.StatusCode != http.StatusConflict {
+		t.Error("Expected duplicate application to be rejected but got: ", response.StatusCode)
+	}
+
+	response = doWithToken(t, "GET", applicationsURL, workerToken, url.Values{})
+	if response.StatusCode != http.StatusForbidden {
+		t.Error("Expected only the owner to list applicants but got: ", response.StatusCode)
+	}
+
+	response = doWithToken(t, "GET", applicationsURL, ownerToken, url.Values{})
+	applications := []Application{}
+	json.NewDecoder(response.Body).Decode(&applications)
+	if len(applications) != 2 {
+		t.Error("Expected owner to see both applicants got:", applications)
+	}
+
+	var testCases = []struct {
+		token              string
+		application        Application
+		status             string
+		expectedStatusCode int
+		reason             string
+	}{
+		{workerToken, application, ApplicationAccepted, http.StatusForbidden, "Applicants cannot accept themselves"},
+		{ownerToken, application, ApplicationWithdrawn, http.StatusForbidden, "Owners cannot withdraw for applicants"},
+		{ownerToken, application, ApplicationAccepted, http.StatusOK, "Owner accepts the applicant"},
+		{ownerToken, other, ApplicationAccepted, http.StatusConflict, "Posting headcount is already filled"},
+		{ownerToken, other, ApplicationRejected, http.StatusOK, "Owner rejects the other applicant"},
+		{otherToken, other, ApplicationWithdrawn, http.StatusConflict, "Rejected applications cannot be withdrawn"},
+	}
+
+	for _, testCase := range testCases {
+		data := url.Values{}
+		data.Add("status", testCase.status)
+		response := doWithToken(t, "PUT", fmt.Sprintf("%s/%d", applicationsURL, testCase.application.ID), testCase.token, data)
+		if response.StatusCode != testCase.expectedStatusCode {
+			t.Errorf("Expected %d but got %d reason %s", testCase.expectedStatusCode, response.StatusCode, testCase.reason)
+		}
+	}
+
+	accepted := Application{}
+	GetDB().First(&accepted, application.ID)
+	engagement := Engagement{}
+	if GetDB().First(&engagement, accepted.EngagementID).RecordNotFound() || engagement.WorkerID != accepted.ApplicantID {
+		t.Error("Expected accepting an applicant to record their engagement got:", engagement)
+	}
+
+	tearDown()
+}
+
+func TestConcurrentAcceptsDoNotOverfillAPosting(t *testing.T) {
+	ownerToken := signupAndSigninAs(t, "owner@farm.com", "some password", RoleFarmOwner)
+	farm := Farm{}
+	postJSON(t, ownerToken, farmsURL, map[string]interface{}{"name": "Green Acres"}, &farm)
+	posting := JobPosting{}
+	postJSON(t, ownerToken, fmt.Sprintf("%s/%d/jobs", farmsURL, farm.ID), jobPostingJSON(1), &posting)
+	applicationsURL := fmt.Sprintf("%s/%d/applications", jobsURL, posting.ID)
+
+	applications := make([]Application, 4)
+	for i := range applications {
+		workerToken := signupAndSignin(t, fmt.Sprintf("worker%d@farm.com", i), "some password")
+		postJSON(t, workerToken, applicationsURL, map[string]interface{}{}, &applications[i])
+	}
+
+	requests := []*http.Request{}
+	for _, application := range applications {
+		requests = append(requests, newApplicationStatusRequest(applicationsURL, application, ownerToken, ApplicationAccepted))
+	}
+	statuses := sendConcurrently(requests)
+
+	if accepted := statuses[http.StatusOK]; accepted != 1 {
+		t.Error("Expected exactly one applicant to fill the posting got:", accepted)
+	}
+
+	tearDown()
+}
+
+func TestConcurrentAcceptsOfOneApplicationRecordOneEngagement(t *testing.T) {
+	ownerToken := signupAndSigninAs(t, "owner@farm.com", "some password", RoleFarmOwner)
+	workerToken := signupAndSignin(t, "worker@farm.com", "some password")
+	farm := Farm{}
+	postJSON(t, ownerToken, farmsURL, map[string]interface{}{"name": "Green Acres"}, &farm)
+	posting := JobPosting{}
+	postJSON(t, ownerToken, fmt.Sprintf("%s/%d/jobs", farmsURL, farm.ID), jobPostingJSON(3), &posting)
+	applicationsURL := fmt.Sprintf("%s/%d/applications", jobsURL, posting.ID)
+	application := Application{}
+	postJSON(t, workerToken, applicationsURL, map[string]interface{}{}, &application)
+
+	requests := []*http.Request{}
+	for i := 0; i < 4; i++ {
+		requests = append(requests, newApplicationStatusRequest(applicationsURL, application, ownerToken, ApplicationAccepted))
+	}
+	statuses := sendConcurrently(requests)
+
+	if statuses[http.StatusOK] != 1 || statuses[http.StatusConflict] != len(requests)-1 {
+		t.Error("Expected one accept to succeed and the rest to conflict got:", statuses)
+	}
+	engagements := 0
+	GetDB().Model(&Engagement{}).Where(&Engagement{WorkerID: application.ApplicantID}).Count(&engagements)
+	if engagements != 1 {
+		t.Error("Expected the applicant to be engaged once got:", engagements)
+	}
+
+	tearDown()
+}
+
+func TestConcurrentApplicationsFromOneWorkerConflict(t *testing.T) {
+	ownerToken := signupAndSigninAs(t, "owner@farm.com", "some password", RoleFarmOwner)
+	workerToken := signupAndSignin(t, "worker@farm.com", "some password")
+	farm := Farm{}
+	postJSON(t, ownerToken, farmsURL, map[string]interface{}{"name": "Green Acres"}, &farm)
+	posting := JobPosting{}
+	postJSON(t, ownerToken, fmt.Sprintf("%s/%d/jobs", farmsURL, farm.ID), jobPostingJSON(1), &posting)
+	applicationsURL := fmt.Sprintf("%s/%d/applications", jobsURL, posting.ID)
+
+	requests := []*http.Request{}
+	for i := 0; i < 4; i++ {
+		request, _ := http.NewRequest("POST", applicationsURL, strings.NewReader("message=hello"))
+		request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		request.Header.Set("Authorization", "Bearer "+workerToken)
+		requests = append(requests, request)
+	}
+	statuses := sendConcurrently(requests)
+
+	if statuses[http.StatusCreated] != 1 || statuses[http.StatusConflict] != len(requests)-1 {
+		t.Error("Expected one application to be created and the rest to conflict got:", statuses)
+	}
+
+	tearDown()
+}
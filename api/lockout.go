@@ -0,0 +1,227 @@
+package api
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Signins are locked out once an email address has failed emailLockoutThreshold
+// times in a row or an IP address has failed ipLockoutThreshold times. IPs get
+// more room as many people can sign in from behind the same address
+const (
+	emailLockoutThreshold = 5
+	ipLockoutThreshold    = 20
+)
+
+// The first lockout lasts lockoutBase and every failure after it doubles the
+// lockout up to lockoutMax
+const (
+	lockoutBase = time.Minute
+	lockoutMax  = time.Hour
+)
+
+// Failures are forgotten once a key has gone failureWindow without another.
+// Otherwise a shared IP would collect everyone's mistakes and stay locked out.
+// It is no shorter than lockoutMax so a lockout always ends before its
+// failures are forgotten
+const failureWindow = lockoutMax
+
+// AttemptStore keeps count of failed signins by key
+type AttemptStore interface {
+	// Get returns the attempts recorded for the key or a zero LoginAttempt
+	Get(key string) (LoginAttempt, error)
+	// Fail records a failed signin returning the number of failures so far
+	Fail(key string) (failures int, err error)
+	// Lock refuses signins for the key until the given time
+	Lock(key string, until time.Time) error
+	// Reset forgets the failures recorded for the key
+	Reset(key string) error
+}
+
+// MemoryAttemptStore keeps attempts in memory. It is only suitable for tests
+// and single process deployments
+type MemoryAttemptStore struct {
+	mu       sync.Mutex
+	attempts map[string]LoginAttempt
+}
+
+// NewMemoryAttemptStore returns an empty MemoryAttemptStore
+func NewMemoryAttemptStore() *MemoryAttemptStore {
+	return &MemoryAttemptStore{attempts: map[string]LoginAttempt{}}
+}
+
+// Get returns the attempts recorded for the key
+func (store *MemoryAttemptStore) Get(key string) (LoginAttempt, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return store.attempts[key], nil
+}
+
+// Fail records a failed signin for the key
+func (store *MemoryAttemptStore) Fail(key string) (int, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	attempt := store.attempts[key]
+	if time.Since(attempt.UpdatedAt) > failureWindow {
+		attempt = LoginAttempt{}
+	}
+	attempt.Key = key
+	attempt.Failures++
+	attempt.UpdatedAt = time.Now()
+	store.attempts[key] = attempt
+	return attempt.Failures, nil
+}
+
+// Lock refuses signins for the key until the given time
+func (store *MemoryAttemptStore) Lock(key string, until time.Time) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	attempt := store.attempts[key]
+	attempt.Key = key
+	attempt.LockedUntil = &until
+	store.attempts[key] = attempt
+	return nil
+}
+
+// Reset forgets the failures recorded for the key
+func (store *MemoryAttemptStore) Reset(key string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	delete(store.attempts, key)
+	return nil
+}
+
+// DBAttemptStore keeps attempts in the login_attempts table so every api
+// process shares the same counts
+type DBAttemptStore struct {
+	DB *gorm.DB
+}
+
+// Get returns the attempts recorded for the key
+func (store DBAttemptStore) Get(key string) (attempt LoginAttempt, err error) {
+	query := store.DB.Where(LoginAttempt{Key: key}).First(&attempt)
+	if query.RecordNotFound() {
+		return LoginAttempt{}, nil
+	}
+	return attempt, query.Error
+}
+
+// Fail records a failed signin for the key. The count is incremented in the
+// database so concurrent failures are never lost, starting again from one
+// when the last failure is older than the failureWindow
+func (store DBAttemptStore) Fail(key string) (failures int, err error) {
+	now := time.Now()
+	err = store.DB.Raw(`INSERT INTO login_attempts (key, failures, updated_at) VALUES (?, 1, ?)
+		ON CONFLICT (key) DO UPDATE SET
+			failures = CASE WHEN login_attempts.updated_at < ? THEN 1 ELSE login_attempts.failures + 1 END,
+			locked_until = CASE WHEN login_attempts.updated_at < ? THEN NULL ELSE login_attempts.locked_until END,
+			updated_at = EXCLUDED.updated_at
+		RETURNING failures`, key, now, now.Add(-failureWindow), now.Add(-failureWindow)).Row().Scan(&failures)
+	return
+}
+
+// Lock refuses signins for the key until the given time
+func (store DBAttemptStore) Lock(key string, until time.Time) error {
+	return store.DB.Model(&LoginAttempt{}).Where("key = ?", key).UpdateColumn("locked_until", until).Error
+}
+
+// Reset forgets the failures recorded for the key
+func (store DBAttemptStore) Reset(key string) error {
+	return store.DB.Where("key = ?", key).Delete(&LoginAttempt{}).Error
+}
+
+// lockoutDuration is how long to lock a key out for after the given number of
+// failures with the threshold for that kind of key
+func lockoutDuration(failures, threshold int) time.Duration {
+	if failures < threshold {
+		return 0
+	}
+	lockout := float64(lockoutBase) * math.Pow(2, float64(failures-threshold))
+	if lockout > float64(lockoutMax) {
+		return lockoutMax
+	}
+	return time.Duration(lockout)
+}
+
+// signinKey identifies what a signin attempt is counted against
+type signinKey struct {
+	key       string
+	threshold int
+}
+
+// signinKeys are the keys a signin from the email and IP is counted against.
+// An IP that is one of the trusted proxies stands for everyone behind it, when
+// the client's own address was not forwarded the IP is left out so failures
+// from anyone do not lock out everyone
+func signinKeys(env *AppContext, email, ip string) []signinKey {
+	keys := []signinKey{{"email:" + strings.ToLower(email), emailLockoutThreshold}}
+	if !isTrustedProxy(env.TrustedProxies, ip) {
+		keys = append(keys, signinKey{"ip:" + ip, ipLockoutThreshold})
+	}
+	return keys
+}
+
+// lockedOutUntil returns the latest time any of the keys is locked out until
+func lockedOutUntil(store AttemptStore, keys []signinKey) (until time.Time, err error) {
+	for _, key := range keys {
+		attempt, err := store.Get(key.key)
+		if err != nil {
+			return until, err
+		}
+		if attempt.LockedUntil != nil && attempt.LockedUntil.After(until) {
+			until = *attempt.LockedUntil
+		}
+	}
+	return until, nil
+}
+
+// recordSigninFailure counts the failure against every key locking out any that
+// have passed their threshold. It returns how long the longest lockout is
+func recordSigninFailure(env *AppContext, keys []signinKey, email, ip string) (until time.Time, err error) {
+	for _, key := range keys {
+		failures, err := env.Attempts.Fail(key.key)
+		if err != nil {
+			return until, err
+		}
+
+		lockout := lockoutDuration(failures, key.threshold)
+		if lockout == 0 {
+			continue
+		}
+
+		lockedUntil := time.Now().Add(lockout)
+		if err := env.Attempts.Lock(key.key, lockedUntil); err != nil {
+			return until, err
+		}
+		if lockedUntil.After(until) {
+			until = lockedUntil
+		}
+
+		user := User{}
+		env.DB.Where(User{PrimaryEmail: email}).First(&user)
+		recordAuditEvent(env.DB, AuditEvent{
+			Action: AuditSigninLockout,
+			UserID: user.ID,
+			IP:     ip,
+			Detail: fmt.Sprintf("Locked out %s for %s after %d failed signins", key.key, lockout, failures),
+		})
+	}
+	return until, nil
+}
+
+// writeLockedOut tells the client to wait until the lockout ends
+func writeLockedOut(w http.ResponseWriter, r *http.Request, until time.Time) {
+	retryAfter := int(math.Ceil(time.Until(until).Seconds()))
+	if retryAfter < 1 {
+		retryAfter = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	writeError(w, r, tooManyRequests(fmt.Sprintf("Too many failed signins, try again in %d seconds", retryAfter)))
+}
@@ -0,0 +1,164 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// basicAuthWithStore signs in through BasicAuth counting attempts in the store
+func basicAuthWithStore(store AttemptStore, email, password string) *httptest.ResponseRecorder {
+	r, _ := http.NewRequest("POST", "/signin", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	r.SetBasicAuth(email, password)
+	w := httptest.NewRecorder()
+	context := &AppContext{DB: GetDB(), Attempts: store}
+	AppHandler{AppContext: context, HandlerFunc: BasicAuth(func(env *AppContext, w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})}.ServeHTTP(w, r)
+	return w
+}
+
+func TestLockoutDurationBacksOff(t *testing.T) {
+	var testCases = []struct {
+		failures int
+		expected time.Duration
+	}{
+		{1, 0},
+		{emailLockoutThreshold - 1, 0},
+		{emailLockoutThreshold, time.Minute},
+		{emailLockoutThreshold + 1, 2 * time.Minute},
+		{emailLockoutThreshold + 3, 8 * time.Minute},
+		{emailLockoutThreshold + 20, lockoutMax},
+	}
+
+	for _, testCase := range testCases {
+		if lockout := lockoutDuration(testCase.failures, emailLockoutThreshold); lockout != testCase.expected {
+			t.Errorf("Expected %d failures to lock out for %s but got %s", testCase.failures, testCase.expected, lockout)
+		}
+	}
+}
+
+func TestSigninKeysLeaveOutTrustedProxies(t *testing.T) {
+	os.Setenv("TRUSTED_PROXIES", "10.0.0.0/8")
+	env := &AppContext{TrustedProxies: newTrustedProxies()}
+	os.Setenv("TRUSTED_PROXIES", "")
+
+	var testCases = []struct {
+		ip       string
+		expected []string
+		reason   string
+	}{
+		{"203.0.113.7", []string{"email:mark@twain.com", "ip:203.0.113.7"}, "A client address"},
+		{"10.1.2.3", []string{"email:mark@twain.com"}, "The proxy did not forward the client address"},
+	}
+
+	for _, testCase := range testCases {
+		keys := []string{}
+		for _, key := range signinKeys(env, "Mark@Twain.com", testCase.ip) {
+			keys = append(keys, key.key)
+		}
+		if !reflect.DeepEqual(keys, testCase.expected) {
+			t.Errorf("Expected %v but got %v reason %s", testCase.expected, keys, testCase.reason)
+		}
+	}
+}
+
+func TestRepeatedFailedSigninsLockOutTheAccount(t *testing.T) {
+	setupUser()
+	store := NewMemoryAttemptStore()
+
+	for i := 1; i < emailLockoutThreshold; i++ {
+		if w := basicAuthWithStore(store, "mark@twain.com", "wrong password"); w.Code != http.StatusUnauthorized {
+			t.Fatalf("Expected failure %d to be unauthorized but got: %d", i, w.Code)
+		}
+	}
+
+	w := basicAuthWithStore(store, "mark@twain.com", "wrong password")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatal("Expected the account to be locked out but got: ", w.Code)
+	}
+	if retryAfter, _ := strconv.Atoi(w.Header().Get("Retry-After")); retryAfter < 1 || retryAfter > 60 {
+		t.Error("Expected Retry-After to be within the first lockout got:", w.Header().Get("Retry-After"))
+	}
+	if apiError := errorResponse(t, w.Result()); apiError.Code != CodeTooManyRequests {
+		t.Error("Expected too_many_requests error got:", apiError)
+	}
+
+	if w := basicAuthWithStore(store, "MARK@twain.com", "Huckelberry"); w.Code != http.StatusTooManyRequests {
+		t.Error("Expected the right password to be refused while locked out but got: ", w.Code)
+	}
+
+	events := []AuditEvent{}
+	GetDB().Where(AuditEvent{Action: AuditSigninLockout}).Find(&events)
+	if len(events) != 1 || events[0].UserID != userIDByEmail("mark@twain.com") || events[0].IP != "192.0.2.1" {
+		t.Error("Expected the lockout to be audited got:", events)
+	}
+
+	store.Lock("email:mark@twain.com", time.Now().Add(-time.Second))
+	if w := basicAuthWithStore(store, "mark@twain.com", "Huckelberry"); w.Code != http.StatusOK {
+		t.Fatal("Expected to sign in once the lockout ends but got: ", w.Code)
+	}
+	if attempt, _ := store.Get("email:mark@twain.com"); attempt.Failures != 0 {
+		t.Error("Expected a successful signin to reset the failures got:", attempt.Failures)
+	}
+
+	tearDown()
+}
+
+func TestDBAttemptStoreCountsFailures(t *testing.T) {
+	store := DBAttemptStore{DB: GetDB()}
+
+	for i := 1; i <= 3; i++ {
+		failures, err := store.Fail("email:mark@twain.com")
+		if err != nil || failures != i {
+			t.Fatalf("Expected failure %d to be counted but got %d %v", i, failures, err)
+		}
+	}
+
+	until := time.Now().Add(time.Minute)
+	store.Lock("email:mark@twain.com", until)
+	attempt, err := store.Get("email:mark@twain.com")
+	if err != nil || attempt.Failures != 3 || attempt.LockedUntil == nil || !attempt.LockedUntil.After(time.Now()) {
+		t.Error("Expected the lock to be stored got:", attempt, err)
+	}
+
+	store.Reset("email:mark@twain.com")
+	if attempt, _ := store.Get("email:mark@twain.com"); attempt.Failures != 0 {
+		t.Error("Expected the failures to be forgotten got:", attempt.Failures)
+	}
+
+	tearDown()
+}
+
+func TestFailuresAreForgottenAfterTheWindow(t *testing.T) {
+	stale := time.Now().Add(-failureWindow - time.Minute)
+	memory := NewMemoryAttemptStore()
+	memory.attempts["ip:192.0.2.1"] = LoginAttempt{Key: "ip:192.0.2.1", Failures: ipLockoutThreshold, UpdatedAt: stale}
+	GetDB().Exec("INSERT INTO login_attempts (key, failures, updated_at) VALUES (?, ?, ?)", "ip:192.0.2.1", ipLockoutThreshold, stale)
+
+	var testCases = []struct {
+		store  AttemptStore
+		reason string
+	}{
+		{memory, "Memory store"},
+		{DBAttemptStore{DB: GetDB()}, "Database store"},
+	}
+
+	for _, testCase := range testCases {
+		failures, err := testCase.store.Fail("ip:192.0.2.1")
+		if err != nil || failures != 1 {
+			t.Errorf("Expected a stale count to start again but got %d %v reason %s", failures, err, testCase.reason)
+		}
+		failures, _ = testCase.store.Fail("ip:192.0.2.1")
+		if failures != 2 {
+			t.Errorf("Expected recent failures to keep counting but got %d reason %s", failures, testCase.reason)
+		}
+	}
+
+	tearDown()
+}
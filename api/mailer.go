@@ -0,0 +1,63 @@
+package api
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Message is an email sent to a chamba user
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers messages to users
+type Mailer interface {
+	Send(message Message) error
+}
+
+// LogMailer writes messages to the application log instead of sending them
+type LogMailer struct{}
+
+// Send logs the message
+func (LogMailer) Send(message Message) error {
+	log.WithFields(log.Fields{
+		"to":      message.To,
+		"subject": message.Subject,
+	}).Info(message.Body)
+	return nil
+}
+
+// FileMailer drops each message into its own file in Dir so they can be read
+// while developing locally
+type FileMailer struct {
+	Dir string
+}
+
+// Send writes the message to a new file in the mailer's directory
+func (mailer FileMailer) Send(message Message) error {
+	if err := os.MkdirAll(mailer.Dir, 0755); err != nil {
+		return err
+	}
+
+	recipient := strings.NewReplacer("@", "_at_", "/", "_").Replace(message.To)
+	name := fmt.Sprintf("%d-%s.eml", time.Now().UnixNano(), recipient)
+	contents := fmt.Sprintf("To: %s\nSubject: %s\n\n%s\n", message.To, message.Subject, message.Body)
+	return ioutil.WriteFile(filepath.Join(mailer.Dir, name), []byte(contents), 0644)
+}
+
+// newMailer picks the mailer for the environment. Setting MAIL_DIR drops
+// messages into that directory otherwise they are written to the log
+func newMailer() Mailer {
+	if dir := os.Getenv("MAIL_DIR"); dir != "" {
+		return FileMailer{Dir: dir}
+	}
+	return LogMailer{}
+}
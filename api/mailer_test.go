@@ -0,0 +1,32 @@
+package api
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFileMailerDropsMessageIntoDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chamba-mail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mailer := FileMailer{Dir: filepath.Join(dir, "outbox")}
+	if err := mailer.Send(Message{To: "mark@twain.com", Subject: "Hello", Body: "the pig is in the punch"}); err != nil {
+		t.Fatal(err)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "outbox", "*.eml"))
+	if len(files) != 1 {
+		t.Fatal("Expected a single message file got:", files)
+	}
+
+	contents, _ := ioutil.ReadFile(files[0])
+	if !strings.Contains(string(contents), "To: mark@twain.com") || !strings.Contains(string(contents), "the pig is in the punch") {
+		t.Error("Unexpected message contents:", string(contents))
+	}
+}
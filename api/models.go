@@ -2,7 +2,6 @@ package api
 
 // AuthToken Represents the auth token we use for authorization
 import (
-	"encoding/json"
 	"fmt"
 	"time"
 
@@ -11,9 +10,106 @@ import (
 
 type AuthToken struct {
 	gorm.Model
-	UserID int    `sql:"index"`
-	Token  string `sql:"not null"`
-	Expiry time.Time
+	UserID      int    `sql:"index"`
+	Token       string `sql:"not null;unique" json:"-"`
+	Expiry      time.Time
+	DeviceLabel string
+	IP          string
+	LastUsedAt  time.Time
+
+	// Refresh tokens are rotated on every use. Every session descended from the
+	// same signin shares a FamilyID so the whole chain can be revoked when a
+	// refresh token that was already rotated is presented again
+	RefreshToken  string `sql:"unique" json:"-"`
+	RefreshExpiry time.Time
+	FamilyID      string `sql:"index"`
+	RotatedAt     *time.Time
+}
+
+// PasswordReset is a single use token that lets a user choose a new password
+type PasswordReset struct {
+	gorm.Model
+	UserID uint      `sql:"index"`
+	Token  string    `sql:"not null;unique"`
+	Expiry time.Time `sql:"not null"`
+	UsedAt *time.Time
+}
+
+// LoginAttempt counts the failed signins made with an email address or from an
+// IP address and how long further signins are locked out for
+type LoginAttempt struct {
+	ID          uint   `gorm:"primary_key"`
+	Key         string `sql:"not null;unique"`
+	Failures    int    `sql:"not null"`
+	LockedUntil *time.Time
+	UpdatedAt   time.Time
+}
+
+// AuditEvent records a security relevant event such as an account lockout
+type AuditEvent struct {
+	gorm.Model
+	Action string `sql:"not null;index"`
+	UserID uint   `sql:"index"`
+	IP     string
+	Detail string
+}
+
+// EmailVerification is a single use token mailed to a user at signup to prove
+// they own the address they signed up with
+type EmailVerification struct {
+	gorm.Model
+	UserID uint      `sql:"index"`
+	Token  string    `sql:"not null;unique"`
+	Expiry time.Time `sql:"not null"`
+	UsedAt *time.Time
+}
+
+// RecoveryCode is a single use code that stands in for an authenticator code
+// when a user with two factor authentication has lost their device
+type RecoveryCode struct {
+	gorm.Model
+	UserID uint   `sql:"index"`
+	Code   string `sql:"not null;unique"`
+	UsedAt *time.Time
+}
+
+// TwoFactorChallenge is handed out by Signin to users with two factor
+// authentication enabled and is exchanged for an AuthToken once they send a
+// code from their authenticator
+type TwoFactorChallenge struct {
+	gorm.Model
+	UserID   uint      `sql:"index"`
+	Token    string    `sql:"not null;unique"`
+	Device   string    // the device label to give the session once it starts
+	Expiry   time.Time `sql:"not null"`
+	Failures int       `sql:"not null"`
+	UsedAt   *time.Time
+}
+
+// ExternalIdentity links a user to the account they sign in with at an OpenID
+// Connect provider. Subject is the provider's id for them which never changes
+// even if their email does
+type ExternalIdentity struct {
+	gorm.Model
+	UserID  uint   `sql:"index"`
+	Issuer  string `sql:"not null;unique_index:uix_external_identities_issuer_subject"`
+	Subject string `sql:"not null;unique_index:uix_external_identities_issuer_subject"`
+}
+
+// OIDCState remembers a login sent to an OpenID Connect provider until the
+// user is sent back. State is the digest of the value handed to the provider
+type OIDCState struct {
+	gorm.Model
+	State        string    `sql:"not null;unique"`
+	Nonce        string    `sql:"not null"`
+	CodeVerifier string    `sql:"not null"`
+	Device       string    // the device label to give the session once it starts
+	Expiry       time.Time `sql:"not null"`
+}
+
+// TableName keeps gorm from naming the table o_id_c_states
+func (OIDCState) TableName() string {
+	return "oidc_states"
 }
 
 // User represents a chamba user
@@ -23,12 +119,64 @@ type User struct {
 	LastName     string `sql:"not null"`
 	UserName     string `sql:"not null"`
 	PrimaryEmail string `sql:"not null;unique"`
-	Password     string `sql:"not null;unique"`
-	Type         string
+	Password     string `sql:"not null;unique" json:"-"` // bcrypt hash, never serialised
+	Role         string `sql:"not null;default:'worker'"`
 	FarmID       uint
 	Address      Address
-	Category     string
-	AuthToken    AuthToken
+	AuthTokens   []AuthToken `json:"-"` // one per signed in device
+
+	// SuspendedAt is set when an admin suspends the user who then cannot sign in
+	SuspendedAt *time.Time
+
+	// EmailVerifiedAt is set once the user follows the verification mailed to
+	// their PrimaryEmail. Until then they cannot apply to jobs
+	EmailVerifiedAt *time.Time
+
+	// TOTPSecret is encrypted with the TOTP_ENCRYPTION_KEY. It is set when the user starts
+	// enrolling in two factor authentication and TOTPEnabledAt is set once they
+	// confirm a code from their authenticator. TOTPLastStep is the last time
+	// step a code was accepted for so codes cannot be replayed
+	TOTPSecret    string     `gorm:"column:totp_secret" json:"-"`
+	TOTPEnabledAt *time.Time `gorm:"column:totp_enabled_at"`
+	TOTPLastStep  int64      `gorm:"column:totp_last_step" json:"-"`
+}
+
+// User roles decide what a user is allowed to do. Workers apply to jobs, farm
+// owners run farms and admins moderate other users
+const (
+	RoleWorker    = "worker"
+	RoleFarmOwner = "farm_owner"
+	RoleAdmin     = "admin"
+)
+
+// isRole checks the role is one of the defined roles
+func isRole(role string) bool {
+	return role == RoleWorker || role == RoleFarmOwner || role == RoleAdmin
+}
+
+// HasRole checks whether the user has any of the given roles
+func (user User) HasRole(roles ...string) bool {
+	for _, role := range roles {
+		if user.Role == role {
+			return true
+		}
+	}
+	return false
+}
+
+// IsVerified checks whether the user has verified their email address
+func (user User) IsVerified() bool {
+	return user.EmailVerifiedAt != nil
+}
+
+// HasTwoFactor checks whether the user must send an authenticator code to sign in
+func (user User) HasTwoFactor() bool {
+	return user.TOTPEnabledAt != nil
+}
+
+// IsSuspended checks whether an admin has suspended the user
+func (user User) IsSuspended() bool {
+	return user.SuspendedAt != nil
 }
 
 // Address is a physical location on the earth
@@ -36,53 +184,151 @@ type Address struct {
 	gorm.Model
 	FarmID          uint
 	UserID          uint
-	Latitude        int
-	Longitude       int
+	Latitude        float64 `sql:"type:numeric(9,6)"`
+	Longitude       float64 `sql:"type:numeric(9,6)"`
 	City            string
 	PostalOrZipCode string
 	ProvinceOrState string
 }
 
-// Review table holds reviews about a farm or work experience
+// Review kinds describe what a review was written about
+const (
+	ReviewOfFarm   = "farm"
+	ReviewOfWorker = "worker"
+)
+
+// Review table holds reviews about a farm or work experience. Workers review the
+// farm they worked on and farm owners review the worker, each at most once per
+// engagement
 type Review struct {
 	gorm.Model
-	Stars   int
-	Comment string
+	EngagementID uint   `sql:"not null;unique_index:uix_reviews_engagement_author"`
+	AuthorID     uint   `sql:"not null;unique_index:uix_reviews_engagement_author"`
+	FarmID       uint   `sql:"index"`
+	WorkerID     uint   `sql:"index"`
+	Kind         string `sql:"not null"`
+	Stars        int    `sql:"not null"`
+	Comment      string
 }
 
-// Task is a unit of work completed
+// RatingSummary aggregates the stars left in reviews about a farm or worker
+type RatingSummary struct {
+	Average float64
+	Count   int
+}
+
+// Engagement records a worker spending time working on a farm. Once completed
+// both sides are able to leave a review
+type Engagement struct {
+	gorm.Model
+	FarmID      uint `sql:"index"`
+	WorkerID    uint `sql:"index"`
+	CompletedAt *time.Time
+}
+
+// Task statuses in the order a task moves through them
+const (
+	TaskOpen       = "open"
+	TaskInProgress = "in_progress"
+	TaskDone       = "done"
+)
+
+// taskTransitions maps a task status to the status it is allowed to move to next
+var taskTransitions = map[string]string{
+	TaskOpen:       TaskInProgress,
+	TaskInProgress: TaskDone,
+}
+
+// Task is a unit of work on a farm that the owner assigns to a worker
 type Task struct {
-	Status bool
+	gorm.Model
+	FarmID      uint   `sql:"index"`
+	AssigneeID  uint   `sql:"index"`
+	Title       string `sql:"not null"`
+	Description string
+	Status      string `sql:"not null"`
+	StartedAt   *time.Time
+	CompletedAt *time.Time
 }
 
+// Crop is something a farm grows along with the window in which it needs
+// hands for the harvest
 type Crop struct {
 	gorm.Model
-	FarmID uint
-	Name   string
+	FarmID       uint   `sql:"index"`
+	Name         string `sql:"not null"`
+	Season       string
+	HarvestStart *time.Time
+	HarvestEnd   *time.Time
 }
 
 // Farm represents a chamba farm where users can work
 type Farm struct {
 	gorm.Model
-	Owner       User // the chamba user associated with the farm
+	OwnerID     uint `sql:"index"`
+	Owner       User `gorm:"ForeignKey:OwnerID" json:"-"` // the chamba user associated with the farm
 	Name        string
 	Description string
 	Crops       []Crop
 	Address     Address
+	Rating      RatingSummary `sql:"-"`
+}
+
+// IsOwnedBy checks whether the given user is allowed to make changes to the farm
+func (farm Farm) IsOwnedBy(user User) bool {
+	return farm.OwnerID != 0 && farm.OwnerID == user.ID
+}
+
+// Compensation terms offered by a job posting
+const (
+	CompensationWage         = "wage"
+	CompensationRoomAndBoard = "room_and_board"
+)
+
+// JobPosting advertises work on a farm that workers can apply to
+type JobPosting struct {
+	gorm.Model
+	FarmID          uint   `sql:"index"`
+	Role            string `sql:"not null"`
+	Description     string
+	StartDate       time.Time
+	EndDate         time.Time
+	Headcount       int    `sql:"not null"`
+	Compensation    string `sql:"not null"`
+	HourlyWageCents int
 }
 
-func (user *User) toJSON() (js []byte, err error) {
-	return json.Marshal(user)
+// Application statuses a worker's application to a job posting moves through
+const (
+	ApplicationApplied   = "applied"
+	ApplicationAccepted  = "accepted"
+	ApplicationRejected  = "rejected"
+	ApplicationWithdrawn = "withdrawn"
+)
+
+// applicationTransitions maps an application status to the statuses it can move to
+var applicationTransitions = map[string][]string{
+	ApplicationApplied:  {ApplicationAccepted, ApplicationRejected, ApplicationWithdrawn},
+	ApplicationAccepted: {ApplicationWithdrawn},
+}
+
+// Application is a worker applying to a job posting
+type Application struct {
+	gorm.Model
+	JobPostingID uint   `sql:"not null;unique_index:uix_applications_posting_applicant"`
+	ApplicantID  uint   `sql:"not null;unique_index:uix_applications_posting_applicant"`
+	EngagementID uint   // set once the application is accepted
+	Status       string `sql:"not null"`
+	Message      string
 }
 
 // Exists checks that a currect user struct can be saved to the database
 // at the moment the only restriction is the PrimaryEmail field which must be unique
 // Per user.
 func (user User) Exists(db *gorm.DB) (exists bool) {
-	checkUser := User{}
-	empty := User{}
-	db.Where(&User{PrimaryEmail: user.PrimaryEmail}).First(&checkUser)
-	return checkUser != empty
+	count := 0
+	db.Model(&User{}).Where(&User{PrimaryEmail: user.PrimaryEmail}).Count(&count)
+	return count != 0
 }
 
 // UserExistsError user struct already exists in the database
@@ -91,9 +337,117 @@ type UserExistsError struct {
 }
 
 // Save the user to the database after a few checks to make sure we can do so
-func (user User) Save(db *gorm.DB) (err error) {
+func (user *User) Save(db *gorm.DB) (err error) {
 	if user.Exists(db) {
 		return UserExistsError{fmt.Sprintf("Unable to save user with PrimaryEmail %s already exists in database", user.PrimaryEmail)}
 	}
-	return db.Save(&user).Error
+	if user.Role == "" {
+		user.Role = RoleWorker
+	}
+	err = db.Save(user).Error
+	if isUniqueViolation(err) {
+		return UserExistsError{fmt.Sprintf("Unable to save user with PrimaryEmail %s already exists in database", user.PrimaryEmail)}
+	}
+	return
+}
+
+// IsCompleted checks whether the worker has finished their time on the farm
+func (engagement Engagement) IsCompleted() bool {
+	return engagement.CompletedAt != nil
+}
+
+// ReviewExistsError the author has already reviewed the engagement
+type ReviewExistsError struct {
+	message string
+}
+
+func (e ReviewExistsError) Error() string {
+	return e.message
+}
+
+// Exists checks whether the author has already left a review for the engagement
+func (review Review) Exists(db *gorm.DB) bool {
+	count := 0
+	db.Model(&Review{}).Where(&Review{EngagementID: review.EngagementID, AuthorID: review.AuthorID}).Count(&count)
+	return count != 0
+}
+
+// Save the review to the database making sure the author has not already
+// reviewed the engagement
+func (review *Review) Save(db *gorm.DB) (err error) {
+	if review.Exists(db) {
+		return ReviewExistsError{fmt.Sprintf("Engagement %d has already been reviewed by user %d", review.EngagementID, review.AuthorID)}
+	}
+	err = db.Save(review).Error
+	if isUniqueViolation(err) {
+		return ReviewExistsError{fmt.Sprintf("Engagement %d has already been reviewed by user %d", review.EngagementID, review.AuthorID)}
+	}
+	return
+}
+
+// ratingSummary averages the stars of every review matching the query
+func ratingSummary(db *gorm.DB, query interface{}, args ...interface{}) (summary RatingSummary, err error) {
+	row := db.Table("reviews").
+		Select("coalesce(avg(stars), 0), count(*)").
+		Where("deleted_at IS NULL").
+		Where(query, args...).
+		Row()
+	err = row.Scan(&summary.Average, &summary.Count)
+	return
+}
+
+// FarmRating summarises the reviews workers have left about a farm
+func FarmRating(db *gorm.DB, farmID uint) (RatingSummary, error) {
+	return ratingSummary(db, "farm_id = ? AND kind = ?", farmID, ReviewOfFarm)
+}
+
+// WorkerRating summarises the reviews farm owners have left about a worker
+func WorkerRating(db *gorm.DB, workerID uint) (RatingSummary, error) {
+	return ratingSummary(db, "worker_id = ? AND kind = ?", workerID, ReviewOfWorker)
+}
+
+// TaskTransitionError the task cannot move to the requested status
+type TaskTransitionError struct {
+	message string
+}
+
+func (e TaskTransitionError) Error() string {
+	return e.message
+}
+
+// Transition moves the task to the given status recording when work started
+// and finished. Tasks only move forward one status at a time
+func (task *Task) Transition(status string, at time.Time) error {
+	if taskTransitions[task.Status] != status {
+		return TaskTransitionError{fmt.Sprintf("Task cannot move from %s to %s", task.Status, status)}
+	}
+
+	task.Status = status
+	switch status {
+	case TaskInProgress:
+		task.StartedAt = &at
+	case TaskDone:
+		task.CompletedAt = &at
+	}
+	return nil
+}
+
+// ApplicationTransitionError the application cannot move to the requested status
+type ApplicationTransitionError struct {
+	message string
+}
+
+func (e ApplicationTransitionError) Error() string {
+	return e.message
+}
+
+// Transition moves the application to the given status
+func (application *Application) Transition(status string) error {
+	for _, allowed := range applicationTransitions[application.Status] {
+		if allowed == status {
+			application.Status = status
+			return nil
+		}
+	}
+	return ApplicationTransitionError{fmt.Sprintf("Application cannot move from %s to %s", application.Status, status)}
 }
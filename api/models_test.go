@@ -3,6 +3,7 @@ package api
 import (
 	"os"
 	"testing"
+	"time"
 )
 
 func init() {
@@ -33,3 +34,65 @@ func TestSaveUserToDatabase(t *testing.T) {
 		}
 	}
 }
+
+func TestTaskTransitionsMoveForwardOneStatusAtATime(t *testing.T) {
+	var testingTable = []struct {
+		from          string
+		to            string
+		expectedError bool
+		Reason        string
+	}{
+		{TaskOpen, TaskInProgress, false, "Open tasks can be started"},
+		{TaskInProgress, TaskDone, false, "Started tasks can be finished"},
+		{TaskOpen, TaskDone, true, "Tasks must be started before they are finished"},
+		{TaskDone, TaskOpen, true, "Finished tasks cannot be reopened"},
+		{TaskInProgress, "paused", true, "Unknown statuses are rejected"},
+	}
+
+	for _, testCase := range testingTable {
+		task := Task{Status: testCase.from}
+		err := task.Transition(testCase.to, time.Now())
+		if (err != nil) != testCase.expectedError {
+			t.Errorf("Expected error %t but got %v reason %s", testCase.expectedError, err, testCase.Reason)
+		}
+	}
+}
+
+func TestTaskTransitionRecordsTimestamps(t *testing.T) {
+	task := Task{Status: TaskOpen}
+	started := time.Now()
+	task.Transition(TaskInProgress, started)
+	if task.StartedAt == nil || !task.StartedAt.Equal(started) || task.CompletedAt != nil {
+		t.Error("Expected only the start time to be recorded got:", task)
+	}
+
+	finished := started.Add(time.Hour)
+	task.Transition(TaskDone, finished)
+	if task.CompletedAt == nil || !task.CompletedAt.Equal(finished) {
+		t.Error("Expected the completion time to be recorded got:", task)
+	}
+}
+
+func TestApplicationTransitions(t *testing.T) {
+	var testingTable = []struct {
+		from          string
+		to            string
+		expectedError bool
+		Reason        string
+	}{
+		{ApplicationApplied, ApplicationAccepted, false, "Applicants can be accepted"},
+		{ApplicationApplied, ApplicationRejected, false, "Applicants can be rejected"},
+		{ApplicationApplied, ApplicationWithdrawn, false, "Applicants can withdraw"},
+		{ApplicationAccepted, ApplicationWithdrawn, false, "Accepted applicants can still withdraw"},
+		{ApplicationRejected, ApplicationAccepted, true, "Rejections are final"},
+		{ApplicationWithdrawn, ApplicationApplied, true, "Withdrawn applications cannot be reopened"},
+	}
+
+	for _, testCase := range testingTable {
+		application := Application{Status: testCase.from}
+		err := application.Transition(testCase.to)
+		if (err != nil) != testCase.expectedError {
+			t.Errorf("Expected error %t but got %v reason %s", testCase.expectedError, err, testCase.Reason)
+		}
+	}
+}
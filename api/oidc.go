@@ -0,0 +1,492 @@
+package api
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/jinzhu/gorm"
+)
+
+// oidcStateLifetime is how long a user has to sign in with the identity
+// provider once they have been sent there
+const oidcStateLifetime = 10 * time.Minute
+
+// oidcStateCookie holds the state of the login the browser started so the
+// callback only signs in the browser that went to the provider
+const oidcStateCookie = "oidc_state"
+
+// OIDCProvider is an OpenID Connect identity provider users can sign in with
+// instead of a password. The endpoints are discovered from the issuer the first
+// time they are needed
+type OIDCProvider struct {
+	IssuerURL    string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string // where the provider sends users back to, our /oidc/callback
+	Client       *http.Client
+
+	mu        sync.Mutex
+	discovery *oidcDiscovery
+	keys      map[string]*rsa.PublicKey
+}
+
+// oidcDiscovery is the part of the provider's openid-configuration we use
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcClaims are the ID token claims we read. Audience can be sent as a single
+// string or a list
+type oidcClaims struct {
+	Issuer        string       `json:"iss"`
+	Subject       string       `json:"sub"`
+	Audience      oidcAudience `json:"aud"`
+	Expiry        int64        `json:"exp"`
+	Nonce         string       `json:"nonce"`
+	Email         string       `json:"email"`
+	EmailVerified bool         `json:"email_verified"`
+	GivenName     string       `json:"given_name"`
+	FamilyName    string       `json:"family_name"`
+}
+
+type oidcAudience []string
+
+func (audience *oidcAudience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*audience = oidcAudience{single}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(audience))
+}
+
+func (audience oidcAudience) contains(clientID string) bool {
+	for _, aud := range audience {
+		if aud == clientID {
+			return true
+		}
+	}
+	return false
+}
+
+// newOIDCProvider configures the provider from the environment. OIDC login is
+// turned off when OIDC_ISSUER_URL is not set
+func newOIDCProvider() *OIDCProvider {
+	issuer := os.Getenv("OIDC_ISSUER_URL")
+	if issuer == "" {
+		return nil
+	}
+	return &OIDCProvider{
+		IssuerURL:    issuer,
+		ClientID:     os.Getenv("OIDC_CLIENT_ID"),
+		ClientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+		RedirectURL:  os.Getenv("OIDC_REDIRECT_URL"),
+	}
+}
+
+func (provider *OIDCProvider) client() *http.Client {
+	if provider.Client != nil {
+		return provider.Client
+	}
+	return &http.Client{Timeout: 10 * time.Second}
+}
+
+func (provider *OIDCProvider) getJSON(target string, v interface{}) error {
+	response, err := provider.client().Get(target)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", target, response.Status)
+	}
+	return json.NewDecoder(response.Body).Decode(v)
+}
+
+// discover fetches and caches the provider's endpoints
+func (provider *OIDCProvider) discover() (oidcDiscovery, error) {
+	provider.mu.Lock()
+	defer provider.mu.Unlock()
+	if provider.discovery != nil {
+		return *provider.discovery, nil
+	}
+
+	issuer := strings.TrimSuffix(provider.IssuerURL, "/")
+	discovery := oidcDiscovery{}
+	if err := provider.getJSON(issuer+"/.well-known/openid-configuration", &discovery); err != nil {
+		return discovery, err
+	}
+	if strings.TrimSuffix(discovery.Issuer, "/") != issuer {
+		return discovery, fmt.Errorf("Provider claims to be %s not %s", discovery.Issuer, issuer)
+	}
+	provider.discovery = &discovery
+	return discovery, nil
+}
+
+// publicKey returns the provider's signing key with the id. The keys are
+// fetched again when an unknown one is asked for as providers rotate them
+func (provider *OIDCProvider) publicKey(discovery oidcDiscovery, kid string) (*rsa.PublicKey, error) {
+	provider.mu.Lock()
+	defer provider.mu.Unlock()
+	if key, ok := provider.keys[kid]; ok {
+		return key, nil
+	}
+
+	jwks := struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}{}
+	if err := provider.getJSON(discovery.JWKSURI, &jwks); err != nil {
+		return nil, err
+	}
+
+	provider.keys = map[string]*rsa.PublicKey{}
+	for _, jwk := range jwks.Keys {
+		if jwk.Kty != "RSA" {
+			continue
+		}
+		n, errN := base64.RawURLEncoding.DecodeString(jwk.N)
+		e, errE := base64.RawURLEncoding.DecodeString(jwk.E)
+		if errN != nil || errE != nil {
+			continue
+		}
+		provider.keys[jwk.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+
+	key, ok := provider.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("No signing key %q", kid)
+	}
+	return key, nil
+}
+
+// stateCookie ties the login's state to the browser. Setting maxAge below
+// zero clears it
+func (provider *OIDCProvider) stateCookie(state string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Path:     "/oidc",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(provider.RedirectURL, "https://"),
+		SameSite: http.SameSiteLaxMode, // sent when the provider redirects back
+	}
+}
+
+// authCodeURL is where to send the user to sign in with the provider
+func (provider *OIDCProvider) authCodeURL(discovery oidcDiscovery, state, nonce, codeVerifier string) string {
+	challenge := sha256.Sum256([]byte(codeVerifier))
+	query := url.Values{}
+	query.Set("response_type", "code")
+	query.Set("client_id", provider.ClientID)
+	query.Set("redirect_uri", provider.RedirectURL)
+	query.Set("scope", "openid email profile")
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	query.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	query.Set("code_challenge_method", "S256")
+
+	separator := "?"
+	if strings.Contains(discovery.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return discovery.AuthorizationEndpoint + separator + query.Encode()
+}
+
+// exchange trades the authorization code for the user's verified ID token claims
+func (provider *OIDCProvider) exchange(code, codeVerifier, nonce string) (claims oidcClaims, err error) {
+	discovery, err := provider.discover()
+	if err != nil {
+		return
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", provider.RedirectURL)
+	form.Set("code_verifier", codeVerifier)
+	request, err := http.NewRequest("POST", discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.SetBasicAuth(url.QueryEscape(provider.ClientID), url.QueryEscape(provider.ClientSecret))
+
+	response, err := provider.client().Do(request)
+	if err != nil {
+		return
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return claims, fmt.Errorf("Token endpoint returned %s", response.Status)
+	}
+
+	tokens := struct {
+		IDToken string `json:"id_token"`
+	}{}
+	if err = json.NewDecoder(response.Body).Decode(&tokens); err != nil {
+		return
+	}
+	return provider.verifyIDToken(discovery, tokens.IDToken, nonce)
+}
+
+// verifyIDToken checks the ID token was signed by the provider for us and for
+// this login before returning its claims
+func (provider *OIDCProvider) verifyIDToken(discovery oidcDiscovery, idToken, nonce string) (claims oidcClaims, err error) {
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return claims, errors.New("ID token is not a JWT")
+	}
+
+	header := struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}{}
+	if err = decodeJWTPart(parts[0], &header); err != nil {
+		return
+	}
+	if header.Alg != "RS256" {
+		return claims, fmt.Errorf("ID token signed with unsupported algorithm %q", header.Alg)
+	}
+
+	key, err := provider.publicKey(discovery, header.Kid)
+	if err != nil {
+		return
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err = rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+		return claims, errors.New("ID token signature is invalid")
+	}
+
+	if err = decodeJWTPart(parts[1], &claims); err != nil {
+		return
+	}
+	switch {
+	case claims.Issuer != discovery.Issuer:
+		err = fmt.Errorf("ID token issued by %s not %s", claims.Issuer, discovery.Issuer)
+	case !claims.Audience.contains(provider.ClientID):
+		err = errors.New("ID token was not issued for this client")
+	case time.Unix(claims.Expiry, 0).Before(time.Now()):
+		err = errors.New("ID token has expired")
+	case claims.Nonce != nonce:
+		err = errors.New("ID token nonce does not match the login")
+	case claims.Subject == "":
+		err = errors.New("ID token has no subject")
+	}
+	return
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	decoded, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(decoded, v)
+}
+
+// findOrCreateOIDCUser returns the user the external identity belongs to. An
+// identity seen for the first time is linked to the user with the same email
+// when the provider has verified it, otherwise a new user is created. A user
+// who has not verified the email themselves is never linked as anyone could
+// have signed up with it and would keep their password and sessions
+func findOrCreateOIDCUser(db *gorm.DB, issuer string, claims oidcClaims) (user User, err error) {
+	identity := ExternalIdentity{}
+	if !db.Where(ExternalIdentity{Issuer: issuer, Subject: claims.Subject}).First(&identity).RecordNotFound() {
+		err = db.First(&user, identity.UserID).Error
+		return
+	}
+
+	if claims.Email == "" || !claims.EmailVerified {
+		return user, AuthenticationError{"The identity provider has not verified the email address"}
+	}
+
+	// Nobody knows the password of a user created here, they sign in through
+	// the provider until they reset it
+	password, err := generateToken()
+	if err == nil {
+		password, err = saltPassword(password)
+	}
+	if err != nil {
+		return
+	}
+
+	now := time.Now()
+	tx := db.Begin()
+	if tx.Where(User{PrimaryEmail: claims.Email}).First(&user).RecordNotFound() {
+		user = User{
+			FirstName:       claims.GivenName,
+			LastName:        claims.FamilyName,
+			PrimaryEmail:    claims.Email,
+			Password:        password,
+			EmailVerifiedAt: &now,
+		}
+		err = user.Save(tx)
+	} else if !user.IsVerified() {
+		tx.Rollback()
+		return User{}, AuthenticationError{"An account with this email address exists but has not been verified"}
+	}
+	if err == nil {
+		err = tx.Create(&ExternalIdentity{UserID: user.ID, Issuer: issuer, Subject: claims.Subject}).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		return
+	}
+	err = tx.Commit().Error
+	return
+}
+
+// StartOIDCLogin sends the user to the identity provider to sign in. The
+// optional device query parameter labels the session started once they return
+func StartOIDCLogin(env *AppContext, w http.ResponseWriter, r *http.Request) {
+	if env.OIDC == nil {
+		writeError(w, r, notFound("OpenID Connect login is not configured"))
+		return
+	}
+
+	discovery, err := env.OIDC.discover()
+	if err != nil {
+		log.WithFields(log.Fields{"action": "StartOIDCLogin"}).Error(err)
+		writeError(w, r, errServer)
+		return
+	}
+
+	var state, nonce, codeVerifier string
+	for _, value := range []*string{&state, &nonce, &codeVerifier} {
+		if *value, err = generateToken(); err != nil {
+			log.WithFields(log.Fields{"action": "StartOIDCLogin"}).Error(err)
+			writeError(w, r, errServer)
+			return
+		}
+	}
+
+	// Logins that were never finished are thrown away once they expire
+	if err := env.DB.Unscoped().Where("expiry < ?", time.Now()).Delete(&OIDCState{}).Error; err != nil {
+		log.WithFields(log.Fields{"action": "StartOIDCLogin"}).Error(err)
+	}
+
+	login := OIDCState{
+		State:        hashToken(state),
+		Nonce:        nonce,
+		CodeVerifier: codeVerifier,
+		Device:       r.URL.Query().Get("device"),
+		Expiry:       time.Now().Add(oidcStateLifetime),
+	}
+	if err := env.DB.Create(&login).Error; err != nil {
+		log.WithFields(log.Fields{"action": "StartOIDCLogin"}).Error(err)
+		writeError(w, r, errServer)
+		return
+	}
+
+	http.SetCookie(w, env.OIDC.stateCookie(state, int(oidcStateLifetime.Seconds())))
+	http.Redirect(w, r, env.OIDC.authCodeURL(discovery, state, nonce, codeVerifier), http.StatusFound)
+}
+
+// OIDCCallback is where the identity provider sends the user back to. The code
+// is exchanged for their identity and they are signed in like Signin would
+func OIDCCallback(env *AppContext, w http.ResponseWriter, r *http.Request) {
+	if env.OIDC == nil {
+		writeError(w, r, notFound("OpenID Connect login is not configured"))
+		return
+	}
+
+	query := r.URL.Query()
+	if providerError := query.Get("error"); providerError != "" {
+		log.WithFields(log.Fields{"action": "OIDCCallback"}).Error(providerError)
+		writeError(w, r, AuthenticationError{"Identity provider refused the login"})
+		return
+	}
+	if query.Get("code") == "" || query.Get("state") == "" {
+		writeError(w, r, badRequest("The code and state parameters are required"))
+		return
+	}
+
+	// The state has to come back to the browser that started the login or
+	// anyone could send a victim here to sign them in as the attacker
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(query.Get("state"))) != 1 {
+		log.WithFields(log.Fields{"action": "OIDCCallback"}).Error("Login state does not match the browser")
+		writeError(w, r, AuthenticationError{"Invalid or expired login"})
+		return
+	}
+	http.SetCookie(w, env.OIDC.stateCookie("", -1))
+
+	// Each login can only come back once
+	login := OIDCState{}
+	env.DB.Where(OIDCState{State: hashToken(query.Get("state"))}).First(&login)
+	if login.ID == 0 || login.Expiry.Before(time.Now()) ||
+		env.DB.Where("id = ?", login.ID).Delete(&OIDCState{}).RowsAffected != 1 {
+		log.WithFields(log.Fields{"action": "OIDCCallback"}).Error("Invalid or expired login state")
+		writeError(w, r, AuthenticationError{"Invalid or expired login"})
+		return
+	}
+
+	claims, err := env.OIDC.exchange(query.Get("code"), login.CodeVerifier, login.Nonce)
+	if err != nil {
+		log.WithFields(log.Fields{"action": "OIDCCallback"}).Error(err)
+		writeError(w, r, AuthenticationError{"Unable to verify the identity provider's response"})
+		return
+	}
+
+	user, err := findOrCreateOIDCUser(env.DB, claims.Issuer, claims)
+	if err != nil {
+		log.WithFields(log.Fields{"action": "OIDCCallback", "subject": claims.Subject}).Error(err)
+		writeError(w, r, err)
+		return
+	}
+	if user.IsSuspended() {
+		writeError(w, r, AuthenticationError{"authorization failed"})
+		return
+	}
+
+	if user.HasTwoFactor() {
+		challenge, err := issueTwoFactorChallenge(env.DB, user, login.Device)
+		if err != nil {
+			log.WithFields(log.Fields{"action": "OIDCCallback"}).Error(err)
+			writeError(w, r, errServer)
+			return
+		}
+		writeJSON(w, http.StatusOK, challenge)
+		return
+	}
+
+	familyID, err := generateToken()
+	if err != nil {
+		log.WithFields(log.Fields{"action": "OIDCCallback"}).Error(err)
+		writeError(w, r, errServer)
+		return
+	}
+	tokens, err := startSession(env.DB, user, login.Device, remoteIP(env, r), familyID)
+	if err != nil {
+		log.WithFields(log.Fields{"action": "OIDCCallback"}).Error(err)
+		writeError(w, r, errServer)
+		return
+	}
+	writeJSON(w, http.StatusOK, tokens)
+}
@@ -0,0 +1,367 @@
+package api
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testIdentityProvider is a stand-in OpenID Connect provider. Tests decide what
+// claims it vouches for by calling authorize in place of the user signing in
+type testIdentityProvider struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+
+	mu     sync.Mutex
+	grants map[string]testGrant // by authorization code
+}
+
+type testGrant struct {
+	claims        map[string]interface{}
+	codeChallenge string
+	redirectURI   string
+}
+
+const (
+	testClientID     = "chamba-test"
+	testClientSecret = "chamba test secret"
+	testRedirectURL  = "http://chamba.test/oidc/callback"
+)
+
+func newTestIdentityProvider(t *testing.T) *testIdentityProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &testIdentityProvider{key: key, grants: map[string]testGrant{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidcDiscovery{
+			Issuer:                idp.server.URL,
+			AuthorizationEndpoint: idp.server.URL + "/authorize",
+			TokenEndpoint:         idp.server.URL + "/token",
+			JWKSURI:               idp.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		idp.mu.Lock()
+		public := idp.key.PublicKey
+		idp.mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": "test",
+				"n":   base64.RawURLEncoding.EncodeToString(public.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		clientID, clientSecret, _ := r.BasicAuth()
+		clientID, _ = url.QueryUnescape(clientID)
+		clientSecret, _ = url.QueryUnescape(clientSecret)
+		if clientID != testClientID || clientSecret != testClientSecret {
+			http.Error(w, `{"error":"invalid_client"}`, http.StatusUnauthorized)
+			return
+		}
+
+		idp.mu.Lock()
+		grant, ok := idp.grants[r.PostFormValue("code")]
+		delete(idp.grants, r.PostFormValue("code"))
+		idp.mu.Unlock()
+
+		verifier := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+		if !ok || r.PostFormValue("grant_type") != "authorization_code" ||
+			r.PostFormValue("redirect_uri") != grant.redirectURI ||
+			base64.RawURLEncoding.EncodeToString(verifier[:]) != grant.codeChallenge {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{
+			"access_token": "unused",
+			"token_type":   "Bearer",
+			"id_token":     idp.sign(t, grant.claims),
+		})
+	})
+	idp.server = httptest.NewServer(mux)
+	return idp
+}
+
+func (idp *testIdentityProvider) provider() *OIDCProvider {
+	return &OIDCProvider{
+		IssuerURL:    idp.server.URL,
+		ClientID:     testClientID,
+		ClientSecret: testClientSecret,
+		RedirectURL:  testRedirectURL,
+	}
+}
+
+// authorize plays the user signing in at the provider for the authorization
+// URL we redirected them to. The claims override the ones a real provider
+// would fill in from the request
+func (idp *testIdentityProvider) authorize(t *testing.T, authURL string, claims map[string]interface{}) (code, state string) {
+	parsed, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := parsed.Query()
+	if query.Get("client_id") != testClientID || query.Get("code_challenge_method") != "S256" {
+		t.Fatal("Expected an authorization code request with PKCE got:", authURL)
+	}
+
+	issued := map[string]interface{}{
+		"iss":   idp.server.URL,
+		"aud":   testClientID,
+		"exp":   time.Now().Add(time.Minute).Unix(),
+		"nonce": query.Get("nonce"),
+	}
+	for claim, value := range claims {
+		issued[claim] = value
+	}
+
+	code, err = generateToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp.mu.Lock()
+	idp.grants[code] = testGrant{claims: issued, codeChallenge: query.Get("code_challenge"), redirectURI: query.Get("redirect_uri")}
+	idp.mu.Unlock()
+	return code, query.Get("state")
+}
+
+func (idp *testIdentityProvider) sign(t *testing.T, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test", "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	digest := sha256.Sum256([]byte(signed))
+	idp.mu.Lock()
+	signature, err := rsa.SignPKCS1v15(rand.Reader, idp.key, crypto.SHA256, digest[:])
+	idp.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// oidcCallback sends the browser holding the state cookie back from the
+// provider with the code and state
+func oidcCallback(provider *OIDCProvider, stateCookie *http.Cookie, code, state string) *httptest.ResponseRecorder {
+	r, _ := http.NewRequest("GET", "/oidc/callback?"+url.Values{"code": {code}, "state": {state}}.Encode(), nil)
+	if stateCookie != nil {
+		r.AddCookie(stateCookie)
+	}
+	w := httptest.NewRecorder()
+	AppHandler{&AppContext{DB: GetDB(), OIDC: provider}, OIDCCallback}.ServeHTTP(w, r)
+	return w
+}
+
+// startTestOIDCLogin redirects to the provider returning the authorization URL
+// and the cookie the browser is given to finish the login with
+func startTestOIDCLogin(t *testing.T, provider *OIDCProvider) (authURL string, stateCookie *http.Cookie) {
+	r, _ := http.NewRequest("GET", "/oidc/login?device=phone", nil)
+	w := httptest.NewRecorder()
+	AppHandler{&AppContext{DB: GetDB(), OIDC: provider}, StartOIDCLogin}.ServeHTTP(w, r)
+	if w.Code != http.StatusFound {
+		t.Fatal("Expected a redirect to the provider but got: ", w.Code)
+	}
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == oidcStateCookie {
+			stateCookie = cookie
+		}
+	}
+	if stateCookie == nil || !stateCookie.HttpOnly || stateCookie.MaxAge <= 0 {
+		t.Fatal("Expected a short lived state cookie got:", stateCookie)
+	}
+	return w.Header().Get("Location"), stateCookie
+}
+
+// oidcLogin goes through the whole login with the provider vouching for claims
+func oidcLogin(t *testing.T, idp *testIdentityProvider, provider *OIDCProvider, claims map[string]interface{}) *httptest.ResponseRecorder {
+	authURL, stateCookie := startTestOIDCLogin(t, provider)
+	code, state := idp.authorize(t, authURL, claims)
+	return oidcCallback(provider, stateCookie, code, state)
+}
+
+func workerClaims(subject, email string) map[string]interface{} {
+	return map[string]interface{}{
+		"sub":            subject,
+		"email":          email,
+		"email_verified": true,
+		"given_name":     "Mark",
+		"family_name":    "Twain",
+	}
+}
+
+func TestOIDCLoginCreatesAVerifiedUser(t *testing.T) {
+	idp := newTestIdentityProvider(t)
+	defer idp.server.Close()
+	provider := idp.provider()
+
+	w := oidcLogin(t, idp, provider, workerClaims("idp-1", "worker@farm.com"))
+	if w.Code != http.StatusOK {
+		t.Fatal("Expected status code 200 but got: ", w.Code, w.Body.String())
+	}
+	tokens := tokenResponse{}
+	json.NewDecoder(w.Body).Decode(&tokens)
+	response := doWithToken(t, "GET", server.URL+"/users/me", tokens.Token, url.Values{})
+	if response.StatusCode != http.StatusOK {
+		t.Fatal("Expected the OIDC session to be usable but got: ", response.StatusCode)
+	}
+
+	user := User{}
+	GetDB().First(&user, userIDByEmail("worker@farm.com"))
+	if !user.IsVerified() || user.Role != RoleWorker || user.FirstName != "Mark" || user.LastName != "Twain" {
+		t.Error("Expected a verified worker to be created got:", user)
+	}
+
+	session := AuthToken{}
+	GetDB().Where("user_id = ?", user.ID).First(&session)
+	if session.DeviceLabel != "phone" {
+		t.Error("Expected the session to be labelled with the device got:", session.DeviceLabel)
+	}
+
+	// The provider's subject identifies the user even once their email changes
+	w = oidcLogin(t, idp, provider, workerClaims("idp-1", "mark@twain.com"))
+	count := 0
+	GetDB().Model(&User{}).Count(&count)
+	if w.Code != http.StatusOK || count != 1 {
+		t.Error("Expected the same user to be signed in got:", w.Code, count)
+	}
+
+	tearDown()
+}
+
+func TestOIDCLoginLinksUsersByVerifiedEmail(t *testing.T) {
+	idp := newTestIdentityProvider(t)
+	defer idp.server.Close()
+	provider := idp.provider()
+	setupUser()
+
+	unverified := workerClaims("idp-1", "mark@twain.com")
+	unverified["email_verified"] = false
+	if w := oidcLogin(t, idp, provider, unverified); w.Code != http.StatusUnauthorized {
+		t.Error("Expected an unverified email not to be linked but got: ", w.Code)
+	}
+
+	if w := oidcLogin(t, idp, provider, workerClaims("idp-1", "mark@twain.com")); w.Code != http.StatusUnauthorized {
+		t.Error("Expected an account that has not verified the email not to be linked but got: ", w.Code)
+	}
+	user := User{}
+	if GetDB().First(&user, userIDByEmail("mark@twain.com")); user.IsVerified() {
+		t.Error("Expected the unlinked account to stay unverified")
+	}
+
+	GetDB().Model(&user).UpdateColumn("email_verified_at", time.Now())
+	if w := oidcLogin(t, idp, provider, workerClaims("idp-1", "mark@twain.com")); w.Code != http.StatusOK {
+		t.Fatal("Expected status code 200 but got: ", w.Code, w.Body.String())
+	}
+
+	identity := ExternalIdentity{}
+	GetDB().Where(ExternalIdentity{Issuer: idp.server.URL, Subject: "idp-1"}).First(&identity)
+	if identity.UserID != userIDByEmail("mark@twain.com") {
+		t.Error("Expected the identity to be linked to the existing user got:", identity)
+	}
+
+	tearDown()
+}
+
+func TestOIDCCallbackRejectsBadLogins(t *testing.T) {
+	idp := newTestIdentityProvider(t)
+	defer idp.server.Close()
+	provider := idp.provider()
+
+	var testCases = []struct {
+		claims map[string]interface{}
+		reason string
+	}{
+		{map[string]interface{}{"aud": "someone-else"}, "Issued for another client"},
+		{map[string]interface{}{"iss": "https://evil.example.com"}, "Issued by another provider"},
+		{map[string]interface{}{"nonce": "replayed"}, "Issued for another login"},
+		{map[string]interface{}{"exp": time.Now().Add(-time.Minute).Unix()}, "Expired"},
+	}
+
+	for _, testCase := range testCases {
+		claims := workerClaims("idp-1", "worker@farm.com")
+		for claim, value := range testCase.claims {
+			claims[claim] = value
+		}
+		if w := oidcLogin(t, idp, provider, claims); w.Code != http.StatusUnauthorized {
+			t.Errorf("Expected status code 401 but got %d reason %s", w.Code, testCase.reason)
+		}
+	}
+
+	authURL, stateCookie := startTestOIDCLogin(t, provider)
+	code, state := idp.authorize(t, authURL, workerClaims("idp-1", "worker@farm.com"))
+	_, otherCookie := startTestOIDCLogin(t, provider)
+	madeUpCookie := &http.Cookie{Name: oidcStateCookie, Value: "A MADE UP STATE"}
+
+	var callbacks = []struct {
+		stateCookie        *http.Cookie
+		state              string
+		expectedStatusCode int
+		reason             string
+	}{
+		{madeUpCookie, "A MADE UP STATE", http.StatusUnauthorized, "Unknown state"},
+		{nil, state, http.StatusUnauthorized, "Browser that did not start the login"},
+		{otherCookie, state, http.StatusUnauthorized, "Browser that started another login"},
+		{stateCookie, state, http.StatusOK, "Browser that started the login"},
+		{stateCookie, state, http.StatusUnauthorized, "A login only comes back once"},
+	}
+
+	for _, callback := range callbacks {
+		if w := oidcCallback(provider, callback.stateCookie, code, callback.state); w.Code != callback.expectedStatusCode {
+			t.Errorf("Expected %d but got %d reason %s", callback.expectedStatusCode, w.Code, callback.reason)
+		}
+	}
+
+	// A token signed by anyone but the provider is refused
+	forger, _ := rsa.GenerateKey(rand.Reader, 2048)
+	idp.mu.Lock()
+	idp.key = forger
+	idp.mu.Unlock()
+	if w := oidcLogin(t, idp, provider, workerClaims("idp-1", "worker@farm.com")); w.Code != http.StatusUnauthorized {
+		t.Error("Expected a forged ID token to be rejected but got: ", w.Code)
+	}
+
+	tearDown()
+}
+
+func TestExpiredOIDCLoginsAreThrownAway(t *testing.T) {
+	idp := newTestIdentityProvider(t)
+	defer idp.server.Close()
+	provider := idp.provider()
+
+	startTestOIDCLogin(t, provider)
+	GetDB().Model(&OIDCState{}).UpdateColumn("expiry", time.Now().Add(-time.Minute))
+	startTestOIDCLogin(t, provider)
+
+	count := 0
+	GetDB().Unscoped().Model(&OIDCState{}).Count(&count)
+	if count != 1 {
+		t.Error("Expected only the login that has not expired to be kept got:", count)
+	}
+
+	tearDown()
+}
+
+func TestOIDCLoginIsOffUntilConfigured(t *testing.T) {
+	response, err := http.Get(server.URL + "/oidc/login")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != http.StatusNotFound {
+		t.Error("Expected status code 404 but got: ", response.StatusCode)
+	}
+}
@@ -0,0 +1,129 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// passwordResetLifetime is how long a reset token can be used for once issued
+const passwordResetLifetime = time.Hour
+
+type passwordResetRequest struct {
+	Email string `json:"email" validate:"required"`
+}
+
+type confirmPasswordResetRequest struct {
+	Token    string `json:"token" validate:"required"`
+	Password string `json:"password" validate:"required"`
+}
+
+func (reset *PasswordReset) isUsable() bool {
+	return reset.UsedAt == nil && reset.Expiry.After(time.Now())
+}
+
+// RequestPasswordReset issues a reset token for the account with the given email
+// and mails it to them. The response is the same whether or not the account
+// exists so it cannot be used to discover who has signed up
+func RequestPasswordReset(env *AppContext, w http.ResponseWriter, r *http.Request) {
+	request := passwordResetRequest{}
+	if err := decodeRequest(r, &request); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	user := User{}
+	if !env.DB.Where(User{PrimaryEmail: request.Email}).First(&user).RecordNotFound() {
+		token, err := generateToken()
+		if err != nil {
+			log.WithFields(log.Fields{"action": "RequestPasswordReset"}).Error(err)
+			writeError(w, r, errServer)
+			return
+		}
+
+		reset := PasswordReset{
+			UserID: user.ID,
+			Token:  hashToken(token),
+			Expiry: time.Now().Add(passwordResetLifetime),
+		}
+
+		if err := env.DB.Create(&reset).Error; err != nil {
+			log.WithFields(log.Fields{"action": "RequestPasswordReset"}).Error(err)
+			writeError(w, r, errServer)
+			return
+		}
+
+		message := Message{
+			To:      user.PrimaryEmail,
+			Subject: "Reset your chamba password",
+			Body: fmt.Sprintf("Use the token below to choose a new password. It expires in %s.\n\n%s",
+				passwordResetLifetime, token),
+		}
+		// A failed send answers the same as an unknown email so the response
+		// never tells whether an account exists
+		if err := env.Mailer.Send(message); err != nil {
+			log.WithFields(log.Fields{"action": "RequestPasswordReset"}).Error(err)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/text")
+	w.Write([]byte("If the account exists a reset token has been sent"))
+}
+
+// ConfirmPasswordReset sets a new password for the user the reset token was
+// issued to. Tokens can only be used once and signs the user out everywhere
+func ConfirmPasswordReset(env *AppContext, w http.ResponseWriter, r *http.Request) {
+	request := confirmPasswordResetRequest{}
+	if err := decodeRequest(r, &request); err != nil {
+		log.WithFields(log.Fields{"action": "ConfirmPasswordReset"}).Error(err)
+		writeError(w, r, err)
+		return
+	}
+
+	reset := PasswordReset{}
+	env.DB.Where(PasswordReset{Token: hashToken(request.Token)}).First(&reset)
+	if reset.ID == 0 || !reset.isUsable() {
+		log.WithFields(log.Fields{"action": "ConfirmPasswordReset"}).Error("Invalid or expired reset token")
+		writeError(w, r, badRequest("Invalid or expired reset token"))
+		return
+	}
+
+	saltedPassword, err := saltPassword(request.Password)
+	if err != nil {
+		log.Error(err)
+		writeError(w, r, errServer)
+		return
+	}
+
+	tx := env.DB.Begin()
+	// Only one request can use the token even if several arrive at once
+	used := tx.Model(&PasswordReset{}).Where("id = ? AND used_at IS NULL", reset.ID).UpdateColumn("used_at", time.Now())
+	if used.Error == nil && used.RowsAffected != 1 {
+		tx.Rollback()
+		log.WithFields(log.Fields{"action": "ConfirmPasswordReset"}).Error("Reset token was already used")
+		writeError(w, r, badRequest("Invalid or expired reset token"))
+		return
+	}
+	err = used.Error
+	if err == nil {
+		err = tx.Model(&User{}).Where("id = ?", reset.UserID).UpdateColumn("password", saltedPassword).Error
+	}
+	if err == nil {
+		err = tx.Where("user_id = ?", reset.UserID).Delete(&AuthToken{}).Error
+	}
+	if err == nil {
+		err = tx.Commit().Error
+	} else {
+		tx.Rollback()
+	}
+	if err != nil {
+		log.WithFields(log.Fields{"action": "ConfirmPasswordReset"}).Error(err)
+		writeError(w, r, errServer)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/text")
+	w.Write([]byte("Password updated"))
+}
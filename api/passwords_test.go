@@ -0,0 +1,146 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// recordingMailer keeps every message sent so tests can read them back
+type recordingMailer struct {
+	messages []Message
+}
+
+func (mailer *recordingMailer) Send(message Message) error {
+	mailer.messages = append(mailer.messages, message)
+	return nil
+}
+
+// failingMailer refuses to send anything
+type failingMailer struct{}
+
+func (failingMailer) Send(message Message) error {
+	return errors.New("mail server unavailable")
+}
+
+func postWithMailer(handler Handler, mailer Mailer, data url.Values) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("POST", "", strings.NewReader(data.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	context := &AppContext{DB: GetDB(), Mailer: mailer, Attempts: NewMemoryAttemptStore()}
+	AppHandler{AppContext: context, HandlerFunc: handler}.ServeHTTP(w, req)
+	return w
+}
+
+func requestTestPasswordReset(t *testing.T, email string) (token string) {
+	mailer := &recordingMailer{}
+	w := postWithMailer(RequestPasswordReset, mailer, url.Values{"email": {email}})
+	if w.Code != http.StatusOK {
+		t.Fatal("Expected status code 200 but got: ", w.Code)
+	}
+	if len(mailer.messages) != 1 || mailer.messages[0].To != email {
+		t.Fatal("Expected a single reset message to be mailed got:", mailer.messages)
+	}
+
+	lines := strings.Split(mailer.messages[0].Body, "\n")
+	token = lines[len(lines)-1]
+
+	reset := PasswordReset{}
+	GetDB().Where(PasswordReset{UserID: userIDByEmail(email)}).Last(&reset)
+	if reset.Token != hashToken(token) {
+		t.Fatal("Expected only the digest of the mailed token to be saved got:", reset.Token)
+	}
+	return token
+}
+
+func TestRequestPasswordResetForUnknownEmailSendsNothing(t *testing.T) {
+	mailer := &recordingMailer{}
+	w := postWithMailer(RequestPasswordReset, mailer, url.Values{"email": {"nobody@farm.com"}})
+	if w.Code != http.StatusOK {
+		t.Error("Expected status code 200 but got: ", w.Code)
+	}
+	if len(mailer.messages) != 0 {
+		t.Error("Expected no messages to be mailed got:", mailer.messages)
+	}
+}
+
+func TestRequestPasswordResetAnswersTheSameWhenMailFails(t *testing.T) {
+	setupUser()
+
+	unknown := postWithMailer(RequestPasswordReset, failingMailer{}, url.Values{"email": {"nobody@farm.com"}})
+	known := postWithMailer(RequestPasswordReset, failingMailer{}, url.Values{"email": {"mark@twain.com"}})
+	if known.Code != unknown.Code || known.Body.String() != unknown.Body.String() {
+		t.Error("Expected a failed send to answer like an unknown email but got:", known.Code, known.Body.String())
+	}
+
+	tearDown()
+}
+
+func TestPasswordResetChangesPasswordOnce(t *testing.T) {
+	signupAndSignin(t, "worker@farm.com", "old password")
+	token := requestTestPasswordReset(t, "worker@farm.com")
+
+	data := url.Values{"token": {token}, "password": {"new password"}}
+	w := postWithMailer(ConfirmPasswordReset, nil, data)
+	if w.Code != http.StatusOK {
+		t.Fatal("Expected status code 200 but got: ", w.Code, w.Body)
+	}
+
+	if _, err := authenticateUser(GetDB(), "worker@farm.com", "new password"); err != nil {
+		t.Error("Expected to sign in with the new password got:", err)
+	}
+	if _, err := authenticateUser(GetDB(), "worker@farm.com", "old password"); err == nil {
+		t.Error("Expected the old password to be rejected")
+	}
+
+	data.Set("password", "another password")
+	w = postWithMailer(ConfirmPasswordReset, nil, data)
+	if w.Code != http.StatusBadRequest {
+		t.Error("Expected reused token to be rejected but got: ", w.Code)
+	}
+
+	tearDown()
+}
+
+func TestExpiredPasswordResetIsRejected(t *testing.T) {
+	signupAndSignin(t, "worker@farm.com", "old password")
+	token := requestTestPasswordReset(t, "worker@farm.com")
+	GetDB().Model(&PasswordReset{}).Where("token = ?", hashToken(token)).UpdateColumn("expiry", time.Now().Add(-time.Minute))
+
+	w := postWithMailer(ConfirmPasswordReset, nil, url.Values{"token": {token}, "password": {"new password"}})
+	if w.Code != http.StatusBadRequest {
+		t.Error("Expected expired token to be rejected but got: ", w.Code)
+	}
+
+	tearDown()
+}
+
+func TestConcurrentPasswordResetsUseTheTokenOnce(t *testing.T) {
+	signupAndSignin(t, "worker@farm.com", "old password")
+	token := requestTestPasswordReset(t, "worker@farm.com")
+
+	codes := make(chan int, 5)
+	for i := 0; i < cap(codes); i++ {
+		go func(i int) {
+			password := fmt.Sprintf("new password %d", i)
+			codes <- postWithMailer(ConfirmPasswordReset, nil, url.Values{"token": {token}, "password": {password}}).Code
+		}(i)
+	}
+
+	succeeded := 0
+	for i := 0; i < cap(codes); i++ {
+		if <-codes == http.StatusOK {
+			succeeded++
+		}
+	}
+	if succeeded != 1 {
+		t.Error("Expected the token to change the password once got:", succeeded)
+	}
+
+	tearDown()
+}
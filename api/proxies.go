@@ -0,0 +1,79 @@
+package api
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// newTrustedProxies loads the proxies requests may be forwarded through from
+// TRUSTED_PROXIES, a comma separated list of IP addresses and CIDR ranges. The
+// X-Forwarded-For header is only believed when it comes from one of them
+func newTrustedProxies() (proxies []*net.IPNet) {
+	for _, entry := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		cidr := entry
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, proxy, err := net.ParseCIDR(cidr)
+		if err != nil {
+			log.WithFields(log.Fields{"proxy": entry}).Error("Ignoring a TRUSTED_PROXIES entry that is not an IP address or range")
+			continue
+		}
+		proxies = append(proxies, proxy)
+	}
+	return
+}
+
+// isTrustedProxy reports whether the address is one of the trusted proxies
+func isTrustedProxy(proxies []*net.IPNet, address string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+	for _, proxy := range proxies {
+		if proxy.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteIP is the address of the client making the request. When it arrives
+// from a trusted proxy the X-Forwarded-For header is read from the right, each
+// proxy appends the address it was connected from, and the first address that
+// is not a trusted proxy is the client. Anything the client put further left
+// is never reached. When there is no such address the last proxy is returned
+func remoteIP(env *AppContext, r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if !isTrustedProxy(env.TrustedProxies, ip) {
+		return ip
+	}
+
+	forwarded := strings.Split(strings.Join(r.Header["X-Forwarded-For"], ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(forwarded[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		ip = hop
+		if !isTrustedProxy(env.TrustedProxies, hop) {
+			break
+		}
+	}
+	return ip
+}
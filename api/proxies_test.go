@@ -0,0 +1,104 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestNewTrustedProxies(t *testing.T) {
+	defer os.Setenv("TRUSTED_PROXIES", os.Getenv("TRUSTED_PROXIES"))
+	os.Setenv("TRUSTED_PROXIES", "10.0.0.0/8, 192.0.2.1,not a proxy,2001:db8::1")
+	proxies := newTrustedProxies()
+
+	var testCases = []struct {
+		address  string
+		expected bool
+	}{
+		{"10.20.30.40", true},
+		{"192.0.2.1", true},
+		{"192.0.2.2", false},
+		{"2001:db8::1", true},
+		{"2001:db8::2", false},
+		{"not an address", false},
+	}
+
+	if len(proxies) != 3 {
+		t.Error("Expected the invalid entry to be skipped got:", proxies)
+	}
+	for _, testCase := range testCases {
+		if trusted := isTrustedProxy(proxies, testCase.address); trusted != testCase.expected {
+			t.Errorf("Expected %s to be trusted %t but got %t", testCase.address, testCase.expected, trusted)
+		}
+	}
+
+	os.Setenv("TRUSTED_PROXIES", "")
+	if proxies := newTrustedProxies(); len(proxies) != 0 {
+		t.Error("Expected no trusted proxies when none are configured got:", proxies)
+	}
+}
+
+func TestRemoteIPOnlyBelievesTrustedProxies(t *testing.T) {
+	os.Setenv("TRUSTED_PROXIES", "10.0.0.0/8")
+	proxied := &AppContext{TrustedProxies: newTrustedProxies()}
+	os.Setenv("TRUSTED_PROXIES", "")
+
+	var testCases = []struct {
+		env        *AppContext
+		remoteAddr string
+		forwarded  []string
+		expected   string
+		reason     string
+	}{
+		{&AppContext{}, "192.0.2.1:1234", nil, "192.0.2.1", "Connected directly"},
+		{&AppContext{}, "10.1.2.3:1234", []string{"203.0.113.7"}, "10.1.2.3", "No proxies are trusted"},
+		{proxied, "192.0.2.1:1234", []string{"203.0.113.7"}, "192.0.2.1", "Forwarded by an address that is not a proxy"},
+		{proxied, "10.1.2.3:1234", []string{"203.0.113.7"}, "203.0.113.7", "Forwarded by a trusted proxy"},
+		{proxied, "10.1.2.3:1234", []string{"198.51.100.1, 203.0.113.7"}, "203.0.113.7", "The client sent its own X-Forwarded-For"},
+		{proxied, "10.1.2.3:1234", []string{"203.0.113.7, 10.0.0.5"}, "203.0.113.7", "Forwarded through two trusted proxies"},
+		{proxied, "10.1.2.3:1234", []string{"198.51.100.1", "203.0.113.7"}, "203.0.113.7", "X-Forwarded-For sent more than once"},
+		{proxied, "10.1.2.3:1234", nil, "10.1.2.3", "A trusted proxy that did not forward an address"},
+		{proxied, "10.1.2.3:1234", []string{"unknown"}, "10.1.2.3", "A forwarded address that is not an IP"},
+	}
+
+	for _, testCase := range testCases {
+		r, _ := http.NewRequest("GET", "/", nil)
+		r.RemoteAddr = testCase.remoteAddr
+		for _, forwarded := range testCase.forwarded {
+			r.Header.Add("X-Forwarded-For", forwarded)
+		}
+		if ip := remoteIP(testCase.env, r); ip != testCase.expected {
+			t.Errorf("Expected %s but got %s reason %s", testCase.expected, ip, testCase.reason)
+		}
+	}
+}
+
+func TestThrottleLimitsClientsBehindAProxySeparately(t *testing.T) {
+	os.Setenv("TRUSTED_PROXIES", "10.0.0.0/8")
+	context := &AppContext{TrustedProxies: newTrustedProxies()}
+	os.Setenv("TRUSTED_PROXIES", "")
+
+	handler := Throttle(RateLimit{Requests: 1, Per: time.Minute})(func(env *AppContext, w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	throttled := func(client string) int {
+		r, _ := http.NewRequest("GET", "/farms/search", nil)
+		r.RemoteAddr = "10.1.2.3:1234"
+		r.Header.Set("X-Forwarded-For", client)
+		w := httptest.NewRecorder()
+		AppHandler{context, handler}.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	if code := throttled("203.0.113.7"); code != http.StatusOK {
+		t.Error("Expected the first client to be allowed but got: ", code)
+	}
+	if code := throttled("203.0.113.8"); code != http.StatusOK {
+		t.Error("Expected a second client behind the same proxy to have its own bucket but got: ", code)
+	}
+	if code := throttled("203.0.113.7"); code != http.StatusTooManyRequests {
+		t.Error("Expected the first client to be over its limit but got: ", code)
+	}
+}
@@ -0,0 +1,152 @@
+package api
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// RateLimit allows a client to make Requests every Per. Clients can burst up
+// to Requests at once after which requests are refilled evenly over Per
+type RateLimit struct {
+	Requests int
+	Per      time.Duration
+}
+
+// rateLimits are the limits applied to each group of routes in Handlers
+type rateLimits struct {
+	Signup RateLimit // new accounts from one IP
+	Signin RateLimit // signin attempts from one IP
+	Mail   RateLimit // routes that send email from one IP or user
+	Public RateLimit // other routes that do not need a signed in user
+	Auth   RateLimit // every route needing a signed in user from one IP, checked before the token is
+	User   RateLimit // every route a signed in user calls
+}
+
+var routeRateLimits = rateLimits{
+	Signup: RateLimit{Requests: 10, Per: time.Hour},
+	Signin: RateLimit{Requests: 20, Per: time.Minute},
+	Mail:   RateLimit{Requests: 5, Per: 15 * time.Minute},
+	Public: RateLimit{Requests: 60, Per: time.Minute},
+	Auth:   RateLimit{Requests: 600, Per: time.Minute},
+	User:   RateLimit{Requests: 300, Per: time.Minute},
+}
+
+// bucket holds the requests a client has left as of updated
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// rateLimiter is a token bucket per client. Buckets are kept in memory so each
+// api process limits the clients it serves
+type rateLimiter struct {
+	limit     RateLimit
+	now       func() time.Time
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+// rateLimitResult describes the state of a client's bucket after a request
+type rateLimitResult struct {
+	allowed    bool
+	remaining  int
+	reset      time.Time     // when the bucket will be full again
+	retryAfter time.Duration // how long until the next request is allowed
+}
+
+func newRateLimiter(limit RateLimit) *rateLimiter {
+	return &rateLimiter{limit: limit, now: time.Now, buckets: map[string]*bucket{}}
+}
+
+// refillRate is the number of requests returned to a bucket every nanosecond
+func (limiter *rateLimiter) refillRate() float64 {
+	return float64(limiter.limit.Requests) / float64(limiter.limit.Per)
+}
+
+// take spends one request from the client's bucket if there is one left
+func (limiter *rateLimiter) take(key string) (result rateLimitResult) {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	now := limiter.now()
+	limiter.sweep(now)
+
+	capacity := float64(limiter.limit.Requests)
+	b, ok := limiter.buckets[key]
+	if !ok {
+		b = &bucket{tokens: capacity, updated: now}
+		limiter.buckets[key] = b
+	}
+	b.tokens = math.Min(capacity, b.tokens+float64(now.Sub(b.updated))*limiter.refillRate())
+	b.updated = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		result.allowed = true
+	} else {
+		result.retryAfter = time.Duration((1 - b.tokens) / limiter.refillRate())
+	}
+	result.remaining = int(b.tokens)
+	result.reset = now.Add(time.Duration((capacity - b.tokens) / limiter.refillRate()))
+	return
+}
+
+// sweep forgets the buckets that have refilled since they were last used so
+// clients that have gone away do not hold on to memory. It runs at most once
+// per limit period
+func (limiter *rateLimiter) sweep(now time.Time) {
+	if now.Sub(limiter.lastSweep) < limiter.limit.Per {
+		return
+	}
+	limiter.lastSweep = now
+	for key, b := range limiter.buckets {
+		if now.Sub(b.updated) >= limiter.limit.Per {
+			delete(limiter.buckets, key)
+		}
+	}
+}
+
+// rateLimitKey identifies the client making the request. Signed in users are
+// limited on their own, everyone else by the IP they connect from
+func rateLimitKey(env *AppContext, r *http.Request) string {
+	if env.User.ID != 0 {
+		return fmt.Sprintf("user:%d", env.User.ID)
+	}
+	return "ip:" + remoteIP(env, r)
+}
+
+// Throttle middleware limits how often each client can call the handler. Every
+// call to Throttle starts its own set of buckets so routes wrapped separately
+// are limited separately. Requests over the limit get a 429
+func Throttle(limit RateLimit) func(Handler) Handler {
+	limiter := newRateLimiter(limit)
+	return func(h Handler) Handler {
+		return func(env *AppContext, w http.ResponseWriter, r *http.Request) {
+			key := rateLimitKey(env, r)
+			result := limiter.take(key)
+
+			w.Header().Set("X-RateLimit-Limit", strconv.Itoa(limit.Requests))
+			w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(result.remaining))
+			w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(int64(math.Ceil(float64(result.reset.UnixNano())/float64(time.Second))), 10))
+
+			if !result.allowed {
+				retryAfter := int(math.Ceil(result.retryAfter.Seconds()))
+				log.WithFields(log.Fields{
+					"client": key,
+					"url":    r.URL,
+				}).Error("Client is over the rate limit")
+				w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+				writeError(w, r, tooManyRequests(fmt.Sprintf("Rate limit exceeded, try again in %d seconds", retryAfter)))
+				return
+			}
+			h(env, w, r)
+		}
+	}
+}
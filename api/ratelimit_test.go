@@ -0,0 +1,130 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterRefillsOverTime(t *testing.T) {
+	now := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	limiter := newRateLimiter(RateLimit{Requests: 3, Per: 3 * time.Second})
+	limiter.now = func() time.Time { return now }
+
+	var testCases = []struct {
+		advance           time.Duration
+		expectedAllowed   bool
+		expectedRemaining int
+		reason            string
+	}{
+		{0, true, 2, "Buckets start full"},
+		{0, true, 1, "Requests can burst"},
+		{0, true, 0, "Up to the limit"},
+		{0, false, 0, "Over the limit"},
+		{500 * time.Millisecond, false, 0, "Half a request has been refilled"},
+		{500 * time.Millisecond, true, 0, "A whole request has been refilled"},
+		{time.Hour, true, 2, "Buckets never hold more than the limit"},
+	}
+
+	for _, testCase := range testCases {
+		now = now.Add(testCase.advance)
+		result := limiter.take("ip:192.0.2.1")
+		if result.allowed != testCase.expectedAllowed || result.remaining != testCase.expectedRemaining {
+			t.Errorf("Expected allowed %v with %d remaining but got %v with %d reason %s",
+				testCase.expectedAllowed, testCase.expectedRemaining, result.allowed, result.remaining, testCase.reason)
+		}
+	}
+
+	if result := limiter.take("ip:192.0.2.2"); !result.allowed {
+		t.Error("Expected every client to have their own bucket")
+	}
+
+	now = now.Add(time.Hour)
+	limiter.take("ip:192.0.2.2")
+	if _, ok := limiter.buckets["ip:192.0.2.1"]; ok {
+		t.Error("Expected idle buckets to be swept")
+	}
+}
+
+func TestThrottleSetsRateLimitHeaders(t *testing.T) {
+	handler := Throttle(RateLimit{Requests: 2, Per: time.Minute})(func(env *AppContext, w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	throttled := func(user User) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest("GET", "/farms", nil)
+		r.RemoteAddr = "192.0.2.1:1234"
+		w := httptest.NewRecorder()
+		AppHandler{&AppContext{}, func(env *AppContext, w http.ResponseWriter, r *http.Request) {
+			env.User = user
+			handler(env, w, r)
+		}}.ServeHTTP(w, r)
+		return w
+	}
+
+	var testCases = []struct {
+		user               User
+		expectedStatusCode int
+		expectedRemaining  string
+		reason             string
+	}{
+		{User{}, http.StatusOK, "1", "First request from the IP"},
+		{User{}, http.StatusOK, "0", "Last request from the IP"},
+		{User{}, http.StatusTooManyRequests, "0", "The IP is over the limit"},
+		{User{ID: 1}, http.StatusOK, "1", "Signed in users are limited on their own"},
+	}
+
+	for _, testCase := range testCases {
+		w := throttled(testCase.user)
+		if w.Code != testCase.expectedStatusCode || w.Header().Get("X-RateLimit-Remaining") != testCase.expectedRemaining {
+			t.Errorf("Expected %d with %s remaining but got %d with %s reason %s", testCase.expectedStatusCode,
+				testCase.expectedRemaining, w.Code, w.Header().Get("X-RateLimit-Remaining"), testCase.reason)
+		}
+		if w.Header().Get("X-RateLimit-Limit") != "2" {
+			t.Error("Expected X-RateLimit-Limit to be 2 got:", w.Header().Get("X-RateLimit-Limit"))
+		}
+		if reset, _ := strconv.ParseInt(w.Header().Get("X-RateLimit-Reset"), 10, 64); reset < time.Now().Unix() {
+			t.Error("Expected X-RateLimit-Reset to be in the future got:", w.Header().Get("X-RateLimit-Reset"))
+		}
+	}
+
+	w := throttled(User{})
+	if retryAfter, _ := strconv.Atoi(w.Header().Get("Retry-After")); retryAfter < 1 || retryAfter > 30 {
+		t.Error("Expected Retry-After to be when the next request is refilled got:", w.Header().Get("Retry-After"))
+	}
+	if apiError := errorResponse(t, w.Result()); apiError.Code != CodeTooManyRequests {
+		t.Error("Expected too_many_requests error got:", apiError)
+	}
+}
+
+func TestMadeUpTokensAreThrottledByIP(t *testing.T) {
+	limits := routeRateLimits
+	routeRateLimits.Auth = RateLimit{Requests: 2, Per: time.Minute}
+	throttled := httptest.NewServer(Handlers())
+	routeRateLimits = limits
+	defer throttled.Close()
+
+	var testCases = []struct {
+		expectedStatusCode int
+		reason             string
+	}{
+		{http.StatusUnauthorized, "First made up token is checked"},
+		{http.StatusUnauthorized, "Second made up token is checked"},
+		{http.StatusTooManyRequests, "The IP is over the limit before the token is looked up"},
+	}
+
+	for i, testCase := range testCases {
+		request, _ := http.NewRequest("GET", throttled.URL+"/farms", nil)
+		request.Header.Set("Authorization", fmt.Sprintf("Bearer A MADE UP TOKEN %d", i))
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		if response.StatusCode != testCase.expectedStatusCode {
+			t.Errorf("Expected %d but got %d reason %s", testCase.expectedStatusCode, response.StatusCode, testCase.reason)
+		}
+	}
+}
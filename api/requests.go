@@ -0,0 +1,208 @@
+package api
+
+import (
+	"encoding"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// FieldError describes why a single request field was rejected
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationError is returned when one or more fields of a request are invalid
+type ValidationError struct {
+	Fields []FieldError `json:"fields"`
+}
+
+func (e ValidationError) Error() string {
+	messages := []string{}
+	for _, field := range e.Fields {
+		messages = append(messages, field.Field+" "+field.Message)
+	}
+	return "Invalid request: " + strings.Join(messages, ", ")
+}
+
+// fieldErrors collects the field errors found while validating a request
+type fieldErrors []FieldError
+
+func (errs *fieldErrors) add(field, message string) {
+	*errs = append(*errs, FieldError{Field: field, Message: message})
+}
+
+// err returns the collected errors as a ValidationError or nil when there are none
+func (errs fieldErrors) err() error {
+	if len(errs) == 0 {
+		return nil
+	}
+	return ValidationError{Fields: errs}
+}
+
+// optionalID is a request field holding the ID of something that can also be
+// cleared. Present is set whenever the field is sent and an ID of 0, or null in
+// JSON, clears it. A value that is not an ID is kept in Err for the request's
+// validate method to report against the field
+type optionalID struct {
+	Present bool
+	ID      uint
+	Err     error
+}
+
+func (id *optionalID) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		*id = optionalID{Present: true}
+		return nil
+	}
+	return id.UnmarshalText(data)
+}
+
+func (id *optionalID) UnmarshalText(text []byte) error {
+	*id = optionalID{Present: true}
+	id.Err = setFromString(reflect.ValueOf(&id.ID).Elem(), string(text))
+	return nil
+}
+
+// validator is implemented by request structs with rules beyond required fields
+type validator interface {
+	validate() fieldErrors
+}
+
+// decodeRequest fills the request struct v from the body of the request. JSON
+// bodies are decoded when the Content-Type is application/json otherwise the
+// form values named by each field's json tag are used. Fields tagged with
+// validate:"required" must be present and the struct's own validate method is
+// run afterwards on the fields that passed. Any problems are returned together
+// as a ValidationError
+func decodeRequest(r *http.Request, v interface{}) error {
+	var errs fieldErrors
+	if isJSONRequest(r) {
+		errs = decodeJSON(r, v)
+	} else {
+		errs = decodeForm(r, v)
+	}
+
+	invalid := map[string]bool{}
+	for _, fieldError := range errs {
+		invalid[fieldError.Field] = true
+	}
+
+	value := reflect.ValueOf(v).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		name := requestFieldName(field)
+		if field.Tag.Get("validate") != "required" || invalid[name] {
+			continue
+		}
+		if reflect.DeepEqual(value.Field(i).Interface(), reflect.Zero(field.Type).Interface()) {
+			errs.add(name, "is required")
+			invalid[name] = true
+		}
+	}
+
+	// fields that could not be decoded or are missing already have an error
+	// so only the request's other problems are added
+	if request, ok := v.(validator); ok {
+		for _, fieldError := range request.validate() {
+			if !invalid[fieldError.Field] {
+				errs = append(errs, fieldError)
+			}
+		}
+	}
+	return errs.err()
+}
+
+func isJSONRequest(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == "application/json"
+}
+
+func decodeJSON(r *http.Request, v interface{}) (errs fieldErrors) {
+	err := json.NewDecoder(r.Body).Decode(v)
+	switch e := err.(type) {
+	case nil:
+	case *json.UnmarshalTypeError:
+		errs.add(e.Field, fmt.Sprintf("must be a %s", e.Type))
+	default:
+		if err != io.EOF { // an empty body is the same as an empty object
+			errs.add("body", "is not valid JSON")
+		}
+	}
+	return
+}
+
+func decodeForm(r *http.Request, v interface{}) (errs fieldErrors) {
+	value := reflect.ValueOf(v).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		name := requestFieldName(value.Type().Field(i))
+		raw := r.PostFormValue(name)
+		if raw == "" {
+			continue
+		}
+
+		target := value.Field(i)
+		if target.Kind() == reflect.Ptr {
+			target.Set(reflect.New(target.Type().Elem()))
+			target = target.Elem()
+		}
+		if unmarshaler, ok := target.Addr().Interface().(encoding.TextUnmarshaler); ok {
+			if err := unmarshaler.UnmarshalText([]byte(raw)); err != nil {
+				errs.add(name, err.Error())
+			}
+			continue
+		}
+		if err := setFromString(target, raw); err != nil {
+			errs.add(name, err.Error())
+		}
+	}
+	return
+}
+
+func requestFieldName(field reflect.StructField) string {
+	if name := strings.Split(field.Tag.Get("json"), ",")[0]; name != "" {
+		return name
+	}
+	return strings.ToLower(field.Name)
+}
+
+func setFromString(target reflect.Value, raw string) error {
+	switch target.Kind() {
+	case reflect.String:
+		target.SetString(raw)
+	case reflect.Int:
+		parsed, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return errors.New("must be a whole number")
+		}
+		target.SetInt(parsed)
+	case reflect.Uint:
+		parsed, err := strconv.ParseUint(raw, 10, 64)
+		if err != nil {
+			return errors.New("must be a positive whole number")
+		}
+		target.SetUint(parsed)
+	case reflect.Float64:
+		parsed, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return errors.New("must be a number")
+		}
+		target.SetFloat(parsed)
+	case reflect.Bool:
+		parsed, err := strconv.ParseBool(raw)
+		if err != nil {
+			return errors.New("must be true or false")
+		}
+		target.SetBool(parsed)
+	default:
+		return fmt.Errorf("cannot be decoded into %s", target.Type())
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDecodeRequestReadsJSONAndFormBodies(t *testing.T) {
+	form := url.Values{}
+	form.Add("name", "Green Acres")
+	form.Add("latitude", "43.5448")
+
+	var testCases = []struct {
+		contentType string
+		body        string
+		reason      string
+	}{
+		{"application/json", `{"name": "Green Acres", "latitude": 43.5448}`, "JSON body"},
+		{"application/json; charset=utf-8", `{"name": "Green Acres", "latitude": 43.5448}`, "JSON body with charset"},
+		{"application/x-www-form-urlencoded", form.Encode(), "Form body"},
+	}
+
+	for _, testCase := range testCases {
+		r, _ := http.NewRequest("POST", "/farms", strings.NewReader(testCase.body))
+		r.Header.Set("Content-Type", testCase.contentType)
+
+		request := farmRequest{}
+		if err := decodeRequest(r, &request); err != nil {
+			t.Errorf("Expected no error but got %v reason %s", err, testCase.reason)
+			continue
+		}
+		if request.Name == nil || *request.Name != "Green Acres" || request.Latitude == nil || *request.Latitude != 43.5448 {
+			t.Errorf("Expected name and latitude to be decoded got %+v reason %s", request, testCase.reason)
+		}
+		if request.Description != nil {
+			t.Errorf("Expected fields missing from the body to stay nil reason %s", testCase.reason)
+		}
+	}
+}
+
+func TestDecodeRequestReportsEveryInvalidField(t *testing.T) {
+	var testCases = []struct {
+		contentType string
+		body        string
+		expected    []FieldError
+		reason      string
+	}{
+		{"application/json", `{"email": "mark@twain.com"}`, []FieldError{
+			{"firstname", "is required"},
+			{"lastname", "is required"},
+			{"password", "is required"},
+		}, "Missing required fields"},
+		{"application/json", `{"firstname": 12}`, []FieldError{
+			{"firstname", "must be a string"},
+			{"lastname", "is required"},
+			{"email", "is required"},
+			{"password", "is required"},
+		}, "Wrong JSON type"},
+		{"application/json", `{"firstname": `, []FieldError{
+			{"body", "is not valid JSON"},
+			{"firstname", "is required"},
+			{"lastname", "is required"},
+			{"email", "is required"},
+			{"password", "is required"},
+		}, "Malformed JSON"},
+	}
+
+	for _, testCase := range testCases {
+		r, _ := http.NewRequest("POST", "/signup", strings.NewReader(testCase.body))
+		r.Header.Set("Content-Type", testCase.contentType)
+
+		err := decodeRequest(r, &signupRequest{})
+		validationError, ok := err.(ValidationError)
+		if !ok {
+			t.Errorf("Expected a ValidationError but got %v reason %s", err, testCase.reason)
+			continue
+		}
+		if !reflect.DeepEqual(validationError.Fields, testCase.expected) {
+			t.Errorf("Expected %v but got %v reason %s", testCase.expected, validationError.Fields, testCase.reason)
+		}
+	}
+}
+
+func TestDecodeRequestRunsRequestValidation(t *testing.T) {
+	form := url.Values{}
+	form.Add("latitude", "north")
+	form.Add("longitude", "-180.5")
+
+	r, _ := http.NewRequest("POST", "/farms", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	err := decodeRequest(r, &farmRequest{})
+	validationError, ok := err.(ValidationError)
+	if !ok || len(validationError.Fields) != 2 {
+		t.Fatal("Expected the latitude and longitude to be reported got:", err)
+	}
+	if validationError.Fields[0].Field != "latitude" || validationError.Fields[1].Field != "longitude" {
+		t.Error("Expected the decode error and then the validation error got:", validationError.Fields)
+	}
+}
+
+func TestSignupAcceptsJSONBody(t *testing.T) {
+	body := `{"firstname": "Mark", "lastname": "Twain", "email": "mark@twain.com", "password": "Huckelberry"}`
+	request, _ := http.NewRequest("POST", signupURL, strings.NewReader(body))
+	request.Header.Set("Content-Type", "application/json")
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != http.StatusOK {
+		t.Error("Expected status code 200 but got: ", response.StatusCode)
+	}
+
+	user := User{}
+	if GetDB().Where(User{PrimaryEmail: "mark@twain.com"}).First(&user).RecordNotFound() || user.FirstName != "Mark" {
+		t.Error("Expected user to be saved from the JSON body got:", user)
+	}
+
+	tearDown()
+}
+
+func TestValidationErrorsAreReturnedAsJSON(t *testing.T) {
+	request, _ := http.NewRequest("POST", signupURL, strings.NewReader(`{"email": "mark@twain.com"}`))
+	request.Header.Set("Content-Type", "application/json")
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusBadRequest {
+		t.Error("Expected status code 400 but got: ", response.StatusCode)
+	}
+
+	result := struct {
+		Error APIError `json:"error"`
+	}{}
+	if err := json.NewDecoder(response.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Error.Code != CodeValidationFailed || len(result.Error.Fields) != 3 {
+		t.Error("Expected the three missing fields to be listed got:", result)
+	}
+}
+
+func TestOptionalIDCanBeSetOrCleared(t *testing.T) {
+	var testCases = []struct {
+		contentType string
+		body        string
+		expected    optionalID
+		expectedErr bool
+		reason      string
+	}{
+		{"application/json", `{}`, optionalID{}, false, "Left out"},
+		{"application/json", `{"assigneeid": 7}`, optionalID{Present: true, ID: 7}, false, "Set in JSON"},
+		{"application/json", `{"assigneeid": 0}`, optionalID{Present: true}, false, "Cleared with 0 in JSON"},
+		{"application/json", `{"assigneeid": null}`, optionalID{Present: true}, false, "Cleared with null in JSON"},
+		{"application/json", `{"assigneeid": "seven"}`, optionalID{Present: true}, true, "Not an ID in JSON"},
+		{"application/x-www-form-urlencoded", "assigneeid=7", optionalID{Present: true, ID: 7}, false, "Set in a form"},
+		{"application/x-www-form-urlencoded", "assigneeid=0", optionalID{Present: true}, false, "Cleared with 0 in a form"},
+		{"application/x-www-form-urlencoded", "assigneeid=-1", optionalID{Present: true}, true, "Not an ID in a form"},
+	}
+
+	for _, testCase := range testCases {
+		r, _ := http.NewRequest("PUT", "/farms/1/tasks/1", strings.NewReader(testCase.body))
+		r.Header.Set("Content-Type", testCase.contentType)
+
+		request := taskRequest{}
+		err := decodeRequest(r, &request)
+		id := request.AssigneeID
+		if id.Present != testCase.expected.Present || id.ID != testCase.expected.ID || (err != nil) != testCase.expectedErr {
+			t.Errorf("Expected %+v with error %t but got %+v %v reason %s", testCase.expected, testCase.expectedErr, id, err, testCase.reason)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+type engagementRequest struct {
+	WorkerID uint `json:"workerid" validate:"required"`
+}
+
+type reviewRequest struct {
+	EngagementID uint   `json:"engagementid" validate:"required"`
+	Stars        int    `json:"stars"`
+	Comment      string `json:"comment"`
+}
+
+func (request reviewRequest) validate() (errs fieldErrors) {
+	if request.Stars < 1 || request.Stars > 5 {
+		errs.add("stars", "must be a whole number from 1 to 5")
+	}
+	return
+}
+
+func listEngagements(env *AppContext, w http.ResponseWriter, r *http.Request) {
+	farm, ok := findOwnedFarm(env, w, r)
+	if !ok {
+		return
+	}
+
+	engagements := []Engagement{}
+	if err := env.DB.Where(Engagement{FarmID: farm.ID}).Order("id").Find(&engagements).Error; err != nil {
+		log.WithFields(log.Fields{"action": "listEngagements"}).Error(err)
+		writeError(w, r, errServer)
+		return
+	}
+	writeJSON(w, http.StatusOK, engagements)
+}
+
+func createEngagement(env *AppContext, w http.ResponseWriter, r *http.Request) {
+	farm, ok := findOwnedFarm(env, w, r)
+	if !ok {
+		return
+	}
+
+	request := engagementRequest{}
+	if err := decodeRequest(r, &request); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	worker := User{}
+	if env.DB.First(&worker, request.WorkerID).RecordNotFound() || worker.ID == farm.OwnerID {
+		writeError(w, r, badRequest("Worker not found"))
+		return
+	}
+
+	engagement := Engagement{FarmID: farm.ID, WorkerID: worker.ID}
+	if err := env.DB.Create(&engagement).Error; err != nil {
+		log.WithFields(log.Fields{"action": "createEngagement"}).Error(err)
+		writeError(w, r, errServer)
+		return
+	}
+	writeJSON(w, http.StatusCreated, engagement)
+}
+
+func completeEngagement(env *AppContext, w http.ResponseWriter, r *http.Request) {
+	farm, ok := findOwnedFarm(env, w, r)
+	if !ok {
+		return
+	}
+
+	id, err := pathID(r, "engagementid")
+	if err != nil {
+		writeError(w, r, badRequest(err.Error()))
+		return
+	}
+
+	engagement := Engagement{}
+	if env.DB.Where(Engagement{FarmID: farm.ID}).First(&engagement, id).RecordNotFound() {
+		writeError(w, r, notFound("Engagement not found"))
+		return
+	}
+
+	if !engagement.IsCompleted() {
+		now := time.Now()
+		engagement.CompletedAt = &now
+		if err := env.DB.Save(&engagement).Error; err != nil {
+			log.WithFields(log.Fields{"action": "completeEngagement"}).Error(err)
+			writeError(w, r, errServer)
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, engagement)
+}
+
+// FarmReviews lists the reviews workers have left about a farm
+func FarmReviews(env *AppContext, w http.ResponseWriter, r *http.Request) {
+	farm, ok := findFarm(env, w, r)
+	if !ok {
+		return
+	}
+
+	reviews := []Review{}
+	if err := env.DB.Where(Review{FarmID: farm.ID, Kind: ReviewOfFarm}).Order("id").Find(&reviews).Error; err != nil {
+		log.WithFields(log.Fields{"action": "FarmReviews"}).Error(err)
+		writeError(w, r, errServer)
+		return
+	}
+	writeJSON(w, http.StatusOK, reviews)
+}
+
+// CreateReview leaves a review for a completed engagement. The worker on the
+// engagement reviews the farm and the farm owner reviews the worker
+func CreateReview(env *AppContext, w http.ResponseWriter, r *http.Request) {
+	request := reviewRequest{}
+	if err := decodeRequest(r, &request); err != nil {
+		log.WithFields(log.Fields{"action": "CreateReview"}).Error(err)
+		writeError(w, r, err)
+		return
+	}
+
+	engagement := Engagement{}
+	if env.DB.First(&engagement, request.EngagementID).RecordNotFound() {
+		writeError(w, r, notFound("Engagement not found"))
+		return
+	}
+
+	farm := Farm{}
+	env.DB.First(&farm, engagement.FarmID)
+
+	review := Review{
+		EngagementID: engagement.ID,
+		AuthorID:     env.User.ID,
+		FarmID:       engagement.FarmID,
+		WorkerID:     engagement.WorkerID,
+		Stars:        request.Stars,
+		Comment:      request.Comment,
+	}
+
+	switch env.User.ID {
+	case engagement.WorkerID:
+		review.Kind = ReviewOfFarm
+	case farm.OwnerID:
+		review.Kind = ReviewOfWorker
+	default:
+		writeError(w, r, forbidden("Only the worker and farm owner can review an engagement"))
+		return
+	}
+
+	if !engagement.IsCompleted() {
+		writeError(w, r, badRequest("Engagement must be completed before it can be reviewed"))
+		return
+	}
+
+	if err := review.Save(env.DB); err != nil {
+		log.WithFields(log.Fields{"action": "CreateReview"}).Error(err)
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, review)
+}
@@ -0,0 +1,127 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+)
+
+var reviewsURL string
+
+func init() {
+	reviewsURL = fmt.Sprintf("%s/reviews", server.URL)
+}
+
+func userIDByEmail(email string) uint {
+	user := User{}
+	GetDB().Where(User{PrimaryEmail: email}).First(&user)
+	return user.ID
+}
+
+func reviewData(engagement Engagement, stars string) url.Values {
+	data := url.Values{}
+	data.Add("engagementid", strconv.Itoa(int(engagement.ID)))
+	data.Add("stars", stars)
+	data.Add("comment", "Would work here again")
+	return data
+}
+
+func TestReviewsAreLimitedToCompletedEngagements(t *testing.T) {
+	ownerToken := signupAndSigninAs(t, "owner@farm.com", "some password", RoleFarmOwner)
+	workerToken := signupAndSignin(t, "worker@farm.com", "some password")
+	strangerToken := signupAndSignin(t, "stranger@farm.com", "some password")
+	farm := Farm{}
+	postJSON(t, ownerToken, farmsURL, map[string]interface{}{"name": "Green Acres"}, &farm)
+	engagement := Engagement{}
+	postJSON(t, ownerToken, fmt.Sprintf("%s/%d/engagements", farmsURL, farm.ID), map[string]interface{}{"workerid": userIDByEmail("worker@farm.com")}, &engagement)
+	engagementURL := fmt.Sprintf("%s/%d/engagements/%d", farmsURL, farm.ID, engagement.ID)
+
+	response := doWithToken(t, "POST", reviewsURL, workerToken, reviewData(engagement, "5"))
+	if response.StatusCode != http.StatusBadRequest {
+		t.Error("Expected incomplete engagement to be rejected but got: ", response.StatusCode)
+	}
+
+	response = doWithToken(t, "PUT", engagementURL, workerToken, url.Values{})
+	if response.StatusCode != http.StatusForbidden {
+		t.Error("Expected only the owner to complete an engagement but got: ", response.StatusCode)
+	}
+
+	response = doWithToken(t, "PUT", engagementURL, ownerToken, url.Values{})
+	if response.StatusCode != http.StatusOK {
+		t.Fatal("Expected engagement to be completed but got: ", response.StatusCode)
+	}
+
+	var testCases = []struct {
+		token              string
+		stars              string
+		expectedStatusCode int
+		reason             string
+	}{
+		{workerToken, "0", http.StatusBadRequest, "Stars below range"},
+		{workerToken, "6", http.StatusBadRequest, "Stars above range"},
+		{workerToken, "many", http.StatusBadRequest, "Stars not a number"},
+		{strangerToken, "3", http.StatusForbidden, "Not part of the engagement"},
+		{workerToken, "4", http.StatusCreated, "Worker reviews the farm"},
+		{workerToken, "2", http.StatusConflict, "Worker already reviewed the engagement"},
+		{ownerToken, "5", http.StatusCreated, "Owner reviews the worker"},
+		{ownerToken, "5", http.StatusConflict, "Owner already reviewed the engagement"},
+	}
+
+	for _, testCase := range testCases {
+		response := doWithToken(t, "POST", reviewsURL, testCase.token, reviewData(engagement, testCase.stars))
+		if response.StatusCode != testCase.expectedStatusCode {
+			t.Errorf("Expected %d but got %d reason %s", testCase.expectedStatusCode, response.StatusCode, testCase.reason)
+		}
+	}
+
+	tearDown()
+}
+
+func TestFarmAndUserReadsIncludeRating(t *testing.T) {
+	ownerToken := signupAndSigninAs(t, "owner@farm.com", "some password", RoleFarmOwner)
+	farm := Farm{}
+	postJSON(t, ownerToken, farmsURL, map[string]interface{}{"name": "Green Acres"}, &farm)
+
+	for i, stars := range []string{"5", "2"} {
+		email := fmt.Sprintf("worker%d@farm.com", i)
+		workerToken := signupAndSignin(t, email, "some password")
+		engagement := Engagement{}
+		postJSON(t, ownerToken, fmt.Sprintf("%s/%d/engagements", farmsURL, farm.ID), map[string]interface{}{"workerid": userIDByEmail(email)}, &engagement)
+		doWithToken(t, "PUT", fmt.Sprintf("%s/%d/engagements/%d", farmsURL, farm.ID, engagement.ID), ownerToken, url.Values{})
+		doWithToken(t, "POST", reviewsURL, workerToken, reviewData(engagement, stars))
+		doWithToken(t, "POST", reviewsURL, ownerToken, reviewData(engagement, "4"))
+	}
+
+	response := doWithToken(t, "GET", fmt.Sprintf("%s/%d", farmsURL, farm.ID), ownerToken, url.Values{})
+	result := Farm{}
+	json.NewDecoder(response.Body).Decode(&result)
+	if result.Rating.Count != 2 || result.Rating.Average != 3.5 {
+		t.Error("Expected farm rating of 3.5 from 2 reviews got:", result.Rating)
+	}
+
+	response = doWithToken(t, "GET", fmt.Sprintf("%s/users/%d", server.URL, userIDByEmail("worker0@farm.com")), ownerToken, url.Values{})
+	profile := struct{ Rating RatingSummary }{}
+	json.NewDecoder(response.Body).Decode(&profile)
+	if profile.Rating.Count != 1 || profile.Rating.Average != 4 {
+		t.Error("Expected worker rating of 4 from 1 review got:", profile.Rating)
+	}
+
+	tearDown()
+}
+
+func TestConcurrentReviewsOfAnEngagementConflict(t *testing.T) {
+	// The loser of a race passes the Exists check and is stopped by the unique index
+	GetDB().Create(&Review{EngagementID: 1, AuthorID: 2, Kind: ReviewOfFarm, Stars: 5})
+	err := GetDB().Create(&Review{EngagementID: 1, AuthorID: 2, Kind: ReviewOfFarm, Stars: 4}).Error
+	if !isUniqueViolation(err) {
+		t.Error("Expected the unique index to refuse a second review got:", err)
+	}
+	if isUniqueViolation(errServer) {
+		t.Error("Expected other errors not to be unique violations")
+	}
+
+	tearDown()
+}
@@ -0,0 +1,125 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Router dispatches requests to a handler by method and path. Patterns are made
+// up of literal segments and :name parameters, for example
+// /farms/:farmid/crops/:cropid. When more than one pattern matches a path the
+// one with the most literal segments wins so /farms/search is matched ahead of
+// /farms/:farmid
+type Router struct {
+	routes []*route
+}
+
+type route struct {
+	segments []string
+	handlers map[string]Handler
+}
+
+// NewRouter returns a router without any routes
+func NewRouter() *Router {
+	return &Router{}
+}
+
+// Handle registers the handler for requests made with the method against paths
+// matching the pattern
+func (router *Router) Handle(method, pattern string, h Handler) {
+	segments := splitPath(pattern)
+	for _, existing := range router.routes {
+		if strings.Join(existing.segments, "/") == strings.Join(segments, "/") {
+			existing.handlers[method] = h
+			return
+		}
+	}
+	router.routes = append(router.routes, &route{segments: segments, handlers: map[string]Handler{method: h}})
+}
+
+// Dispatch calls the handler registered for the request. Paths without a route
+// get a 404 and paths without a handler for the method get a 405 listing the
+// methods that are allowed
+func (router *Router) Dispatch(env *AppContext, w http.ResponseWriter, r *http.Request) {
+	matched, params := router.match(r.URL.Path)
+	if matched == nil {
+		writeError(w, r, notFound(fmt.Sprintf("No route matches %s", r.URL.Path)))
+		return
+	}
+
+	h, ok := matched.handlers[r.Method]
+	if !ok {
+		allowed := []string{}
+		for method := range matched.handlers {
+			allowed = append(allowed, method)
+		}
+		sort.Strings(allowed)
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		writeError(w, r, methodNotAllowed(fmt.Sprintf("%s requests only", strings.Join(allowed, ", "))))
+		return
+	}
+
+	h(env, w, r.WithContext(context.WithValue(r.Context(), pathParamsKey, params)))
+}
+
+func (router *Router) match(path string) (matched *route, params map[string]string) {
+	segments := splitPath(path)
+	mostLiterals := -1
+	for _, candidate := range router.routes {
+		candidateParams, literals, ok := candidate.match(segments)
+		if ok && literals > mostLiterals {
+			matched, params, mostLiterals = candidate, candidateParams, literals
+		}
+	}
+	return
+}
+
+// match reports whether the route matches the path segments returning the
+// parameters it captured and how many literal segments it matched
+func (route *route) match(segments []string) (params map[string]string, literals int, ok bool) {
+	if len(segments) != len(route.segments) {
+		return nil, 0, false
+	}
+
+	params = map[string]string{}
+	for i, segment := range route.segments {
+		switch {
+		case strings.HasPrefix(segment, ":"):
+			params[segment[1:]] = segments[i]
+		case segment == segments[i]:
+			literals++
+		default:
+			return nil, 0, false
+		}
+	}
+	return params, literals, true
+}
+
+func splitPath(path string) []string {
+	trimmed := strings.Trim(path, "/")
+	if trimmed == "" {
+		return []string{}
+	}
+	return strings.Split(trimmed, "/")
+}
+
+// pathParam returns the value captured for the named parameter of the route
+// the request matched
+func pathParam(r *http.Request, name string) string {
+	params, _ := r.Context().Value(pathParamsKey).(map[string]string)
+	return params[name]
+}
+
+// pathID parses the named path parameter as a record id
+func pathID(r *http.Request, name string) (uint, error) {
+	value := pathParam(r, name)
+	id, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid %s %q", name, value)
+	}
+	return uint(id), nil
+}
@@ -0,0 +1,94 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// routeTo returns a handler that writes the route name and path params it was
+// called with so tests can see which route matched
+func routeTo(name string) Handler {
+	return func(env *AppContext, w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s farm=%s crop=%s", name, pathParam(r, "farmid"), pathParam(r, "cropid"))
+	}
+}
+
+func serveTestRoute(router *Router, method, path string) *httptest.ResponseRecorder {
+	r, _ := http.NewRequest(method, path, nil)
+	w := httptest.NewRecorder()
+	AppHandler{&AppContext{}, router.Dispatch}.ServeHTTP(w, r)
+	return w
+}
+
+func TestRouterMatchesMethodsAndPathParams(t *testing.T) {
+	router := NewRouter()
+	router.Handle("GET", "/farms", routeTo("listFarms"))
+	router.Handle("POST", "/farms", routeTo("createFarm"))
+	router.Handle("GET", "/farms/:farmid", routeTo("showFarm"))
+	router.Handle("GET", "/farms/search", routeTo("searchFarms"))
+	router.Handle("PUT", "/farms/:farmid/crops/:cropid", routeTo("updateCrop"))
+
+	var testCases = []struct {
+		method       string
+		path         string
+		expectedBody string
+		reason       string
+	}{
+		{"GET", "/farms", "listFarms farm= crop=", "Collection route"},
+		{"POST", "/farms/", "createFarm farm= crop=", "Trailing slash and second method"},
+		{"GET", "/farms/12", "showFarm farm=12 crop=", "Path parameter"},
+		{"GET", "/farms/search", "searchFarms farm= crop=", "Literal segment wins over parameter"},
+		{"PUT", "/farms/12/crops/3", "updateCrop farm=12 crop=3", "Nested path parameters"},
+	}
+
+	for _, testCase := range testCases {
+		w := serveTestRoute(router, testCase.method, testCase.path)
+		if w.Code != http.StatusOK || w.Body.String() != testCase.expectedBody {
+			t.Errorf("Expected %q but got %d %q reason %s", testCase.expectedBody, w.Code, w.Body.String(), testCase.reason)
+		}
+	}
+}
+
+func TestRouterRejectsUnknownPathsAndMethods(t *testing.T) {
+	router := NewRouter()
+	router.Handle("GET", "/farms/:farmid", routeTo("showFarm"))
+	router.Handle("PUT", "/farms/:farmid", routeTo("updateFarm"))
+	router.Handle("DELETE", "/farms/:farmid", routeTo("deleteFarm"))
+
+	w := serveTestRoute(router, "POST", "/farms/12")
+	if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != "DELETE, GET, PUT" {
+		t.Error("Expected 405 listing the allowed methods got:", w.Code, w.Header())
+	}
+	if apiError := errorResponse(t, w.Result()); apiError.Code != CodeMethodNotAllowed {
+		t.Error("Expected method_not_allowed error got:", apiError)
+	}
+
+	for _, path := range []string{"/farms", "/farms/12/crops", "/nothing/here"} {
+		w := serveTestRoute(router, "GET", path)
+		if w.Code != http.StatusNotFound || w.Header().Get("Content-Type") != "application/json" {
+			t.Errorf("Expected a JSON 404 for %s got %d %s", path, w.Code, w.Body.String())
+		}
+		if apiError := errorResponse(t, w.Result()); apiError.Code != CodeNotFound || apiError.RequestID == "" {
+			t.Errorf("Expected not_found error with a request ID for %s got: %v", path, apiError)
+		}
+	}
+}
+
+func TestPathIDRejectsNonNumericIDs(t *testing.T) {
+	token := signupAndSigninAs(t, "owner@farm.com", "some password", RoleFarmOwner)
+
+	response := doWithToken(t, "GET", farmsURL+"/green-acres", token, url.Values{})
+	if response.StatusCode != http.StatusBadRequest {
+		t.Error("Expected status code 400 but got: ", response.StatusCode)
+	}
+
+	response = doWithToken(t, "PATCH", farmsURL+"/1", token, url.Values{})
+	if response.StatusCode != http.StatusMethodNotAllowed || response.Header.Get("Allow") != "DELETE, GET, PUT" {
+		t.Error("Expected 405 listing the allowed methods got:", response.StatusCode, response.Header)
+	}
+
+	tearDown()
+}
@@ -0,0 +1,199 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/jinzhu/gorm"
+)
+
+// refreshTokenLifetime is how long a refresh token stays valid. Every refresh
+// issues a new one so the window slides forward while the device is in use
+const refreshTokenLifetime = 30 * 24 * time.Hour
+
+// tokenResponse is returned whenever a session is started or refreshed
+type tokenResponse struct {
+	Token         string
+	Expiry        time.Time
+	RefreshToken  string
+	RefreshExpiry time.Time
+}
+
+// startSession issues a new auth and refresh token for the user as part of the
+// given token family. Only digests of the tokens are saved so the response is
+// the one chance to hand them to the client
+func startSession(db *gorm.DB, user User, device, ip, familyID string) (tokens tokenResponse, err error) {
+	if tokens.Token, err = generateToken(); err != nil {
+		return
+	}
+	if tokens.RefreshToken, err = generateToken(); err != nil {
+		return
+	}
+	tokens.Expiry = oneDayFromNow()
+	tokens.RefreshExpiry = time.Now().Add(refreshTokenLifetime)
+
+	session := AuthToken{
+		UserID:        int(user.ID),
+		Token:         hashToken(tokens.Token),
+		Expiry:        tokens.Expiry,
+		DeviceLabel:   device,
+		IP:            ip,
+		LastUsedAt:    time.Now(),
+		RefreshToken:  hashToken(tokens.RefreshToken),
+		RefreshExpiry: tokens.RefreshExpiry,
+		FamilyID:      familyID,
+	}
+	err = db.Create(&session).Error
+	return
+}
+
+// revokeTokenFamily signs out every session descended from the same signin
+func revokeTokenFamily(db *gorm.DB, familyID string) error {
+	return db.Where("family_id = ?", familyID).Delete(&AuthToken{}).Error
+}
+
+// sessionView is what a user sees about one of their sessions. The token itself
+// is never returned
+type sessionView struct {
+	ID          uint
+	DeviceLabel string
+	IP          string
+	CreatedAt   time.Time
+	LastUsedAt  time.Time
+	Expiry      time.Time
+	Current     bool
+}
+
+// ListSessions lists the devices the authenticated user is signed in on
+func ListSessions(env *AppContext, w http.ResponseWriter, r *http.Request) {
+	sessions := []AuthToken{}
+	err := env.DB.Where("user_id = ? AND expiry > ?", env.User.ID, time.Now()).
+		Order("last_used_at desc").
+		Find(&sessions).Error
+	if err != nil {
+		log.WithFields(log.Fields{"action": "ListSessions"}).Error(err)
+		writeError(w, r, errServer)
+		return
+	}
+
+	views := []sessionView{}
+	for _, session := range sessions {
+		views = append(views, sessionView{
+			ID:          session.ID,
+			DeviceLabel: session.DeviceLabel,
+			IP:          session.IP,
+			CreatedAt:   session.CreatedAt,
+			LastUsedAt:  session.LastUsedAt,
+			Expiry:      session.Expiry,
+			Current:     session.ID == env.AuthToken.ID,
+		})
+	}
+	writeJSON(w, http.StatusOK, views)
+}
+
+// RevokeSession signs the authenticated user out of one of their sessions
+func RevokeSession(env *AppContext, w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "sessionid")
+	if err != nil {
+		writeError(w, r, badRequest(err.Error()))
+		return
+	}
+
+	session := AuthToken{}
+	if env.DB.Where("user_id = ?", env.User.ID).First(&session, id).RecordNotFound() {
+		writeError(w, r, notFound("Session not found"))
+		return
+	}
+
+	if err := env.DB.Delete(&session).Error; err != nil {
+		log.WithFields(log.Fields{"action": "RevokeSession"}).Error(err)
+		writeError(w, r, errServer)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type refreshRequest struct {
+	RefreshToken string `json:"refreshtoken" validate:"required"`
+}
+
+// RefreshToken exchanges a refresh token for a new auth and refresh token. The
+// old pair stops working straight away. Presenting a refresh token that has
+// already been exchanged means it has leaked so the whole token family is
+// revoked and the device has to sign in again
+func RefreshToken(env *AppContext, w http.ResponseWriter, r *http.Request) {
+	request := refreshRequest{}
+	if err := decodeRequest(r, &request); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	session := AuthToken{}
+	if env.DB.Unscoped().Where("refresh_token = ?", hashToken(request.RefreshToken)).First(&session).RecordNotFound() {
+		log.WithFields(log.Fields{"action": "RefreshToken"}).Error("Unknown refresh token")
+		writeError(w, r, AuthenticationError{"authorization failed"})
+		return
+	}
+
+	if session.RotatedAt != nil {
+		log.WithFields(log.Fields{
+			"action":    "RefreshToken",
+			"user_id":   session.UserID,
+			"family_id": session.FamilyID,
+		}).Warn("Refresh token reused, revoking token family")
+		if err := revokeTokenFamily(env.DB, session.FamilyID); err != nil {
+			log.WithFields(log.Fields{"action": "RefreshToken"}).Error(err)
+		}
+		writeError(w, r, AuthenticationError{"authorization failed"})
+		return
+	}
+
+	if session.DeletedAt != nil || session.RefreshExpiry.Before(time.Now()) {
+		log.WithFields(log.Fields{"action": "RefreshToken"}).Error("Refresh token revoked or expired")
+		writeError(w, r, AuthenticationError{"authorization failed"})
+		return
+	}
+
+	user := User{}
+	if err := env.DB.First(&user, session.UserID).Error; err != nil || user.IsSuspended() {
+		log.WithFields(log.Fields{"action": "RefreshToken", "user_id": session.UserID}).Error("No usable user for refresh token ", err)
+		writeError(w, r, AuthenticationError{"authorization failed"})
+		return
+	}
+
+	// The old token is rotated and the new session started together so a
+	// failure part way leaves the family able to refresh again
+	tx := env.DB.Begin()
+
+	// Only one request can rotate the token, anyone racing it is treated as reuse
+	now := time.Now()
+	rotated := tx.Model(&AuthToken{}).
+		Where("id = ? AND rotated_at IS NULL", session.ID).
+		UpdateColumns(map[string]interface{}{"rotated_at": now, "deleted_at": now})
+	if rotated.Error != nil {
+		tx.Rollback()
+		log.WithFields(log.Fields{"action": "RefreshToken"}).Error(rotated.Error)
+		writeError(w, r, errServer)
+		return
+	}
+	if rotated.RowsAffected != 1 {
+		tx.Rollback()
+		revokeTokenFamily(env.DB, session.FamilyID)
+		writeError(w, r, AuthenticationError{"authorization failed"})
+		return
+	}
+
+	next, err := startSession(tx, user, session.DeviceLabel, remoteIP(env, r), session.FamilyID)
+	if err == nil {
+		err = tx.Commit().Error
+	} else {
+		tx.Rollback()
+	}
+	if err != nil {
+		log.WithFields(log.Fields{"action": "RefreshToken"}).Error(err)
+		writeError(w, r, errServer)
+		return
+	}
+	writeJSON(w, http.StatusOK, next)
+}
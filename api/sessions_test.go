@@ -0,0 +1,283 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+var sessionsURL string
+
+func init() {
+	sessionsURL = fmt.Sprintf("%s/sessions", server.URL)
+}
+
+func listTestSessions(t *testing.T, token string) (sessions []sessionView) {
+	response := doWithToken(t, "GET", sessionsURL, token, url.Values{})
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		t.Fatal("Expected status code 200 but got: ", response.StatusCode)
+	}
+	json.NewDecoder(response.Body).Decode(&sessions)
+	return
+}
+
+func TestEachSigninStartsItsOwnSession(t *testing.T) {
+	phone := signupAndSignin(t, "worker@farm.com", "some password")
+	laptop := signin(t, "worker@farm.com", "some password", "laptop")
+
+	if phone == laptop {
+		t.Fatal("Expected each device to get its own token")
+	}
+
+	sessions := listTestSessions(t, laptop)
+	if len(sessions) != 2 {
+		t.Fatal("Expected two sessions got:", sessions)
+	}
+
+	current := 0
+	for _, session := range sessions {
+		if session.Current {
+			current++
+			if session.DeviceLabel != "laptop" || session.IP == "" {
+				t.Error("Expected current session to be the laptop got:", session)
+			}
+		}
+	}
+	if current != 1 {
+		t.Error("Expected exactly one current session got:", sessions)
+	}
+
+	tearDown()
+}
+
+func TestClearTokenOnlySignsOutOneDevice(t *testing.T) {
+	phone := signupAndSignin(t, "worker@farm.com", "some password")
+	laptop := signin(t, "worker@farm.com", "some password", "laptop")
+
+	response := doWithToken(t, "POST", clearTokenURL, phone, url.Values{})
+	if response.StatusCode != http.StatusOK {
+		t.Fatal("Expected status code 200 but got: ", response.StatusCode)
+	}
+
+	response = doWithToken(t, "GET", sessionsURL, phone, url.Values{})
+	if response.StatusCode != http.StatusUnauthorized {
+		t.Error("Expected cleared token to be rejected but got: ", response.StatusCode)
+	}
+
+	if sessions := listTestSessions(t, laptop); len(sessions) != 1 {
+		t.Error("Expected laptop to stay signed in got:", sessions)
+	}
+
+	tearDown()
+}
+
+func TestRevokeSession(t *testing.T) {
+	phone := signupAndSignin(t, "worker@farm.com", "some password")
+	laptop := signin(t, "worker@farm.com", "some password", "laptop")
+	stranger := signupAndSignin(t, "stranger@farm.com", "some password")
+
+	var laptopSession sessionView
+	for _, session := range listTestSessions(t, laptop) {
+		if session.Current {
+			laptopSession = session
+		}
+	}
+	laptopURL := fmt.Sprintf("%s/%d", sessionsURL, laptopSession.ID)
+
+	var testCases = []struct {
+		token              string
+		expectedStatusCode int
+		reason             string
+	}{
+		{stranger, http.StatusNotFound, "Users cannot revoke other users sessions"},
+		{phone, http.StatusNoContent, "Phone revokes the laptop session"},
+		{phone, http.StatusNotFound, "Revoked session is gone"},
+	}
+
+	for _, testCase := range testCases {
+		response := doWithToken(t, "DELETE", laptopURL, testCase.token, url.Values{})
+		if response.StatusCode != testCase.expectedStatusCode {
+			t.Errorf("Expected %d but got %d reason %s", testCase.expectedStatusCode, response.StatusCode, testCase.reason)
+		}
+	}
+
+	response := doWithToken(t, "GET", sessionsURL, laptop, url.Values{})
+	if response.StatusCode != http.StatusUnauthorized {
+		t.Error("Expected revoked token to be rejected but got: ", response.StatusCode)
+	}
+
+	tearDown()
+}
+
+func refreshTestToken(refreshToken string) (response *http.Response, tokens tokenResponse, err error) {
+	data := url.Values{}
+	data.Add("refreshtoken", refreshToken)
+	response, err = http.PostForm(fmt.Sprintf("%s/token/refresh", server.URL), data)
+	if err != nil {
+		return
+	}
+	defer response.Body.Close()
+	json.NewDecoder(response.Body).Decode(&tokens)
+	return
+}
+
+func signinWithRefresh(t *testing.T, email, password string) (tokens tokenResponse) {
+	request, _ := http.NewRequest("POST", signinURL, nil)
+	request.SetBasicAuth(email, password)
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	json.NewDecoder(response.Body).Decode(&tokens)
+	if tokens.RefreshToken == "" {
+		t.Fatal("Expected signin to return a refresh token got:", tokens)
+	}
+	return
+}
+
+func TestRefreshTokenRotatesBothTokens(t *testing.T) {
+	signupAndSignin(t, "worker@farm.com", "some password")
+	first := signinWithRefresh(t, "worker@farm.com", "some password")
+
+	response, second, err := refreshTestToken(first.RefreshToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != http.StatusOK {
+		t.Fatal("Expected status code 200 but got: ", response.StatusCode)
+	}
+	if second.Token == first.Token || second.RefreshToken == first.RefreshToken {
+		t.Error("Expected both tokens to be rotated got:", second)
+	}
+	if !second.RefreshExpiry.After(first.RefreshExpiry) {
+		t.Error("Expected refresh expiry to slide forward got:", first.RefreshExpiry, second.RefreshExpiry)
+	}
+
+	response = doWithToken(t, "GET", sessionsURL, first.Token, url.Values{})
+	if response.StatusCode != http.StatusUnauthorized {
+		t.Error("Expected rotated auth token to be rejected but got: ", response.StatusCode)
+	}
+	if sessions := listTestSessions(t, second.Token); len(sessions) != 2 {
+		t.Error("Expected the refreshed session and the first signin got:", sessions)
+	}
+
+	tearDown()
+}
+
+func TestReusedRefreshTokenRevokesTokenFamily(t *testing.T) {
+	signupAndSignin(t, "worker@farm.com", "some password")
+	first := signinWithRefresh(t, "worker@farm.com", "some password")
+	other := signinWithRefresh(t, "worker@farm.com", "some password")
+
+	_, second, _ := refreshTestToken(first.RefreshToken)
+	_, third, _ := refreshTestToken(second.RefreshToken)
+
+	response, _, _ := refreshTestToken(first.RefreshToken)
+	if response.StatusCode != http.StatusUnauthorized {
+		t.Error("Expected reused refresh token to be rejected but got: ", response.StatusCode)
+	}
+
+	response = doWithToken(t, "GET", sessionsURL, third.Token, url.Values{})
+	if response.StatusCode != http.StatusUnauthorized {
+		t.Error("Expected the token family to be revoked but got: ", response.StatusCode)
+	}
+	response, _, _ = refreshTestToken(third.RefreshToken)
+	if response.StatusCode != http.StatusUnauthorized {
+		t.Error("Expected the latest refresh token to be revoked but got: ", response.StatusCode)
+	}
+
+	response = doWithToken(t, "GET", sessionsURL, other.Token, url.Values{})
+	if response.StatusCode != http.StatusOK {
+		t.Error("Expected sessions from other signins to stay valid but got: ", response.StatusCode)
+	}
+
+	tearDown()
+}
+
+func TestRefreshRejectsUnknownToken(t *testing.T) {
+	response, _, err := refreshTestToken("A MADE UP TOKEN")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != http.StatusUnauthorized {
+		t.Error("Expected status code 401 but got: ", response.StatusCode)
+	}
+}
+
+func TestOnlyTokenDigestsAreStored(t *testing.T) {
+	signupAndSignin(t, "worker@farm.com", "some password")
+	tokens := signinWithRefresh(t, "worker@farm.com", "some password")
+
+	count := 0
+	GetDB().Model(&AuthToken{}).Where("token = ? OR refresh_token = ?", tokens.Token, tokens.RefreshToken).Count(&count)
+	if count != 0 {
+		t.Error("Expected plaintext tokens to never be stored")
+	}
+
+	session := AuthToken{}
+	GetDB().Where("token = ?", hashToken(tokens.Token)).First(&session)
+	if session.RefreshToken != hashToken(tokens.RefreshToken) {
+		t.Error("Expected token digests to be stored got:", session)
+	}
+
+	tearDown()
+}
+
+func TestTouchSessionOnlyWritesStaleSessions(t *testing.T) {
+	stale := time.Now().Add(-time.Hour)
+	session := AuthToken{UserID: 1, Token: hashToken("touch"), IP: "10.0.0.1", LastUsedAt: stale}
+	GetDB().Create(&session)
+
+	saved := func() AuthToken {
+		found := AuthToken{}
+		GetDB().First(&found, session.ID)
+		return found
+	}
+
+	recent := session
+	recent.LastUsedAt = time.Now().Add(-10 * time.Second)
+	touchSession(GetDB(), &recent, "10.0.0.1")
+	if !saved().LastUsedAt.Before(time.Now().Add(-time.Minute)) {
+		t.Error("Expected a recently used session not to be written again")
+	}
+
+	touchSession(GetDB(), &session, "10.0.0.1")
+	if saved().LastUsedAt.Before(time.Now().Add(-time.Minute)) {
+		t.Error("Expected a stale session to be written")
+	}
+
+	moved := saved()
+	touchSession(GetDB(), &moved, "10.0.0.2")
+	if saved().IP != "10.0.0.2" {
+		t.Error("Expected a session used from a new address to be written")
+	}
+
+	tearDown()
+}
+
+func TestRefreshForAMissingUserLeavesTheTokenUnrotated(t *testing.T) {
+	signupAndSignin(t, "worker@farm.com", "some password")
+	tokens := signinWithRefresh(t, "worker@farm.com", "some password")
+	GetDB().Exec("DELETE FROM users WHERE primary_email = ?", "worker@farm.com")
+
+	response, _, err := refreshTestToken(tokens.RefreshToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != http.StatusUnauthorized {
+		t.Error("Expected status code 401 but got: ", response.StatusCode)
+	}
+
+	session := AuthToken{}
+	GetDB().Unscoped().Where("refresh_token = ?", hashToken(tokens.RefreshToken)).First(&session)
+	if session.RotatedAt != nil || session.DeletedAt != nil {
+		t.Error("Expected the refresh token to be left as it was got:", session)
+	}
+
+	tearDown()
+}
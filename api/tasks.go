@@ -0,0 +1,181 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+type taskRequest struct {
+	Title       *string    `json:"title"`
+	Description *string    `json:"description"`
+	AssigneeID  optionalID `json:"assigneeid"`
+	Status      *string    `json:"status"`
+}
+
+func (request taskRequest) validate() (errs fieldErrors) {
+	if request.Title != nil && *request.Title == "" {
+		errs.add("title", "cannot be blank")
+	}
+	if request.AssigneeID.Err != nil {
+		errs.add("assigneeid", request.AssigneeID.Err.Error())
+	}
+	return
+}
+
+// edits reports whether the request changes anything other than the status
+func (request taskRequest) edits() bool {
+	return request.Title != nil || request.Description != nil || request.AssigneeID.Present
+}
+
+// AssignedTasks lists the tasks assigned to the authenticated user optionally
+// filtered by status
+func AssignedTasks(env *AppContext, w http.ResponseWriter, r *http.Request) {
+	query := env.DB.Where(Task{AssigneeID: env.User.ID})
+	if status := r.URL.Query().Get("status"); status != "" {
+		query = query.Where(Task{Status: status})
+	}
+
+	tasks := []Task{}
+	if err := query.Order("id").Find(&tasks).Error; err != nil {
+		log.WithFields(log.Fields{"action": "AssignedTasks"}).Error(err)
+		writeError(w, r, errServer)
+		return
+	}
+	writeJSON(w, http.StatusOK, tasks)
+}
+
+func listFarmTasks(env *AppContext, w http.ResponseWriter, r *http.Request) {
+	farm, ok := findOwnedFarm(env, w, r)
+	if !ok {
+		return
+	}
+
+	tasks := []Task{}
+	if err := env.DB.Where(Task{FarmID: farm.ID}).Order("id").Find(&tasks).Error; err != nil {
+		log.WithFields(log.Fields{"action": "listFarmTasks"}).Error(err)
+		writeError(w, r, errServer)
+		return
+	}
+	writeJSON(w, http.StatusOK, tasks)
+}
+
+// findAssignee looks up the user a task is being assigned to
+func findAssignee(env *AppContext, id uint) (assignee User, err error) {
+	if env.DB.First(&assignee, id).RecordNotFound() {
+		return assignee, fmt.Errorf("Assignee %d not found", id)
+	}
+	return assignee, nil
+}
+
+func createTask(env *AppContext, w http.ResponseWriter, r *http.Request) {
+	farm, ok := findOwnedFarm(env, w, r)
+	if !ok {
+		return
+	}
+
+	request := taskRequest{}
+	err := decodeRequest(r, &request)
+	if err == nil && request.Title == nil {
+		err = ValidationError{Fields: []FieldError{{Field: "title", Message: "is required"}}}
+	}
+	if err != nil {
+		log.WithFields(log.Fields{"action": "createTask"}).Error(err)
+		writeError(w, r, err)
+		return
+	}
+
+	task := Task{FarmID: farm.ID, Title: *request.Title, Status: TaskOpen}
+	if request.Description != nil {
+		task.Description = *request.Description
+	}
+
+	if request.AssigneeID.ID != 0 {
+		assignee, err := findAssignee(env, request.AssigneeID.ID)
+		if err != nil {
+			writeError(w, r, badRequest(err.Error()))
+			return
+		}
+		task.AssigneeID = assignee.ID
+	}
+
+	if err := env.DB.Create(&task).Error; err != nil {
+		log.WithFields(log.Fields{"action": "createTask"}).Error(err)
+		writeError(w, r, errServer)
+		return
+	}
+	writeJSON(w, http.StatusCreated, task)
+}
+
+// updateTask lets the farm owner edit and reassign a task. Both the owner and
+// the assigned worker can move the task on to its next status
+func updateTask(env *AppContext, w http.ResponseWriter, r *http.Request) {
+	farm, ok := findFarm(env, w, r)
+	if !ok {
+		return
+	}
+
+	id, err := pathID(r, "taskid")
+	if err != nil {
+		writeError(w, r, badRequest(err.Error()))
+		return
+	}
+
+	task := Task{}
+	if env.DB.Where(Task{FarmID: farm.ID}).First(&task, id).RecordNotFound() {
+		writeError(w, r, notFound("Task not found"))
+		return
+	}
+
+	isOwner := farm.IsOwnedBy(env.User)
+	if !isOwner && task.AssigneeID != env.User.ID {
+		writeError(w, r, forbidden("Only the farm owner or assignee can update a task"))
+		return
+	}
+
+	request := taskRequest{}
+	if err := decodeRequest(r, &request); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	if request.edits() && !isOwner {
+		writeError(w, r, forbidden("Only the farm owner can edit or reassign a task"))
+		return
+	}
+
+	if request.Title != nil {
+		task.Title = *request.Title
+	}
+	if request.Description != nil {
+		task.Description = *request.Description
+	}
+	switch {
+	case request.AssigneeID.Present && request.AssigneeID.ID == 0:
+		task.AssigneeID = 0
+	case request.AssigneeID.Present:
+		assignee, err := findAssignee(env, request.AssigneeID.ID)
+		if err != nil {
+			writeError(w, r, badRequest(err.Error()))
+			return
+		}
+		task.AssigneeID = assignee.ID
+	}
+
+	if request.Status != nil && *request.Status != task.Status {
+		if err := task.Transition(*request.Status, time.Now()); err != nil {
+			log.WithFields(log.Fields{"action": "updateTask"}).Error(err)
+			writeError(w, r, err)
+			return
+		}
+	}
+
+	if err := env.DB.Save(&task).Error; err != nil {
+		log.WithFields(log.Fields{"action": "updateTask"}).Error(err)
+		writeError(w, r, errServer)
+		return
+	}
+	writeJSON(w, http.StatusOK, task)
+}
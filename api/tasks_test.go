@@ -0,0 +1,126 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestWorkerListsAssignedTasks(t *testing.T) {
+	ownerToken := signupAndSigninAs(t, "owner@farm.com", "some password", RoleFarmOwner)
+	workerToken := signupAndSignin(t, "worker@farm.com", "some password")
+	farm := Farm{}
+	postJSON(t, ownerToken, farmsURL, map[string]interface{}{"name": "Green Acres"}, &farm)
+	expected := Task{}
+	postJSON(t, ownerToken, fmt.Sprintf("%s/%d/tasks", farmsURL, farm.ID), map[string]interface{}{"title": "Pick strawberries", "assigneeid": userIDByEmail("worker@farm.com")}, &expected)
+
+	if expected.Status != TaskOpen {
+		t.Errorf("Expected new task to be %s but got %s", TaskOpen, expected.Status)
+	}
+
+	response := doWithToken(t, "GET", fmt.Sprintf("%s/tasks", server.URL), workerToken, url.Values{})
+	tasks := []Task{}
+	json.NewDecoder(response.Body).Decode(&tasks)
+	if len(tasks) != 1 || tasks[0].ID != expected.ID {
+		t.Error("Expected to list the assigned task got:", tasks)
+	}
+
+	response = doWithToken(t, "GET", fmt.Sprintf("%s/tasks", server.URL), ownerToken, url.Values{})
+	tasks = []Task{}
+	json.NewDecoder(response.Body).Decode(&tasks)
+	if len(tasks) != 0 {
+		t.Error("Expected owner to have no assigned tasks got:", tasks)
+	}
+
+	tearDown()
+}
+
+func TestAssigneeMovesTaskThroughStatuses(t *testing.T) {
+	ownerToken := signupAndSigninAs(t, "owner@farm.com", "some password", RoleFarmOwner)
+	workerToken := signupAndSignin(t, "worker@farm.com", "some password")
+	strangerToken := signupAndSignin(t, "stranger@farm.com", "some password")
+	farm := Farm{}
+	postJSON(t, ownerToken, farmsURL, map[string]interface{}{"name": "Green Acres"}, &farm)
+	task := Task{}
+	postJSON(t, ownerToken, fmt.Sprintf("%s/%d/tasks", farmsURL, farm.ID), map[string]interface{}{"title": "Pick strawberries", "assigneeid": userIDByEmail("worker@farm.com")}, &task)
+	taskURL := fmt.Sprintf("%s/%d/tasks/%d", farmsURL, farm.ID, task.ID)
+
+	var testCases = []struct {
+		token              string
+		field              string
+		value              string
+		expectedStatusCode int
+		reason             string
+	}{
+		{strangerToken, "status", TaskInProgress, http.StatusForbidden, "Only the assignee or owner can update"},
+		{workerToken, "title", "Eat strawberries", http.StatusForbidden, "Only the owner can edit a task"},
+		{workerToken, "status", TaskDone, http.StatusConflict, "Task must be started first"},
+		{workerToken, "status", TaskInProgress, http.StatusOK, "Assignee starts the task"},
+		{workerToken, "status", TaskDone, http.StatusOK, "Assignee finishes the task"},
+		{workerToken, "status", TaskOpen, http.StatusConflict, "Finished tasks stay finished"},
+	}
+
+	for _, testCase := range testCases {
+		data := url.Values{}
+		data.Add(testCase.field, testCase.value)
+		response := doWithToken(t, "PUT", taskURL, testCase.token, data)
+		if response.StatusCode != testCase.expectedStatusCode {
+			t.Errorf("Expected %d but got %d reason %s", testCase.expectedStatusCode, response.StatusCode, testCase.reason)
+		}
+	}
+
+	result := Task{}
+	GetDB().First(&result, task.ID)
+	if result.Status != TaskDone || result.StartedAt == nil || result.CompletedAt == nil {
+		t.Error("Expected finished task with timestamps got:", result)
+	}
+
+	tearDown()
+}
+
+func TestOwnerEditsAndUnassignsTasks(t *testing.T) {
+	ownerToken := signupAndSigninAs(t, "owner@farm.com", "some password", RoleFarmOwner)
+	signupAndSignin(t, "worker@farm.com", "some password")
+	farm := Farm{}
+	postJSON(t, ownerToken, farmsURL, map[string]interface{}{"name": "Green Acres"}, &farm)
+	task := Task{}
+	postJSON(t, ownerToken, fmt.Sprintf("%s/%d/tasks", farmsURL, farm.ID), map[string]interface{}{"title": "Pick strawberries", "assigneeid": userIDByEmail("worker@farm.com")}, &task)
+	taskURL := fmt.Sprintf("%s/%d/tasks/%d", farmsURL, farm.ID, task.ID)
+
+	putJSON := func(body string) *http.Response {
+		request, _ := http.NewRequest("PUT", taskURL, strings.NewReader(body))
+		request.Header.Set("Content-Type", "application/json")
+		request.Header.Set("Authorization", "Bearer "+ownerToken)
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return response
+	}
+	assignee := func() uint {
+		result := Task{}
+		GetDB().First(&result, task.ID)
+		return result.AssigneeID
+	}
+
+	if response := putJSON(`{"title": ""}`); response.StatusCode != http.StatusBadRequest {
+		t.Error("Expected a blank title to be rejected but got: ", response.StatusCode)
+	}
+
+	if response := putJSON(`{"assigneeid": null}`); response.StatusCode != http.StatusOK || assignee() != 0 {
+		t.Error("Expected a null assignee to unassign the task but got: ", response.StatusCode, assignee())
+	}
+
+	data := url.Values{}
+	data.Add("assigneeid", fmt.Sprint(userIDByEmail("worker@farm.com")))
+	doWithToken(t, "PUT", taskURL, ownerToken, data)
+	data.Set("assigneeid", "0")
+	if response := doWithToken(t, "PUT", taskURL, ownerToken, data); response.StatusCode != http.StatusOK || assignee() != 0 {
+		t.Error("Expected assignee 0 to unassign the task but got: ", response.StatusCode, assignee())
+	}
+
+	tearDown()
+}
@@ -0,0 +1,99 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// TOTP codes follow RFC 6238 with the defaults every authenticator app supports
+const (
+	totpIssuer      = "chamba"
+	totpDigits      = 6
+	totpPeriod      = 30 * time.Second
+	totpSecretBytes = 20
+	// totpSkew is how many periods either side of now a code is accepted for so
+	// a phone with a slightly wrong clock still works
+	totpSkew = 1
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// generateTOTPSecret returns a new base32 encoded secret for an authenticator
+func generateTOTPSecret() (string, error) {
+	b := make([]byte, totpSecretBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(b), nil
+}
+
+// totpProvisioningURI is the otpauth URI authenticator apps read from a QR code
+func totpProvisioningURI(secret, account string) string {
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", totpIssuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(totpDigits))
+	query.Set("period", fmt.Sprint(int(totpPeriod.Seconds())))
+	return (&url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + totpIssuer + ":" + account,
+		RawQuery: query.Encode(),
+	}).String()
+}
+
+// totpStep is the number of periods since the unix epoch
+func totpStep(t time.Time) int64 {
+	return t.Unix() / int64(totpPeriod.Seconds())
+}
+
+// hotp is the RFC 4226 code for the key at the counter
+func hotp(key []byte, counter int64, digits int) string {
+	message := make([]byte, 8)
+	binary.BigEndian.PutUint64(message, uint64(counter))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(message)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	modulo := uint32(1)
+	for i := 0; i < digits; i++ {
+		modulo *= 10
+	}
+	return fmt.Sprintf("%0*d", digits, code%modulo)
+}
+
+// validateTOTP checks the code against the secret at now. Codes from a step at
+// or before lastStep have already been used and are refused so a code cannot
+// be replayed. The step the code matched is returned so it can be recorded
+func validateTOTP(secret, code string, now time.Time, lastStep int64) (step int64, ok bool) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil || len(key) == 0 {
+		return 0, false
+	}
+	code = strings.TrimSpace(code)
+	if len(code) != totpDigits {
+		return 0, false
+	}
+
+	current := totpStep(now)
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(hotp(key, step, totpDigits)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,71 @@
+package api
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestTOTPMatchesRFC6238(t *testing.T) {
+	key := []byte("12345678901234567890")
+
+	var testCases = []struct {
+		unix     int64
+		expected string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+	}
+
+	for _, testCase := range testCases {
+		if code := hotp(key, totpStep(time.Unix(testCase.unix, 0)), 8); code != testCase.expected {
+			t.Errorf("Expected %s at %d but got %s", testCase.expected, testCase.unix, code)
+		}
+	}
+}
+
+func TestValidateTOTP(t *testing.T) {
+	key := []byte("12345678901234567890")
+	secret := totpEncoding.EncodeToString(key)
+	now := time.Unix(1234567890, 0)
+	current := totpStep(now)
+
+	var testCases = []struct {
+		code     string
+		lastStep int64
+		expected bool
+		reason   string
+	}{
+		{hotp(key, current, totpDigits), 0, true, "Current code"},
+		{hotp(key, current-1, totpDigits), 0, true, "Previous code allowing for clock drift"},
+		{hotp(key, current+1, totpDigits), 0, true, "Next code allowing for clock drift"},
+		{hotp(key, current-2, totpDigits), 0, false, "Too old"},
+		{hotp(key, current, totpDigits), current, false, "Already used"},
+		{"12345", 0, false, "Too short"},
+	}
+
+	for _, testCase := range testCases {
+		if _, ok := validateTOTP(secret, testCase.code, now, testCase.lastStep); ok != testCase.expected {
+			t.Errorf("Expected %v reason %s", testCase.expected, testCase.reason)
+		}
+	}
+
+	if _, ok := validateTOTP("", hotp([]byte{}, current, totpDigits), now, 0); ok {
+		t.Error("Expected an empty secret to never validate")
+	}
+}
+
+func TestTOTPProvisioningURI(t *testing.T) {
+	uri, err := url.Parse(totpProvisioningURI("JBSWY3DPEHPK3PXP", "mark@twain.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uri.Scheme != "otpauth" || uri.Host != "totp" || uri.Path != "/chamba:mark@twain.com" {
+		t.Error("Expected an otpauth totp URI got:", uri)
+	}
+	if query := uri.Query(); query.Get("secret") != "JBSWY3DPEHPK3PXP" || query.Get("issuer") != "chamba" {
+		t.Error("Expected the secret and issuer in the URI got:", query)
+	}
+}
@@ -0,0 +1,405 @@
+package api
+
+import (
+	"crypto/rand"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/dklassen/chamba/encrypt"
+	"github.com/jinzhu/gorm"
+)
+
+// A two factor challenge has to be answered within twoFactorChallengeLifetime
+// and is thrown away after twoFactorChallengeAttempts wrong codes
+const (
+	twoFactorChallengeLifetime = 5 * time.Minute
+	twoFactorChallengeAttempts = 5
+)
+
+// recoveryCodeCount is how many recovery codes a user is given when they enable
+// two factor authentication
+const recoveryCodeCount = 10
+
+type twoFactorCodeRequest struct {
+	Code string `json:"code" validate:"required"`
+}
+
+type twoFactorSigninRequest struct {
+	Challenge string `json:"challenge" validate:"required"`
+	Code      string `json:"code" validate:"required"`
+}
+
+// twoFactorEnrollment is the secret to load into an authenticator app, either
+// typed in or scanned from a QR code of the ProvisioningURI
+type twoFactorEnrollment struct {
+	Secret          string
+	ProvisioningURI string
+}
+
+// recoveryCodesResponse hands the user their recovery codes. Only digests are
+// kept so this is the one chance to see them
+type recoveryCodesResponse struct {
+	RecoveryCodes []string
+}
+
+// challengeResponse is returned by Signin instead of a token when the user has
+// two factor authentication enabled
+type challengeResponse struct {
+	TwoFactorRequired bool
+	Challenge         string
+	ChallengeExpiry   time.Time
+}
+
+func (challenge *TwoFactorChallenge) isUsable() bool {
+	return challenge.UsedAt == nil && challenge.Expiry.After(time.Now()) && challenge.Failures < twoFactorChallengeAttempts
+}
+
+// generateRecoveryCode returns a code like 7kq2m-x9c4t that is easy to write down
+func generateRecoveryCode() (string, error) {
+	b := make([]byte, 7)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	code := strings.ToLower(totpEncoding.EncodeToString(b))[:10]
+	return code[:5] + "-" + code[5:], nil
+}
+
+// normalizeRecoveryCode lets users type recovery codes in any case with or
+// without the dash
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+// replaceRecoveryCodes throws away the user's recovery codes and issues new ones
+func replaceRecoveryCodes(tx *gorm.DB, user User) (codes []string, err error) {
+	if err = tx.Where("user_id = ?", user.ID).Delete(&RecoveryCode{}).Error; err != nil {
+		return
+	}
+	for i := 0; i < recoveryCodeCount; i++ {
+		code, err := generateRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		if err := tx.Create(&RecoveryCode{UserID: user.ID, Code: hashToken(normalizeRecoveryCode(code))}).Error; err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+	return
+}
+
+// newTOTPKey loads the key TOTP secrets are encrypted with from
+// TOTP_ENCRYPTION_KEY. AES needs a key of 16, 24 or 32 bytes, without one two
+// factor enrollment is turned off
+func newTOTPKey() string {
+	key := os.Getenv("TOTP_ENCRYPTION_KEY")
+	switch len(key) {
+	case 0:
+	case 16, 24, 32:
+		return key
+	default:
+		log.WithFields(log.Fields{"length": len(key)}).Error("TOTP_ENCRYPTION_KEY must be 16, 24 or 32 bytes, two factor enrollment is turned off")
+	}
+	return ""
+}
+
+// decryptTOTPSecret returns the user's TOTP secret in the clear
+func decryptTOTPSecret(key string, user User) (string, error) {
+	if user.TOTPSecret == "" {
+		return "", errors.New("User has not enrolled in two factor authentication")
+	}
+	return encrypt.AESDecrypt(key, user.TOTPSecret)
+}
+
+// acceptTOTP checks a code from the user's authenticator and records the step
+// it was for. The update only succeeds for a later step than the last one so
+// the same code sent twice at once is only accepted once
+func acceptTOTP(db *gorm.DB, key string, user User, code string) (bool, error) {
+	secret, err := decryptTOTPSecret(key, user)
+	if err != nil {
+		return false, err
+	}
+	step, ok := validateTOTP(secret, code, time.Now(), user.TOTPLastStep)
+	if !ok {
+		return false, nil
+	}
+
+	query := db.Model(&User{}).Where("id = ? AND totp_last_step < ?", user.ID, step).UpdateColumn("totp_last_step", step)
+	return query.RowsAffected == 1, query.Error
+}
+
+// acceptRecoveryCode uses up one of the user's recovery codes
+func acceptRecoveryCode(db *gorm.DB, user User, code string) (bool, error) {
+	query := db.Model(&RecoveryCode{}).
+		Where("user_id = ? AND code = ? AND used_at IS NULL", user.ID, hashToken(normalizeRecoveryCode(code))).
+		UpdateColumn("used_at", time.Now())
+	return query.RowsAffected == 1, query.Error
+}
+
+// verifySecondFactor accepts either a code from the user's authenticator or one
+// of their recovery codes. Wrong codes count as failed signins for the user so
+// guessing codes is locked out just like guessing passwords. When the user is
+// locked out the time it ends is returned and the code is not checked
+func verifySecondFactor(env *AppContext, user User, code string, ip string) (ok bool, lockedUntil time.Time, err error) {
+	keys := signinKeys(env, user.PrimaryEmail, ip)
+	lockedUntil, err = lockedOutUntil(env.Attempts, keys)
+	if err != nil || lockedUntil.After(time.Now()) {
+		return false, lockedUntil, err
+	}
+
+	ok, err = acceptTOTP(env.DB, env.TOTPKey, user, code)
+	if !ok && err == nil {
+		ok, err = acceptRecoveryCode(env.DB, user, code)
+		if ok {
+			recordAuditEvent(env.DB, AuditEvent{
+				Action: AuditRecoveryCodeUsed,
+				UserID: user.ID,
+				IP:     ip,
+				Detail: "Signed in with a recovery code",
+			})
+		}
+	}
+	if err != nil {
+		return false, time.Time{}, err
+	}
+
+	if !ok {
+		until, err := recordSigninFailure(env, keys, user.PrimaryEmail, ip)
+		if err != nil {
+			log.WithFields(log.Fields{"action": "verifySecondFactor"}).Error(err)
+		}
+		return false, until, nil
+	}
+	if err := env.Attempts.Reset(keys[0].key); err != nil {
+		log.WithFields(log.Fields{"action": "verifySecondFactor"}).Error(err)
+	}
+	return true, time.Time{}, nil
+}
+
+// issueTwoFactorChallenge starts the second step of signing in the user
+func issueTwoFactorChallenge(db *gorm.DB, user User, device string) (response challengeResponse, err error) {
+	token, err := generateToken()
+	if err != nil {
+		return
+	}
+
+	challenge := TwoFactorChallenge{
+		UserID: user.ID,
+		Token:  hashToken(token),
+		Device: device,
+		Expiry: time.Now().Add(twoFactorChallengeLifetime),
+	}
+	if err = db.Create(&challenge).Error; err != nil {
+		return
+	}
+	return challengeResponse{TwoFactorRequired: true, Challenge: token, ChallengeExpiry: challenge.Expiry}, nil
+}
+
+// EnrollTwoFactor generates a new TOTP secret for the authenticated user. Two
+// factor authentication is not enabled until a code from it is confirmed
+func EnrollTwoFactor(env *AppContext, w http.ResponseWriter, r *http.Request) {
+	if env.TOTPKey == "" {
+		writeError(w, r, notFound("Two factor authentication is not configured"))
+		return
+	}
+	if env.User.HasTwoFactor() {
+		writeError(w, r, conflict("Two factor authentication is already enabled"))
+		return
+	}
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		log.WithFields(log.Fields{"action": "EnrollTwoFactor"}).Error(err)
+		writeError(w, r, errServer)
+		return
+	}
+	encrypted, err := encrypt.AESEncrypt(env.TOTPKey, secret)
+	if err == nil {
+		err = env.DB.Model(&env.User).UpdateColumn("totp_secret", encrypted).Error
+	}
+	if err != nil {
+		log.WithFields(log.Fields{"action": "EnrollTwoFactor"}).Error(err)
+		writeError(w, r, errServer)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, twoFactorEnrollment{
+		Secret:          secret,
+		ProvisioningURI: totpProvisioningURI(secret, env.User.PrimaryEmail),
+	})
+}
+
+// ConfirmTwoFactor enables two factor authentication once the user proves their
+// authenticator is set up by sending a code from it. Returns their recovery codes
+func ConfirmTwoFactor(env *AppContext, w http.ResponseWriter, r *http.Request) {
+	request := twoFactorCodeRequest{}
+	if err := decodeRequest(r, &request); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	user := env.User
+	if user.HasTwoFactor() {
+		writeError(w, r, conflict("Two factor authentication is already enabled"))
+		return
+	}
+	if user.TOTPSecret == "" {
+		writeError(w, r, badRequest("Enroll in two factor authentication before confirming it"))
+		return
+	}
+
+	ok, err := acceptTOTP(env.DB, env.TOTPKey, user, request.Code)
+	if err != nil {
+		log.WithFields(log.Fields{"action": "ConfirmTwoFactor"}).Error(err)
+		writeError(w, r, errServer)
+		return
+	}
+	if !ok {
+		writeError(w, r, ValidationError{Fields: []FieldError{{"code", "does not match the authenticator"}}})
+		return
+	}
+
+	tx := env.DB.Begin()
+	err = tx.Model(&user).UpdateColumn("totp_enabled_at", time.Now()).Error
+	var codes []string
+	if err == nil {
+		codes, err = replaceRecoveryCodes(tx, user)
+	}
+	if err != nil {
+		tx.Rollback()
+		log.WithFields(log.Fields{"action": "ConfirmTwoFactor"}).Error(err)
+		writeError(w, r, errServer)
+		return
+	}
+	tx.Commit()
+
+	recordAuditEvent(env.DB, AuditEvent{
+		Action: AuditTwoFactorEnabled,
+		UserID: user.ID,
+		IP:     remoteIP(env, r),
+		Detail: "Enabled two factor authentication",
+	})
+	writeJSON(w, http.StatusOK, recoveryCodesResponse{RecoveryCodes: codes})
+}
+
+// DisableTwoFactor turns two factor authentication off. A code from the
+// authenticator or a recovery code is needed so a stolen session cannot do it
+func DisableTwoFactor(env *AppContext, w http.ResponseWriter, r *http.Request) {
+	request := twoFactorCodeRequest{}
+	if err := decodeRequest(r, &request); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	user := env.User
+	if !user.HasTwoFactor() {
+		writeError(w, r, conflict("Two factor authentication is not enabled"))
+		return
+	}
+
+	ok, lockedUntil, err := verifySecondFactor(env, user, request.Code, remoteIP(env, r))
+	if err != nil {
+		log.WithFields(log.Fields{"action": "DisableTwoFactor"}).Error(err)
+		writeError(w, r, errServer)
+		return
+	}
+	if lockedUntil.After(time.Now()) {
+		writeLockedOut(w, r, lockedUntil)
+		return
+	}
+	if !ok {
+		writeError(w, r, forbidden("Invalid two factor code"))
+		return
+	}
+
+	tx := env.DB.Begin()
+	err = tx.Model(&user).UpdateColumns(map[string]interface{}{
+		"totp_secret":     "",
+		"totp_enabled_at": nil,
+		"totp_last_step":  0,
+	}).Error
+	if err == nil {
+		err = tx.Where("user_id = ?", user.ID).Delete(&RecoveryCode{}).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		log.WithFields(log.Fields{"action": "DisableTwoFactor"}).Error(err)
+		writeError(w, r, errServer)
+		return
+	}
+	tx.Commit()
+
+	recordAuditEvent(env.DB, AuditEvent{
+		Action: AuditTwoFactorDisabled,
+		UserID: user.ID,
+		IP:     remoteIP(env, r),
+		Detail: "Disabled two factor authentication",
+	})
+	w.Header().Set("Content-Type", "application/text")
+	w.Write([]byte("Two factor authentication disabled"))
+}
+
+// CompleteTwoFactorSignin exchanges the challenge handed out by Signin and a
+// code from the user's authenticator, or a recovery code, for an auth token
+func CompleteTwoFactorSignin(env *AppContext, w http.ResponseWriter, r *http.Request) {
+	request := twoFactorSigninRequest{}
+	if err := decodeRequest(r, &request); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	challenge := TwoFactorChallenge{}
+	env.DB.Where(TwoFactorChallenge{Token: hashToken(request.Challenge)}).First(&challenge)
+	if challenge.ID == 0 || !challenge.isUsable() {
+		log.WithFields(log.Fields{"action": "CompleteTwoFactorSignin"}).Error("Invalid or expired two factor challenge")
+		writeError(w, r, AuthenticationError{"Invalid or expired two factor challenge"})
+		return
+	}
+
+	user := User{}
+	if env.DB.First(&user, challenge.UserID).RecordNotFound() || user.IsSuspended() || !user.HasTwoFactor() {
+		writeError(w, r, AuthenticationError{"Invalid or expired two factor challenge"})
+		return
+	}
+
+	ok, lockedUntil, err := verifySecondFactor(env, user, request.Code, remoteIP(env, r))
+	if err != nil {
+		log.WithFields(log.Fields{"action": "CompleteTwoFactorSignin"}).Error(err)
+		writeError(w, r, errServer)
+		return
+	}
+	if lockedUntil.After(time.Now()) {
+		writeLockedOut(w, r, lockedUntil)
+		return
+	}
+	if !ok {
+		log.WithFields(log.Fields{"action": "CompleteTwoFactorSignin", "user_id": user.ID}).Error("Invalid two factor code")
+		env.DB.Model(&challenge).UpdateColumn("failures", gorm.Expr("failures + 1"))
+		writeError(w, r, AuthenticationError{"Invalid two factor code"})
+		return
+	}
+
+	// Only one request can use the challenge even if several arrive at once
+	if env.DB.Model(&TwoFactorChallenge{}).Where("id = ? AND used_at IS NULL", challenge.ID).UpdateColumn("used_at", time.Now()).RowsAffected != 1 {
+		writeError(w, r, AuthenticationError{"Invalid or expired two factor challenge"})
+		return
+	}
+
+	familyID, err := generateToken()
+	if err != nil {
+		log.WithFields(log.Fields{"action": "CompleteTwoFactorSignin"}).Error(err)
+		writeError(w, r, errServer)
+		return
+	}
+	tokens, err := startSession(env.DB, user, challenge.Device, remoteIP(env, r), familyID)
+	if err != nil {
+		log.WithFields(log.Fields{"action": "CompleteTwoFactorSignin"}).Error(err)
+		writeError(w, r, errServer)
+		return
+	}
+	writeJSON(w, http.StatusOK, tokens)
+}
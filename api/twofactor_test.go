@@ -0,0 +1,277 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dklassen/chamba/encrypt"
+)
+
+var twoFactorURL string
+
+func init() {
+	twoFactorURL = fmt.Sprintf("%s/twofactor", server.URL)
+}
+
+// codeAt is the code an authenticator loaded with the secret shows at the time
+func codeAt(t *testing.T, secret string, at time.Time) string {
+	return codeForStep(t, secret, totpStep(at))
+}
+
+func codeForStep(t *testing.T, secret string, step int64) string {
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hotp(key, step, totpDigits)
+}
+
+// enableTestTwoFactor enrolls the signed in user and confirms it returning the
+// TOTP secret and recovery codes
+func enableTestTwoFactor(t *testing.T, token string) (secret string, recoveryCodes []string) {
+	response := doWithToken(t, "POST", twoFactorURL, token, url.Values{})
+	if response.StatusCode != http.StatusOK {
+		t.Fatal("Expected status code 200 but got: ", response.StatusCode)
+	}
+	enrollment := twoFactorEnrollment{}
+	json.NewDecoder(response.Body).Decode(&enrollment)
+	if !strings.HasPrefix(enrollment.ProvisioningURI, "otpauth://totp/") {
+		t.Error("Expected a provisioning URI got:", enrollment.ProvisioningURI)
+	}
+
+	response = doWithToken(t, "POST", twoFactorURL+"/confirm", token, url.Values{"code": {codeAt(t, enrollment.Secret, time.Now())}})
+	if response.StatusCode != http.StatusOK {
+		t.Fatal("Expected status code 200 but got: ", response.StatusCode)
+	}
+	codes := recoveryCodesResponse{}
+	json.NewDecoder(response.Body).Decode(&codes)
+	if len(codes.RecoveryCodes) != recoveryCodeCount {
+		t.Fatal("Expected recovery codes got:", codes)
+	}
+	return enrollment.Secret, codes.RecoveryCodes
+}
+
+// signinForChallenge signs in with a password expecting to be challenged
+func signinForChallenge(t *testing.T, email, password string) string {
+	request, _ := http.NewRequest("POST", signinURL, nil)
+	request.SetBasicAuth(email, password)
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	challenge := challengeResponse{}
+	json.NewDecoder(response.Body).Decode(&challenge)
+	if response.StatusCode != http.StatusOK || !challenge.TwoFactorRequired || challenge.Challenge == "" {
+		t.Fatal("Expected a two factor challenge got:", response.StatusCode, challenge)
+	}
+	return challenge.Challenge
+}
+
+func completeTestSignin(t *testing.T, challenge, code string) *http.Response {
+	data := url.Values{"challenge": {challenge}, "code": {code}}
+	request, _ := http.NewRequest("POST", signinURL+"/twofactor", strings.NewReader(data.Encode()))
+	request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
+
+func TestTwoFactorSecretIsStoredEncrypted(t *testing.T) {
+	token := signupAndSignin(t, "mark@twain.com", "Huckelberry")
+	secret, _ := enableTestTwoFactor(t, token)
+
+	user := User{}
+	GetDB().First(&user, userIDByEmail("mark@twain.com"))
+	if user.TOTPSecret == secret || !user.HasTwoFactor() {
+		t.Error("Expected two factor to be enabled with an encrypted secret got:", user.TOTPSecret)
+	}
+	if decrypted, _ := encrypt.AESDecrypt(testTOTPKey, user.TOTPSecret); decrypted != secret {
+		t.Error("Expected the secret to decrypt with the TOTP key")
+	}
+
+	response := doWithToken(t, "POST", twoFactorURL, token, url.Values{})
+	if response.StatusCode != http.StatusConflict {
+		t.Error("Expected enrolling twice to conflict but got: ", response.StatusCode)
+	}
+
+	tearDown()
+}
+
+func TestTwoFactorEnrollmentNeedsAKey(t *testing.T) {
+	r, _ := http.NewRequest("POST", "/twofactor", nil)
+	w := httptest.NewRecorder()
+	AppHandler{&AppContext{DB: GetDB()}, EnrollTwoFactor}.ServeHTTP(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Error("Expected enrollment to be refused without a TOTP key but got: ", w.Code)
+	}
+}
+
+func TestSigninWithTwoFactorIsTwoSteps(t *testing.T) {
+	token := signupAndSignin(t, "mark@twain.com", "Huckelberry")
+	secret, recoveryCodes := enableTestTwoFactor(t, token)
+
+	// The code used to confirm enrolment cannot be replayed so sign in with
+	// the one the authenticator shows next
+	user := User{}
+	GetDB().First(&user, userIDByEmail("mark@twain.com"))
+	usedCode := codeForStep(t, secret, user.TOTPLastStep)
+	nextCode := codeForStep(t, secret, user.TOTPLastStep+1)
+	challenge := signinForChallenge(t, "mark@twain.com", "Huckelberry")
+
+	var testCases = []struct {
+		challenge          string
+		code               string
+		expectedStatusCode int
+		reason             string
+	}{
+		{"A MADE UP CHALLENGE", nextCode, http.StatusUnauthorized, "Unknown challenge"},
+		{challenge, "000000", http.StatusUnauthorized, "Wrong code"},
+		{challenge, usedCode, http.StatusUnauthorized, "Code already used to confirm"},
+		{challenge, nextCode, http.StatusOK, "Valid code"},
+		{challenge, nextCode, http.StatusUnauthorized, "Challenges can only be used once"},
+	}
+
+	for _, testCase := range testCases {
+		response := completeTestSignin(t, testCase.challenge, testCase.code)
+		if response.StatusCode != testCase.expectedStatusCode {
+			t.Errorf("Expected %d but got %d reason %s", testCase.expectedStatusCode, response.StatusCode, testCase.reason)
+		}
+	}
+
+	challenge = signinForChallenge(t, "mark@twain.com", "Huckelberry")
+	response := completeTestSignin(t, challenge, strings.ToUpper(recoveryCodes[0]))
+	if response.StatusCode != http.StatusOK {
+		t.Error("Expected a recovery code to complete the signin but got: ", response.StatusCode)
+	}
+	tokens := tokenResponse{}
+	json.NewDecoder(response.Body).Decode(&tokens)
+	if response := doWithToken(t, "GET", server.URL+"/users/me", tokens.Token, url.Values{}); response.StatusCode != http.StatusOK {
+		t.Error("Expected the two factor session to be usable but got: ", response.StatusCode)
+	}
+
+	challenge = signinForChallenge(t, "mark@twain.com", "Huckelberry")
+	if response := completeTestSignin(t, challenge, recoveryCodes[0]); response.StatusCode != http.StatusUnauthorized {
+		t.Error("Expected recovery codes to be single use but got: ", response.StatusCode)
+	}
+
+	events := []AuditEvent{}
+	GetDB().Where(AuditEvent{Action: AuditRecoveryCodeUsed}).Find(&events)
+	if len(events) != 1 {
+		t.Error("Expected the recovery code use to be audited got:", events)
+	}
+
+	tearDown()
+}
+
+func TestTwoFactorChallengeLocksAfterWrongCodes(t *testing.T) {
+	token := signupAndSignin(t, "mark@twain.com", "Huckelberry")
+	secret, _ := enableTestTwoFactor(t, token)
+	challenge := signinForChallenge(t, "mark@twain.com", "Huckelberry")
+
+	for i := 0; i < twoFactorChallengeAttempts; i++ {
+		completeTestSignin(t, challenge, "000000")
+	}
+	// The wrong codes also locked the account out which is tested on its own
+	GetDB().Exec("DELETE FROM login_attempts;")
+
+	response := completeTestSignin(t, challenge, codeAt(t, secret, time.Now().Add(totpPeriod)))
+	if response.StatusCode != http.StatusUnauthorized {
+		t.Error("Expected the challenge to be thrown away after too many wrong codes but got: ", response.StatusCode)
+	}
+
+	tearDown()
+}
+
+func TestWrongTwoFactorCodesLockOutTheAccount(t *testing.T) {
+	token := signupAndSignin(t, "mark@twain.com", "Huckelberry")
+	secret, _ := enableTestTwoFactor(t, token)
+
+	// A fresh challenge for every guess does not start the count again
+	for i := 1; i < emailLockoutThreshold; i++ {
+		challenge := signinForChallenge(t, "mark@twain.com", "Huckelberry")
+		if response := completeTestSignin(t, challenge, "000000"); response.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("Expected wrong code %d to be unauthorized but got: %d", i, response.StatusCode)
+		}
+	}
+	challenge := signinForChallenge(t, "mark@twain.com", "Huckelberry")
+	if response := completeTestSignin(t, challenge, "000000"); response.StatusCode != http.StatusTooManyRequests {
+		t.Fatal("Expected the account to be locked out but got: ", response.StatusCode)
+	}
+
+	response := completeTestSignin(t, challenge, codeAt(t, secret, time.Now().Add(totpPeriod)))
+	if response.StatusCode != http.StatusTooManyRequests {
+		t.Error("Expected the right code to be refused while locked out but got: ", response.StatusCode)
+	}
+
+	tearDown()
+}
+
+func TestDisableTwoFactorLocksOutAfterWrongCodes(t *testing.T) {
+	token := signupAndSignin(t, "mark@twain.com", "Huckelberry")
+	_, recoveryCodes := enableTestTwoFactor(t, token)
+
+	for i := 1; i < emailLockoutThreshold; i++ {
+		response := doWithToken(t, "POST", twoFactorURL+"/disable", token, url.Values{"code": {"000000"}})
+		if response.StatusCode != http.StatusForbidden {
+			t.Fatalf("Expected wrong code %d to be forbidden but got: %d", i, response.StatusCode)
+		}
+	}
+
+	var testCases = []struct {
+		code               string
+		expectedStatusCode int
+		reason             string
+	}{
+		{"000000", http.StatusTooManyRequests, "Too many wrong codes"},
+		{recoveryCodes[0], http.StatusTooManyRequests, "Locked out even with a right code"},
+	}
+
+	for _, testCase := range testCases {
+		response := doWithToken(t, "POST", twoFactorURL+"/disable", token, url.Values{"code": {testCase.code}})
+		if response.StatusCode != testCase.expectedStatusCode {
+			t.Errorf("Expected %d but got %d reason %s", testCase.expectedStatusCode, response.StatusCode, testCase.reason)
+		}
+	}
+
+	tearDown()
+}
+
+func TestDisableTwoFactorNeedsACode(t *testing.T) {
+	token := signupAndSignin(t, "mark@twain.com", "Huckelberry")
+	_, recoveryCodes := enableTestTwoFactor(t, token)
+
+	var testCases = []struct {
+		code               string
+		expectedStatusCode int
+		reason             string
+	}{
+		{"000000", http.StatusForbidden, "Wrong code"},
+		{recoveryCodes[1], http.StatusOK, "Recovery code"},
+		{recoveryCodes[2], http.StatusConflict, "Already disabled"},
+	}
+
+	for _, testCase := range testCases {
+		response := doWithToken(t, "POST", twoFactorURL+"/disable", token, url.Values{"code": {testCase.code}})
+		if response.StatusCode != testCase.expectedStatusCode {
+			t.Errorf("Expected %d but got %d reason %s", testCase.expectedStatusCode, response.StatusCode, testCase.reason)
+		}
+	}
+
+	signin(t, "mark@twain.com", "Huckelberry", "")
+
+	count := 0
+	GetDB().Model(&RecoveryCode{}).Where("user_id = ?", userIDByEmail("mark@twain.com")).Count(&count)
+	if count != 0 {
+		t.Error("Expected recovery codes to be thrown away got:", count)
+	}
+
+	tearDown()
+}
@@ -0,0 +1,78 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// selfView is what users see about their own account
+type selfView struct {
+	ID           uint
+	FirstName    string
+	LastName     string
+	PrimaryEmail string
+	Role         string
+	TwoFactor    bool
+	CreatedAt    time.Time
+}
+
+func newSelfView(user User) selfView {
+	return selfView{
+		ID:           user.ID,
+		FirstName:    user.FirstName,
+		LastName:     user.LastName,
+		PrimaryEmail: user.PrimaryEmail,
+		Role:         user.Role,
+		TwoFactor:    user.HasTwoFactor(),
+		CreatedAt:    user.CreatedAt,
+	}
+}
+
+// publicUserView is what any authenticated user can see about another user
+type publicUserView struct {
+	ID        uint
+	FirstName string
+	LastName  string
+	Rating    RatingSummary
+}
+
+func newPublicUserView(user User, rating RatingSummary) publicUserView {
+	return publicUserView{
+		ID:        user.ID,
+		FirstName: user.FirstName,
+		LastName:  user.LastName,
+		Rating:    rating,
+	}
+}
+
+// ShowSelf returns the authenticated user's own account
+func ShowSelf(env *AppContext, w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, newSelfView(env.User))
+}
+
+// ShowUser returns the public profile of a user along with the rating farm
+// owners have given them as a worker
+func ShowUser(env *AppContext, w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "userid")
+	if err != nil {
+		writeError(w, r, badRequest(err.Error()))
+		return
+	}
+
+	user := User{}
+	if env.DB.First(&user, id).RecordNotFound() {
+		writeError(w, r, notFound("User not found"))
+		return
+	}
+
+	rating, err := WorkerRating(env.DB, user.ID)
+	if err != nil {
+		log.WithFields(log.Fields{"action": "ShowUser"}).Error(err)
+		writeError(w, r, errServer)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newPublicUserView(user, rating))
+}
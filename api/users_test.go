@@ -0,0 +1,131 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestSignupReturnsSelfViewWithoutSecrets(t *testing.T) {
+	data := url.Values{}
+	data.Add("firstname", "Mark")
+	data.Add("lastname", "Twain")
+	data.Add("email", "mark@twain.com")
+	data.Add("password", "Huckelberry")
+
+	request, _ := http.NewRequest("POST", signupURL, strings.NewReader(data.Encode()))
+	request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	fields := map[string]interface{}{}
+	if err := json.NewDecoder(response.Body).Decode(&fields); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []string{"ID", "FirstName", "LastName", "PrimaryEmail", "Role", "CreatedAt"} {
+		if _, ok := fields[expected]; !ok {
+			t.Errorf("Expected signup response to include %s got: %v", expected, fields)
+		}
+	}
+	if len(fields) != 6 {
+		t.Error("Expected signup response to only include the self view fields got:", fields)
+	}
+	if fields["ID"] != float64(userIDByEmail("mark@twain.com")) {
+		t.Error("Expected signup response to include the new user's ID got:", fields["ID"])
+	}
+
+	tearDown()
+}
+
+func TestShowUserSelfAndPublicViews(t *testing.T) {
+	ownerToken := signupAndSigninAs(t, "owner@farm.com", "some password", RoleFarmOwner)
+	signupAndSignin(t, "worker@farm.com", "some password")
+
+	response := doWithToken(t, "GET", fmt.Sprintf("%s/users/me", server.URL), ownerToken, url.Values{})
+	self := selfView{}
+	json.NewDecoder(response.Body).Decode(&self)
+	if self.ID != userIDByEmail("owner@farm.com") || self.PrimaryEmail != "owner@farm.com" {
+		t.Error("Expected /users/me to return the authenticated user got:", self)
+	}
+
+	response = doWithToken(t, "GET", fmt.Sprintf("%s/users/%d", server.URL, userIDByEmail("worker@farm.com")), ownerToken, url.Values{})
+	public := map[string]interface{}{}
+	json.NewDecoder(response.Body).Decode(&public)
+	if _, ok := public["PrimaryEmail"]; ok || public["FirstName"] != "test" {
+		t.Error("Expected another user's profile to leave out their email got:", public)
+	}
+
+	tearDown()
+}
+
+// TestResponsesNeverIncludeSecrets walks the endpoints that return user or
+// session data and checks none of the stored secrets appear in them
+func TestResponsesNeverIncludeSecrets(t *testing.T) {
+	ownerToken := signupAndSigninAs(t, "owner@farm.com", "some password", RoleFarmOwner)
+	tokens := signinWithRefresh(t, "owner@farm.com", "some password")
+	farm := Farm{}
+	postJSON(t, ownerToken, farmsURL, map[string]interface{}{"name": "Green Acres"}, &farm)
+
+	owner := User{}
+	GetDB().Where(User{PrimaryEmail: "owner@farm.com"}).First(&owner)
+	sessions := []AuthToken{}
+	GetDB().Where("user_id = ?", owner.ID).Find(&sessions)
+
+	secrets := []string{owner.Password, "some password", tokens.Token, tokens.RefreshToken}
+	for _, session := range sessions {
+		secrets = append(secrets, session.Token, session.RefreshToken)
+	}
+
+	paths := []string{
+		"/users/me",
+		fmt.Sprintf("/users/%d", owner.ID),
+		"/farms",
+		fmt.Sprintf("/farms/%d", farm.ID),
+		"/sessions",
+	}
+
+	for _, path := range paths {
+		response := doWithToken(t, "GET", server.URL+path, tokens.Token, url.Values{})
+		body, _ := ioutil.ReadAll(response.Body)
+		response.Body.Close()
+
+		if response.StatusCode != http.StatusOK {
+			t.Errorf("Expected status code 200 from %s but got: %d", path, response.StatusCode)
+		}
+		if strings.Contains(string(body), `"Password"`) {
+			t.Errorf("Expected %s not to include a Password field got: %s", path, body)
+		}
+		for _, secret := range secrets {
+			if secret != "" && strings.Contains(string(body), secret) {
+				t.Errorf("Expected %s not to include secret %q got: %s", path, secret, body)
+			}
+		}
+	}
+
+	tearDown()
+}
+
+func TestUserJSONLeavesOutSecrets(t *testing.T) {
+	user := User{
+		PrimaryEmail: "mark@twain.com",
+		Password:     "$2a$10$hash",
+		AuthTokens:   []AuthToken{{Token: "tokendigest", RefreshToken: "refreshdigest"}},
+	}
+	js, err := json.Marshal(Farm{Owner: user})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"$2a$10$hash", "tokendigest", "refreshdigest"} {
+		if strings.Contains(string(js), secret) {
+			t.Errorf("Expected %q to be left out of %s", secret, js)
+		}
+	}
+}
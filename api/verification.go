@@ -0,0 +1,102 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/jinzhu/gorm"
+)
+
+// emailVerificationLifetime is how long a verification token can be used for
+const emailVerificationLifetime = 48 * time.Hour
+
+type verifyEmailRequest struct {
+	Token string `json:"token" validate:"required"`
+}
+
+func (verification *EmailVerification) isUsable() bool {
+	return verification.UsedAt == nil && verification.Expiry.After(time.Now())
+}
+
+// sendEmailVerification issues a verification token for the user and mails it
+// to their primary email
+func sendEmailVerification(db *gorm.DB, mailer Mailer, user User) error {
+	token, err := generateToken()
+	if err != nil {
+		return err
+	}
+
+	verification := EmailVerification{
+		UserID: user.ID,
+		Token:  hashToken(token),
+		Expiry: time.Now().Add(emailVerificationLifetime),
+	}
+	if err := db.Create(&verification).Error; err != nil {
+		return err
+	}
+
+	return mailer.Send(Message{
+		To:      user.PrimaryEmail,
+		Subject: "Verify your chamba email address",
+		Body: fmt.Sprintf("Use the token below to verify your email address. It expires in %s.\n\n%s",
+			emailVerificationLifetime, token),
+	})
+}
+
+// VerifyEmail marks the email address of the user the token was mailed to as
+// verified. Tokens can only be used once
+func VerifyEmail(env *AppContext, w http.ResponseWriter, r *http.Request) {
+	request := verifyEmailRequest{}
+	if err := decodeRequest(r, &request); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	verification := EmailVerification{}
+	env.DB.Where(EmailVerification{Token: hashToken(request.Token)}).First(&verification)
+	if verification.ID == 0 || !verification.isUsable() {
+		log.WithFields(log.Fields{"action": "VerifyEmail"}).Error("Invalid or expired verification token")
+		writeError(w, r, badRequest("Invalid or expired verification token"))
+		return
+	}
+
+	now := time.Now()
+	verification.UsedAt = &now
+
+	tx := env.DB.Begin()
+	err := tx.Save(&verification).Error
+	if err == nil {
+		err = tx.Model(&User{}).
+			Where("id = ? AND email_verified_at IS NULL", verification.UserID).
+			UpdateColumn("email_verified_at", now).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		log.WithFields(log.Fields{"action": "VerifyEmail"}).Error(err)
+		writeError(w, r, errServer)
+		return
+	}
+	tx.Commit()
+
+	w.Header().Set("Content-Type", "application/text")
+	w.Write([]byte("Email verified"))
+}
+
+// ResendEmailVerification mails the authenticated user a new verification token
+func ResendEmailVerification(env *AppContext, w http.ResponseWriter, r *http.Request) {
+	if env.User.IsVerified() {
+		writeError(w, r, conflict("Email has already been verified"))
+		return
+	}
+
+	if err := sendEmailVerification(env.DB, env.Mailer, env.User); err != nil {
+		log.WithFields(log.Fields{"action": "ResendEmailVerification"}).Error(err)
+		writeError(w, r, errServer)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/text")
+	w.Write([]byte("Verification email sent"))
+}
@@ -0,0 +1,131 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+var verifyURL string
+
+func init() {
+	verifyURL = fmt.Sprintf("%s/verify", server.URL)
+}
+
+func signupData(email string) url.Values {
+	data := url.Values{}
+	data.Add("firstname", "test")
+	data.Add("lastname", "test")
+	data.Add("email", email)
+	data.Add("password", "some password")
+	return data
+}
+
+// signupUnverified signs up a user through the Signup handler and returns the
+// verification token mailed to them
+func signupUnverified(t *testing.T, email string) (token string) {
+	mailer := &recordingMailer{}
+	w := postWithMailer(Signup, mailer, signupData(email))
+	if w.Code != http.StatusOK {
+		t.Fatal("Expected status code 200 but got: ", w.Code)
+	}
+	if len(mailer.messages) != 1 || mailer.messages[0].To != email {
+		t.Fatal("Expected a single verification message to be mailed got:", mailer.messages)
+	}
+
+	lines := strings.Split(mailer.messages[0].Body, "\n")
+	return lines[len(lines)-1]
+}
+
+func verifyTestEmail(t *testing.T, token string) *http.Response {
+	request, _ := http.NewRequest("POST", verifyURL, strings.NewReader(url.Values{"token": {token}}.Encode()))
+	request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
+
+func TestSignupRequiresAnEmailAddress(t *testing.T) {
+	for _, email := range []string{"not an email", "Mark <mark@twain.com>", "mark@"} {
+		w := postWithMailer(Signup, &recordingMailer{}, signupData(email))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected %q to be rejected but got: %d", email, w.Code)
+		}
+	}
+}
+
+func TestSignupMailsAVerificationToken(t *testing.T) {
+	token := signupUnverified(t, "worker@farm.com")
+
+	user := User{}
+	GetDB().First(&user, userIDByEmail("worker@farm.com"))
+	if user.IsVerified() {
+		t.Fatal("Expected new users to start unverified")
+	}
+
+	verification := EmailVerification{}
+	GetDB().Where(EmailVerification{UserID: user.ID}).First(&verification)
+	if verification.Token != hashToken(token) {
+		t.Error("Expected only the digest of the mailed token to be saved got:", verification.Token)
+	}
+
+	var testCases = []struct {
+		token              string
+		expectedStatusCode int
+		reason             string
+	}{
+		{"A MADE UP TOKEN", http.StatusBadRequest, "Unknown token"},
+		{token, http.StatusOK, "Valid token"},
+		{token, http.StatusBadRequest, "Tokens can only be used once"},
+	}
+
+	for _, testCase := range testCases {
+		response := verifyTestEmail(t, testCase.token)
+		if response.StatusCode != testCase.expectedStatusCode {
+			t.Errorf("Expected %d but got %d reason %s", testCase.expectedStatusCode, response.StatusCode, testCase.reason)
+		}
+	}
+
+	GetDB().First(&user, user.ID)
+	if !user.IsVerified() {
+		t.Error("Expected the user to be verified")
+	}
+
+	tearDown()
+}
+
+func TestUnverifiedUsersCannotApplyToJobs(t *testing.T) {
+	ownerToken := signupAndSigninAs(t, "owner@farm.com", "some password", RoleFarmOwner)
+	farm := Farm{}
+	postJSON(t, ownerToken, farmsURL, map[string]interface{}{"name": "Green Acres"}, &farm)
+	posting := JobPosting{}
+	postJSON(t, ownerToken, fmt.Sprintf("%s/%d/jobs", farmsURL, farm.ID), jobPostingJSON(1), &posting)
+
+	token := signupUnverified(t, "worker@farm.com")
+	workerToken := signin(t, "worker@farm.com", "some password", "")
+	applicationsURL := fmt.Sprintf("%s/%d/applications", jobsURL, posting.ID)
+
+	response := doWithToken(t, "POST", applicationsURL, workerToken, url.Values{})
+	if response.StatusCode != http.StatusForbidden {
+		t.Error("Expected unverified worker to be unable to apply but got: ", response.StatusCode)
+	}
+
+	response = doWithToken(t, "POST", verifyURL+"/resend", workerToken, url.Values{})
+	if response.StatusCode != http.StatusOK {
+		t.Error("Expected a new verification email to be sent but got: ", response.StatusCode)
+	}
+
+	verifyTestEmail(t, token)
+	postJSON(t, workerToken, applicationsURL, map[string]interface{}{}, &Application{})
+
+	response = doWithToken(t, "POST", verifyURL+"/resend", workerToken, url.Values{})
+	if response.StatusCode != http.StatusConflict {
+		t.Error("Expected verified users not to be sent another token but got: ", response.StatusCode)
+	}
+
+	tearDown()
+}
@@ -0,0 +1,787 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/dklassen/chamba/api"
+	"github.com/jinzhu/gorm"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Exports are newline delimited JSON. The first line is a header and every
+// line after it is a record of one kind. Records are written in an order where
+// everything a record refers to comes before it so they can be imported in one
+// pass. Engagements are exported because reviews belong to them
+const (
+	exportFormatVersion = 1
+	exportBatchSize     = 500
+
+	kindHeader     = "export"
+	kindUser       = "user"
+	kindFarm       = "farm"
+	kindAddress    = "address"
+	kindCrop       = "crop"
+	kindEngagement = "engagement"
+	kindReview     = "review"
+	kindAuthToken  = "auth_token"
+)
+
+// exportRecord is a line of an export
+type exportRecord struct {
+	Kind string          `json:"kind"`
+	Data json.RawMessage `json:"data"`
+}
+
+type exportHeader struct {
+	Version         int       `json:"version"`
+	ExportedAt      time.Time `json:"exported_at"`
+	IncludesSecrets bool      `json:"includes_secrets"`
+}
+
+// exportedUser leaves out the password hash and two factor secret unless the
+// export includes secrets
+type exportedUser struct {
+	ID              uint       `json:"id"`
+	CreatedAt       time.Time  `json:"created_at"`
+	UpdatedAt       time.Time  `json:"updated_at"`
+	FirstName       string     `json:"first_name"`
+	LastName        string     `json:"last_name"`
+	UserName        string     `json:"user_name"`
+	PrimaryEmail    string     `json:"primary_email"`
+	Role            string     `json:"role"`
+	FarmID          uint       `json:"farm_id,omitempty"`
+	SuspendedAt     *time.Time `json:"suspended_at,omitempty"`
+	EmailVerifiedAt *time.Time `json:"email_verified_at,omitempty"`
+	Password        string     `json:"password,omitempty"`
+	TOTPSecret      string     `json:"totp_secret,omitempty"`
+	TOTPEnabledAt   *time.Time `json:"totp_enabled_at,omitempty"`
+	TOTPLastStep    int64      `json:"totp_last_step,omitempty"`
+}
+
+type exportedFarm struct {
+	ID          uint      `json:"id"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+	OwnerID     uint      `json:"owner_id"`
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+}
+
+type exportedAddress struct {
+	ID              uint      `json:"id"`
+	CreatedAt       time.Time `json:"created_at"`
+	UpdatedAt       time.Time `json:"updated_at"`
+	FarmID          uint      `json:"farm_id,omitempty"`
+	UserID          uint      `json:"user_id,omitempty"`
+	Latitude        float64   `json:"latitude"`
+	Longitude       float64   `json:"longitude"`
+	City            string    `json:"city"`
+	PostalOrZipCode string    `json:"postal_or_zip_code"`
+	ProvinceOrState string    `json:"province_or_state"`
+}
+
+type exportedCrop struct {
+	ID           uint       `json:"id"`
+	CreatedAt    time.Time  `json:"created_at"`
+	UpdatedAt    time.Time  `json:"updated_at"`
+	FarmID       uint       `json:"farm_id"`
+	Name         string     `json:"name"`
+	Season       string     `json:"season"`
+	HarvestStart *time.Time `json:"harvest_start,omitempty"`
+	HarvestEnd   *time.Time `json:"harvest_end,omitempty"`
+}
+
+type exportedEngagement struct {
+	ID          uint       `json:"id"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+	FarmID      uint       `json:"farm_id"`
+	WorkerID    uint       `json:"worker_id"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+}
+
+type exportedReview struct {
+	ID           uint      `json:"id"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+	EngagementID uint      `json:"engagement_id"`
+	AuthorID     uint      `json:"author_id"`
+	FarmID       uint      `json:"farm_id"`
+	WorkerID     uint      `json:"worker_id"`
+	Kind         string    `json:"kind"`
+	Stars        int       `json:"stars"`
+	Comment      string    `json:"comment"`
+}
+
+// exportedAuthToken is a signed in session. Sessions are only exported along
+// with the other secrets. The tokens are the digests stored in the database
+type exportedAuthToken struct {
+	ID            uint       `json:"id"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+	UserID        uint       `json:"user_id"`
+	Token         string     `json:"token"`
+	Expiry        time.Time  `json:"expiry"`
+	DeviceLabel   string     `json:"device_label"`
+	IP            string     `json:"ip"`
+	LastUsedAt    time.Time  `json:"last_used_at"`
+	RefreshToken  string     `json:"refresh_token"`
+	RefreshExpiry time.Time  `json:"refresh_expiry"`
+	FamilyID      string     `json:"family_id"`
+	RotatedAt     *time.Time `json:"rotated_at,omitempty"`
+}
+
+func exportUser(user api.User, secrets bool) exportedUser {
+	exported := exportedUser{
+		ID:              user.ID,
+		CreatedAt:       user.CreatedAt,
+		UpdatedAt:       user.UpdatedAt,
+		FirstName:       user.FirstName,
+		LastName:        user.LastName,
+		UserName:        user.UserName,
+		PrimaryEmail:    user.PrimaryEmail,
+		Role:            user.Role,
+		FarmID:          user.FarmID,
+		SuspendedAt:     user.SuspendedAt,
+		EmailVerifiedAt: user.EmailVerifiedAt,
+	}
+	// Two factor stays on only when the secret goes with it, otherwise the
+	// imported user could never sign in
+	if secrets {
+		exported.Password = user.Password
+		exported.TOTPSecret = user.TOTPSecret
+		exported.TOTPEnabledAt = user.TOTPEnabledAt
+		exported.TOTPLastStep = user.TOTPLastStep
+	}
+	return exported
+}
+
+func exportFarm(farm api.Farm) exportedFarm {
+	return exportedFarm{farm.ID, farm.CreatedAt, farm.UpdatedAt, farm.OwnerID, farm.Name, farm.Description}
+}
+
+func exportAddress(address api.Address) exportedAddress {
+	return exportedAddress{address.ID, address.CreatedAt, address.UpdatedAt, address.FarmID, address.UserID,
+		address.Latitude, address.Longitude, address.City, address.PostalOrZipCode, address.ProvinceOrState}
+}
+
+func exportCrop(crop api.Crop) exportedCrop {
+	return exportedCrop{crop.ID, crop.CreatedAt, crop.UpdatedAt, crop.FarmID, crop.Name, crop.Season, crop.HarvestStart, crop.HarvestEnd}
+}
+
+func exportEngagement(engagement api.Engagement) exportedEngagement {
+	return exportedEngagement{engagement.ID, engagement.CreatedAt, engagement.UpdatedAt, engagement.FarmID, engagement.WorkerID, engagement.CompletedAt}
+}
+
+func exportReview(review api.Review) exportedReview {
+	return exportedReview{review.ID, review.CreatedAt, review.UpdatedAt, review.EngagementID, review.AuthorID,
+		review.FarmID, review.WorkerID, review.Kind, review.Stars, review.Comment}
+}
+
+func exportAuthToken(token api.AuthToken) exportedAuthToken {
+	return exportedAuthToken{token.ID, token.CreatedAt, token.UpdatedAt, uint(token.UserID), token.Token, token.Expiry,
+		token.DeviceLabel, token.IP, token.LastUsedAt, token.RefreshToken, token.RefreshExpiry, token.FamilyID, token.RotatedAt}
+}
+
+// exportRef is a reference from an exported record to another record by its
+// kind and id. Zero ids refer to nothing
+type exportRef struct {
+	kind string
+	id   uint
+}
+
+// referrer is an exported record that can list the records it refers to
+type referrer interface {
+	references() []exportRef
+}
+
+// A user's farm_id is not a reference as the import links it once every farm
+// is in and leaves it out when the farm was not exported
+func (r exportedUser) references() []exportRef { return nil }
+
+func (r exportedFarm) references() []exportRef { return []exportRef{{kindUser, r.OwnerID}} }
+
+func (r exportedAddress) references() []exportRef {
+	return []exportRef{{kindFarm, r.FarmID}, {kindUser, r.UserID}}
+}
+
+func (r exportedCrop) references() []exportRef { return []exportRef{{kindFarm, r.FarmID}} }
+
+func (r exportedEngagement) references() []exportRef {
+	return []exportRef{{kindFarm, r.FarmID}, {kindUser, r.WorkerID}}
+}
+
+func (r exportedReview) references() []exportRef {
+	return []exportRef{{kindEngagement, r.EngagementID}, {kindUser, r.AuthorID}, {kindFarm, r.FarmID}, {kindUser, r.WorkerID}}
+}
+
+func (r exportedAuthToken) references() []exportRef { return []exportRef{{kindUser, r.UserID}} }
+
+// exportWriter writes one record per line
+type exportWriter struct {
+	encoder *json.Encoder
+	counts  map[string]int
+	skipped map[string]int
+	written map[string]map[uint]bool // ids of the records written by kind
+}
+
+func newExportWriter(w io.Writer) *exportWriter {
+	return &exportWriter{encoder: json.NewEncoder(w), counts: map[string]int{}, skipped: map[string]int{}, written: map[string]map[uint]bool{}}
+}
+
+// writeRecord writes the record when everything it refers to is already in the
+// export. Any other record could not be imported so it is left out, which is
+// also how a single user export leaves out other users' data
+func (w *exportWriter) writeRecord(kind string, id uint, record referrer) error {
+	for _, ref := range record.references() {
+		if ref.id != 0 && !w.written[ref.kind][ref.id] {
+			w.skipped[kind]++
+			return nil
+		}
+	}
+	if w.written[kind] == nil {
+		w.written[kind] = map[uint]bool{}
+	}
+	w.written[kind][id] = true
+	return w.write(kind, record)
+}
+
+func (w *exportWriter) write(kind string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	w.counts[kind]++
+	return w.encoder.Encode(exportRecord{Kind: kind, Data: data})
+}
+
+// exportOptions are the flags export accepts
+type exportOptions struct {
+	Output         string
+	User           string
+	IncludeSecrets bool
+}
+
+func parseExportOptions(args []string) (exportOptions, error) {
+	options := exportOptions{}
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	flags.StringVar(&options.Output, "output", "-", "File to write the export to, - for stdout")
+	flags.StringVar(&options.User, "user", "", "Only export the user with this email, their farms and the records that refer to nothing else")
+	flags.BoolVar(&options.IncludeSecrets, "include-secrets", false, "Export password hashes, two factor secrets and sessions")
+	if err := flags.Parse(args); err != nil {
+		return options, err
+	}
+	if flags.NArg() > 0 {
+		return options, fmt.Errorf("Unexpected arguments %v", flags.Args())
+	}
+	return options, nil
+}
+
+// exportScopes are the conditions picking the rows of each table that involve
+// a single user. Their farms are everything they own. The rows that refer to
+// another user or their farms are then left out by exportWriter.writeRecord
+func exportScopes(userID uint) map[string][]interface{} {
+	farms := "farm_id IN (SELECT id FROM farms WHERE owner_id = ?)"
+	return map[string][]interface{}{
+		kindUser:       {"id = ?", userID},
+		kindFarm:       {"owner_id = ?", userID},
+		kindAddress:    {"user_id = ? OR " + farms, userID, userID},
+		kindCrop:       {farms, userID},
+		kindEngagement: {"worker_id = ? OR " + farms, userID, userID},
+		kindReview:     {"author_id = ? OR worker_id = ? OR " + farms, userID, userID, userID},
+		kindAuthToken:  {"user_id = ?", userID},
+	}
+}
+
+// exportTable reads the rows of one kind and turns each into its record
+type exportTable struct {
+	kind   string
+	model  interface{} // a row of the table, batches are loaded into a slice of its type
+	record func(row interface{}) (id uint, record referrer)
+}
+
+// exportTables are the tables to export in an order where every record only
+// refers to kinds before it. Sessions only go along with the other secrets
+func exportTables(secrets bool) []exportTable {
+	tables := []exportTable{
+		{kindUser, api.User{}, func(row interface{}) (uint, referrer) {
+			user := row.(api.User)
+			return user.ID, exportUser(user, secrets)
+		}},
+		{kindFarm, api.Farm{}, func(row interface{}) (uint, referrer) {
+			farm := row.(api.Farm)
+			return farm.ID, exportFarm(farm)
+		}},
+		{kindAddress, api.Address{}, func(row interface{}) (uint, referrer) {
+			address := row.(api.Address)
+			return address.ID, exportAddress(address)
+		}},
+		{kindCrop, api.Crop{}, func(row interface{}) (uint, referrer) {
+			crop := row.(api.Crop)
+			return crop.ID, exportCrop(crop)
+		}},
+		{kindEngagement, api.Engagement{}, func(row interface{}) (uint, referrer) {
+			engagement := row.(api.Engagement)
+			return engagement.ID, exportEngagement(engagement)
+		}},
+		{kindReview, api.Review{}, func(row interface{}) (uint, referrer) {
+			review := row.(api.Review)
+			return review.ID, exportReview(review)
+		}},
+	}
+	if secrets {
+		tables = append(tables, exportTable{kindAuthToken, api.AuthToken{}, func(row interface{}) (uint, referrer) {
+			token := row.(api.AuthToken)
+			return token.ID, exportAuthToken(token)
+		}})
+	}
+	return tables
+}
+
+// export writes the rows of the table in the scope, or every row when there is
+// no scope, a batch at a time ordered by id
+func (table exportTable) export(tx *gorm.DB, w *exportWriter, scope []interface{}) error {
+	rowsType := reflect.SliceOf(reflect.TypeOf(table.model))
+	after := uint(0)
+	for {
+		query := tx.Where("id > ?", after).Order("id").Limit(exportBatchSize)
+		if scope != nil {
+			query = query.Where(scope[0], scope[1:]...)
+		}
+		rows := reflect.New(rowsType)
+		if err := query.Find(rows.Interface()).Error; err != nil {
+			return err
+		}
+		if rows.Elem().Len() == 0 {
+			return nil
+		}
+		for i := 0; i < rows.Elem().Len(); i++ {
+			id, record := table.record(rows.Elem().Index(i).Interface())
+			if err := w.writeRecord(table.kind, id, record); err != nil {
+				return err
+			}
+			after = id
+		}
+	}
+}
+
+// exportDatabase writes every record involving the user with the email, or
+// every record when no email is given. The user and every table are read in
+// one read only transaction so the records are a single snapshot that agree
+// with each other
+func exportDatabase(db *gorm.DB, w *exportWriter, email string, secrets bool) error {
+	tx := db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+	defer tx.Rollback()
+	if err := tx.Exec("SET TRANSACTION ISOLATION LEVEL REPEATABLE READ, READ ONLY").Error; err != nil {
+		return err
+	}
+
+	var scopes map[string][]interface{}
+	if email != "" {
+		user := api.User{}
+		query := tx.Where(api.User{PrimaryEmail: email}).First(&user)
+		if query.RecordNotFound() {
+			return fmt.Errorf("No user found with email %s", email)
+		}
+		if query.Error != nil {
+			return query.Error
+		}
+		scopes = exportScopes(user.ID)
+	}
+
+	err := w.write(kindHeader, exportHeader{Version: exportFormatVersion, ExportedAt: time.Now().UTC(), IncludesSecrets: secrets})
+	if err != nil {
+		return err
+	}
+	for _, table := range exportTables(secrets) {
+		if err := table.export(tx, w, scopes[table.kind]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// importIDs maps the ids in an export to the ids the records were given when
+// they were imported, by kind
+type importIDs map[string]map[uint]uint
+
+func (ids importIDs) add(kind string, exported, imported uint) {
+	if ids[kind] == nil {
+		ids[kind] = map[uint]uint{}
+	}
+	ids[kind][exported] = imported
+}
+
+// resolve finds the imported id of a record referred to by its exported id.
+// Zero means no record and stays zero
+func (ids importIDs) resolve(kind string, exported uint) (uint, error) {
+	if exported == 0 {
+		return 0, nil
+	}
+	imported, ok := ids[kind][exported]
+	if !ok {
+		return 0, fmt.Errorf("Refers to %s %d which is not earlier in the export", kind, exported)
+	}
+	return imported, nil
+}
+
+// importRef is a reference from an imported record to another record by its
+// exported id and where to put the imported id
+type importRef struct {
+	kind     string
+	exported uint
+	into     *uint
+}
+
+// resolveAll resolves several references stopping at the first one missing
+func (ids importIDs) resolveAll(refs ...importRef) error {
+	for _, ref := range refs {
+		id, err := ids.resolve(ref.kind, ref.exported)
+		if err != nil {
+			return err
+		}
+		*ref.into = id
+	}
+	return nil
+}
+
+// importer restores the records of an export giving them new ids and pointing
+// the references between them at the new ids
+type importer struct {
+	tx     *gorm.DB
+	ids    importIDs
+	counts map[string]int
+
+	// farmOwners are users who own a farm that had not been imported yet when
+	// the user was. Their farm_id is set once every farm is in
+	farmOwners map[uint]uint // imported user id to exported farm id
+}
+
+func newImporter(tx *gorm.DB) *importer {
+	return &importer{tx: tx, ids: importIDs{}, counts: map[string]int{}, farmOwners: map[uint]uint{}}
+}
+
+// unusablePassword hashes a random password nobody knows for users imported
+// without their password hash. They choose a new one by resetting it
+func unusablePassword() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	hashed, err := bcrypt.GenerateFromPassword([]byte(base64.RawURLEncoding.EncodeToString(b)), bcrypt.MinCost)
+	return string(hashed), err
+}
+
+// decodeRecord unmarshals the data of a record and resolves its references
+func (im *importer) decodeRecord(record exportRecord, v interface{}, refs func() []importRef) error {
+	if err := json.Unmarshal(record.Data, v); err != nil {
+		return err
+	}
+	return im.ids.resolveAll(refs()...)
+}
+
+// create inserts an imported row keeping the timestamps it was exported with.
+// gorm sets them to now on create so they are put back afterwards
+func (im *importer) create(model interface{}, createdAt, updatedAt time.Time) error {
+	if err := im.tx.Create(model).Error; err != nil {
+		return err
+	}
+	return im.tx.Model(model).UpdateColumns(map[string]interface{}{"created_at": createdAt, "updated_at": updatedAt}).Error
+}
+
+func (im *importer) importRecord(record exportRecord) (err error) {
+	var exportedID, importedID uint
+	switch record.Kind {
+	case kindUser:
+		r := exportedUser{}
+		if err = json.Unmarshal(record.Data, &r); err != nil {
+			return
+		}
+		user := api.User{
+			FirstName:       r.FirstName,
+			LastName:        r.LastName,
+			UserName:        r.UserName,
+			PrimaryEmail:    r.PrimaryEmail,
+			Role:            r.Role,
+			SuspendedAt:     r.SuspendedAt,
+			EmailVerifiedAt: r.EmailVerifiedAt,
+			Password:        r.Password,
+			TOTPSecret:      r.TOTPSecret,
+			TOTPLastStep:    r.TOTPLastStep,
+		}
+		if r.TOTPSecret != "" {
+			user.TOTPEnabledAt = r.TOTPEnabledAt
+		}
+		if user.Password == "" {
+			if user.Password, err = unusablePassword(); err != nil {
+				return
+			}
+		}
+		if user.Exists(im.tx) {
+			return fmt.Errorf("A user with the email %s already exists", user.PrimaryEmail)
+		}
+		if err = im.create(&user, r.CreatedAt, r.UpdatedAt); err != nil {
+			return
+		}
+		if r.FarmID != 0 {
+			im.farmOwners[user.ID] = r.FarmID
+		}
+		exportedID, importedID = r.ID, user.ID
+	case kindFarm:
+		r, farm := exportedFarm{}, api.Farm{}
+		err = im.decodeRecord(record, &r, func() []importRef {
+			return []importRef{{kindUser, r.OwnerID, &farm.OwnerID}}
+		})
+		if err != nil {
+			return
+		}
+		farm.Name, farm.Description = r.Name, r.Description
+		if err = im.create(&farm, r.CreatedAt, r.UpdatedAt); err != nil {
+			return
+		}
+		exportedID, importedID = r.ID, farm.ID
+	case kindAddress:
+		r, address := exportedAddress{}, api.Address{}
+		err = im.decodeRecord(record, &r, func() []importRef {
+			return []importRef{{kindFarm, r.FarmID, &address.FarmID}, {kindUser, r.UserID, &address.UserID}}
+		})
+		if err != nil {
+			return
+		}
+		address.Latitude, address.Longitude = r.Latitude, r.Longitude
+		address.City, address.PostalOrZipCode, address.ProvinceOrState = r.City, r.PostalOrZipCode, r.ProvinceOrState
+		if err = im.create(&address, r.CreatedAt, r.UpdatedAt); err != nil {
+			return
+		}
+		exportedID, importedID = r.ID, address.ID
+	case kindCrop:
+		r, crop := exportedCrop{}, api.Crop{}
+		err = im.decodeRecord(record, &r, func() []importRef {
+			return []importRef{{kindFarm, r.FarmID, &crop.FarmID}}
+		})
+		if err != nil {
+			return
+		}
+		crop.Name, crop.Season, crop.HarvestStart, crop.HarvestEnd = r.Name, r.Season, r.HarvestStart, r.HarvestEnd
+		if err = im.create(&crop, r.CreatedAt, r.UpdatedAt); err != nil {
+			return
+		}
+		exportedID, importedID = r.ID, crop.ID
+	case kindEngagement:
+		r, engagement := exportedEngagement{}, api.Engagement{}
+		err = im.decodeRecord(record, &r, func() []importRef {
+			return []importRef{{kindFarm, r.FarmID, &engagement.FarmID}, {kindUser, r.WorkerID, &engagement.WorkerID}}
+		})
+		if err != nil {
+			return
+		}
+		engagement.CompletedAt = r.CompletedAt
+		if err = im.create(&engagement, r.CreatedAt, r.UpdatedAt); err != nil {
+			return
+		}
+		exportedID, importedID = r.ID, engagement.ID
+	case kindReview:
+		r, review := exportedReview{}, api.Review{}
+		err = im.decodeRecord(record, &r, func() []importRef {
+			return []importRef{
+				{kindEngagement, r.EngagementID, &review.EngagementID},
+				{kindUser, r.AuthorID, &review.AuthorID},
+				{kindFarm, r.FarmID, &review.FarmID},
+				{kindUser, r.WorkerID, &review.WorkerID},
+			}
+		})
+		if err != nil {
+			return
+		}
+		review.Kind, review.Stars, review.Comment = r.Kind, r.Stars, r.Comment
+		if err = im.create(&review, r.CreatedAt, r.UpdatedAt); err != nil {
+			return
+		}
+		exportedID, importedID = r.ID, review.ID
+	case kindAuthToken:
+		r, userID := exportedAuthToken{}, uint(0)
+		err = im.decodeRecord(record, &r, func() []importRef {
+			return []importRef{{kindUser, r.UserID, &userID}}
+		})
+		if err != nil {
+			return
+		}
+		token := api.AuthToken{UserID: int(userID), Token: r.Token, Expiry: r.Expiry, DeviceLabel: r.DeviceLabel, IP: r.IP, LastUsedAt: r.LastUsedAt,
+			RefreshToken: r.RefreshToken, RefreshExpiry: r.RefreshExpiry, FamilyID: r.FamilyID, RotatedAt: r.RotatedAt}
+		if err = im.create(&token, r.CreatedAt, r.UpdatedAt); err != nil {
+			return
+		}
+		exportedID, importedID = r.ID, token.ID
+	default:
+		return fmt.Errorf("Unknown kind of record %q", record.Kind)
+	}
+
+	im.ids.add(record.Kind, exportedID, importedID)
+	im.counts[record.Kind]++
+	return nil
+}
+
+// linkFarmOwners points farm owners at their farms now every farm is imported
+func (im *importer) linkFarmOwners() error {
+	for userID, exportedFarmID := range im.farmOwners {
+		farmID, ok := im.ids[kindFarm][exportedFarmID]
+		if !ok {
+			// The farm was left out of a single user export
+			continue
+		}
+		if err := im.tx.Model(&api.User{}).Where("id = ?", userID).UpdateColumn("farm_id", farmID).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readExportHeader checks the first line of an export is a header this
+// version of chamba-database can import
+func readExportHeader(line []byte) (exportHeader, error) {
+	record, header := exportRecord{}, exportHeader{}
+	if err := json.Unmarshal(line, &record); err != nil || record.Kind != kindHeader {
+		return header, fmt.Errorf("Expected an export header on the first line")
+	}
+	if err := json.Unmarshal(record.Data, &header); err != nil {
+		return header, err
+	}
+	if header.Version != exportFormatVersion {
+		return header, fmt.Errorf("Cannot import version %d exports, expected version %d", header.Version, exportFormatVersion)
+	}
+	return header, nil
+}
+
+// importExport reads an export into the database in a single transaction so
+// a bad record leaves nothing half imported
+func importExport(db *gorm.DB, r io.Reader) (counts map[string]int, err error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	if !scanner.Scan() {
+		if err = scanner.Err(); err == nil {
+			err = fmt.Errorf("The export is empty")
+		}
+		return
+	}
+	if _, err = readExportHeader(scanner.Bytes()); err != nil {
+		return
+	}
+
+	tx := db.Begin()
+	im := newImporter(tx)
+	for line := 2; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		record := exportRecord{}
+		if err = json.Unmarshal(scanner.Bytes(), &record); err == nil {
+			err = im.importRecord(record)
+		}
+		if err != nil {
+			tx.Rollback()
+			return nil, fmt.Errorf("Line %d: %v", line, err)
+		}
+	}
+	if err = scanner.Err(); err == nil {
+		err = im.linkFarmOwners()
+	}
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return im.counts, tx.Commit().Error
+}
+
+// writeExport runs write against the file at path, or stdout for "-". When
+// the export fails the file is removed rather than left looking like a short
+// export
+func writeExport(path string, write func(*exportWriter) error) (*exportWriter, error) {
+	out := os.Stdout
+	if path != "-" {
+		var err error
+		if out, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600); err != nil {
+			return nil, err
+		}
+	}
+	buffered := bufio.NewWriter(out)
+	w := newExportWriter(buffered)
+	err := write(w)
+	if err == nil {
+		err = buffered.Flush()
+	}
+	if out != os.Stdout {
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(path)
+		}
+	}
+	return w, err
+}
+
+// export writes the database, or the data of a single user, to a file
+func export(args []string) {
+	options, err := parseExportOptions(args)
+	if err != nil {
+		log.Fatal(err, "\n", usage)
+	}
+
+	w, err := writeExport(options.Output, func(w *exportWriter) error {
+		return exportDatabase(api.GetDB(), w, options.User, options.IncludeSecrets)
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fields := log.Fields{"output": options.Output, "secrets": options.IncludeSecrets}
+	for kind, count := range w.counts {
+		fields[kind+"s"] = count
+	}
+	for kind, count := range w.skipped {
+		fields["skipped_"+kind+"s"] = count
+	}
+	log.WithFields(fields).Info("Exported database")
+}
+
+// importData restores an export written by export into the database
+func importData(args []string) {
+	if len(args) != 1 {
+		log.Fatal(usage)
+	}
+
+	in := os.Stdin
+	if args[0] != "-" {
+		f, err := os.Open(args[0])
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		in = f
+	}
+
+	counts, err := importExport(api.GetDB(), in)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fields := log.Fields{"input": args[0]}
+	for kind, count := range counts {
+		fields[kind+"s"] = count
+	}
+	log.WithFields(fields).Info("Imported database")
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dklassen/chamba/api"
+)
+
+func TestExportUserLeavesOutSecrets(t *testing.T) {
+	enabledAt := time.Date(2016, 5, 1, 12, 0, 0, 0, time.UTC)
+	user := api.User{PrimaryEmail: "mark@twain.com", Password: "$2a$10$hash", TOTPSecret: "encrypted", TOTPEnabledAt: &enabledAt, TOTPLastStep: 42}
+
+	out := bytes.Buffer{}
+	w := newExportWriter(&out)
+	if err := w.write(kindUser, exportUser(user, false)); err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"password", "$2a$10$hash", "totp", "encrypted"} {
+		if strings.Contains(out.String(), secret) {
+			t.Errorf("Expected %q to be left out of the export got: %s", secret, out.String())
+		}
+	}
+
+	exported := exportUser(user, true)
+	if exported.Password != user.Password || exported.TOTPSecret != user.TOTPSecret || exported.TOTPEnabledAt == nil {
+		t.Error("Expected the secrets to be exported when asked for got:", exported)
+	}
+}
+
+func TestExportWriterWritesOneRecordPerLine(t *testing.T) {
+	out := bytes.Buffer{}
+	w := newExportWriter(&out)
+	w.write(kindFarm, exportFarm(api.Farm{OwnerID: 1, Name: "Sunrise Orchard"}))
+	w.write(kindCrop, exportCrop(api.Crop{FarmID: 2, Name: "Apples"}))
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 || w.counts[kindFarm] != 1 || w.counts[kindCrop] != 1 {
+		t.Fatal("Expected two records got:", out.String())
+	}
+	record, crop := exportRecord{}, exportedCrop{}
+	json.Unmarshal([]byte(lines[1]), &record)
+	json.Unmarshal(record.Data, &crop)
+	if record.Kind != kindCrop || crop.FarmID != 2 || crop.Name != "Apples" {
+		t.Error("Expected the crop to be readable back got:", lines[1])
+	}
+}
+
+func TestImportIDsResolveReferences(t *testing.T) {
+	ids := importIDs{}
+	ids.add(kindFarm, 7, 31)
+
+	var farmID, userID uint
+	if err := ids.resolveAll(importRef{kindFarm, 7, &farmID}, importRef{kindUser, 0, &userID}); err != nil || farmID != 31 || userID != 0 {
+		t.Error("Expected farm 7 to be 31 and no user to stay no user got:", farmID, userID, err)
+	}
+	if _, err := ids.resolve(kindFarm, 8); err == nil {
+		t.Error("Expected a farm missing from the export to be an error")
+	}
+	if _, err := ids.resolve(kindUser, 7); err == nil {
+		t.Error("Expected ids of one kind not to resolve another")
+	}
+}
+
+func TestImportRejectsBadExportsBeforeTouchingTheDatabase(t *testing.T) {
+	var testCases = []struct {
+		export string
+		reason string
+	}{
+		{"", "Empty"},
+		{`{"kind":"user","data":{}}`, "No header"},
+		{`{"kind":"export","data":{"version":2}}`, "Newer version"},
+		{"not json", "Not JSON"},
+	}
+
+	for _, testCase := range testCases {
+		if _, err := importExport(nil, strings.NewReader(testCase.export)); err == nil {
+			t.Error("Expected an error reason", testCase.reason)
+		}
+	}
+
+	header, err := readExportHeader([]byte(`{"kind":"export","data":{"version":1,"includes_secrets":true}}`))
+	if err != nil || !header.IncludesSecrets {
+		t.Error("Expected a version 1 header to be read got:", header, err)
+	}
+}
+
+func TestParseExportOptions(t *testing.T) {
+	options, err := parseExportOptions(nil)
+	if err != nil || options.Output != "-" || options.User != "" || options.IncludeSecrets {
+		t.Error("Expected everything without secrets to stdout by default got:", options, err)
+	}
+
+	options, err = parseExportOptions([]string{"--user", "mark@twain.com", "--output=mark.ndjson", "--include-secrets"})
+	if err != nil || options.User != "mark@twain.com" || options.Output != "mark.ndjson" || !options.IncludeSecrets {
+		t.Error("Expected the flags to be parsed got:", options, err)
+	}
+}
+
+func TestExportTablesComeAfterWhatTheyReferTo(t *testing.T) {
+	exported := map[string]bool{}
+	for _, table := range exportTables(true) {
+		_, record := table.record(table.model)
+		for _, ref := range record.references() {
+			if !exported[ref.kind] {
+				t.Errorf("Expected %s to be exported before the %ss that refer to it", ref.kind, table.kind)
+			}
+		}
+		exported[table.kind] = true
+	}
+}
+
+// importable reads an export back checking every reference resolves to a
+// record earlier in it the way importing it would
+func importable(t *testing.T, export string) (kinds map[string]int) {
+	records := map[string]func() referrer{
+		kindUser:       func() referrer { return &exportedUser{} },
+		kindFarm:       func() referrer { return &exportedFarm{} },
+		kindAddress:    func() referrer { return &exportedAddress{} },
+		kindCrop:       func() referrer { return &exportedCrop{} },
+		kindEngagement: func() referrer { return &exportedEngagement{} },
+		kindReview:     func() referrer { return &exportedReview{} },
+		kindAuthToken:  func() referrer { return &exportedAuthToken{} },
+	}
+
+	ids, kinds := importIDs{}, map[string]int{}
+	for _, line := range strings.Split(strings.TrimSpace(export), "\n") {
+		record := exportRecord{}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatal(err)
+		}
+		data := records[record.Kind]()
+		json.Unmarshal(record.Data, data)
+		for _, ref := range data.references() {
+			if _, err := ids.resolve(ref.kind, ref.id); err != nil {
+				t.Errorf("Expected the %s to be importable got: %v", record.Kind, err)
+			}
+		}
+		id := struct {
+			ID uint `json:"id"`
+		}{}
+		json.Unmarshal(record.Data, &id)
+		ids.add(record.Kind, id.ID, id.ID)
+		kinds[record.Kind]++
+	}
+	return kinds
+}
+
+func TestUserExportOnlyKeepsRecordsItCanImport(t *testing.T) {
+	me, other := api.User{PrimaryEmail: "worker@farm.com"}, api.User{PrimaryEmail: "owner@farm.com"}
+	me.ID, other.ID = 1, 2
+	mine, theirs := api.Farm{OwnerID: 1, Name: "Green Acres"}, api.Farm{OwnerID: 2, Name: "Sunrise Orchard"}
+	mine.ID, theirs.ID = 10, 20
+	engagement := api.Engagement{FarmID: 20, WorkerID: 1}
+	engagement.ID = 100
+	review := api.Review{EngagementID: 100, AuthorID: 2, FarmID: 20, WorkerID: 1, Kind: api.ReviewOfWorker, Stars: 2, Comment: "Said in confidence"}
+	review.ID = 200
+	crop := api.Crop{FarmID: 10, Name: "Apples"}
+	crop.ID = 300
+	token := api.AuthToken{UserID: 1, Token: "digest"}
+	token.ID = 400
+
+	// The rows the scopes pick for the worker, the other user is not among them
+	rows := map[string][]interface{}{
+		kindUser:       {me},
+		kindFarm:       {mine},
+		kindCrop:       {crop},
+		kindEngagement: {engagement},
+		kindReview:     {review},
+		kindAuthToken:  {token},
+	}
+
+	out := bytes.Buffer{}
+	w := newExportWriter(&out)
+	for _, table := range exportTables(true) {
+		for _, row := range rows[table.kind] {
+			id, record := table.record(row)
+			if err := w.writeRecord(table.kind, id, record); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if strings.Contains(out.String(), "Said in confidence") {
+		t.Error("Expected another user's review to be left out got:", out.String())
+	}
+	if w.skipped[kindEngagement] != 1 || w.skipped[kindReview] != 1 {
+		t.Error("Expected the engagement and review at another user's farm to be skipped got:", w.skipped)
+	}
+
+	kinds := importable(t, out.String())
+	if kinds[kindUser] != 1 || kinds[kindFarm] != 1 || kinds[kindCrop] != 1 || kinds[kindAuthToken] != 1 {
+		t.Error("Expected the user, their farm, its crop and their session got:", kinds)
+	}
+}
+
+func TestFailedExportsLeaveNoFileBehind(t *testing.T) {
+	dir, err := ioutil.TempDir("", "export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "chamba.ndjson")
+
+	_, err = writeExport(path, func(w *exportWriter) error {
+		w.write(kindFarm, exportFarm(api.Farm{Name: "Sunrise Orchard"}))
+		return errors.New("connection lost")
+	})
+	if err == nil {
+		t.Error("Expected the export to fail")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("Expected the partial export to be removed got:", err)
+	}
+
+	w, err := writeExport(path, func(w *exportWriter) error {
+		return w.write(kindFarm, exportFarm(api.Farm{Name: "Sunrise Orchard"}))
+	})
+	if err != nil || w.counts[kindFarm] != 1 {
+		t.Fatal("Expected the export to be written got:", err)
+	}
+	if written, _ := ioutil.ReadFile(path); !strings.Contains(string(written), "Sunrise Orchard") {
+		t.Error("Expected the export to be flushed to the file got:", string(written))
+	}
+}
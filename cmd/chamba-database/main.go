@@ -1,8 +1,11 @@
 package main
 
 import (
+	"context"
+	"database/sql"
 	"fmt"
 	"os"
+	"strconv"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
@@ -13,36 +16,113 @@ var (
 	usage = fmt.Sprintf(`Usage: %s COMMAND
 The flags available are a subset of the POSIX ones, but should behave similarly.
 Valid commands:
- nuke  - Nuke the database and migrate back to ground zero
- migrate - Migrate the database to the latest schema
+ nuke [--yes] [--backup FILE] - Roll back every migration and migrate back to ground zero.
+       Refused when GOENV is production. Asks for the database name unless --yes
+       is given and writes a pg_dump to FILE first when --backup is given
+ migrate up - Apply every pending migration, the same as migrate on its own
+ migrate down N - Roll back the last N migrations
+ migrate status - List the migrations and whether they have been applied
+ migrate create NAME - Write empty up and down files for a new migration
+ seed [--size small|medium|large] [--seed N] - Fill the database with made up users,
+       farms, crops, reviews and tasks. The same seed gives the same data and every
+       seeded user signs in with the password chamba-seed-password
+ export [--output FILE] [--user EMAIL] [--include-secrets] - Write users, farms,
+       addresses, crops, engagements and reviews as newline delimited JSON. Password
+       hashes, two factor secrets and sessions are left out unless --include-secrets
+       is given. --user only exports the data of the user with EMAIL
+ import FILE - Restore an export, - reads it from stdin. Records get new ids and
+       the references between them are kept. Users exported without their password
+       hash need to reset it
+ promote EMAIL ROLE - Give the user with EMAIL the role worker, farm_owner or admin
+
+Migrations are read from MIGRATIONS_DIR which defaults to ./migrations
 `, os.Args[0])
 )
 
-func nuke() {
-	db := api.GetDB()
-	db.LogMode(true)
-	db.DropTableIfExists(
-		&api.User{},
-		&api.AuthToken{},
-		&api.Address{},
-		&api.Farm{})
-	migrate()
+func nuke(args []string) {
+	options, err := parseNukeOptions(args)
+	if err != nil {
+		log.Fatal(err, "\n", usage)
+	}
+	if err := guardNuke(options, os.Getenv("GOENV"), os.Getenv("DATABASE_URL"), os.Stdin, os.Stdout); err != nil {
+		log.Fatal(err)
+	}
+
+	migrations := mustLoadMigrations()
+	err = withMigrationLock(api.GetDB().DB(), func(ctx context.Context, conn *sql.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+		if err := migrateDown(ctx, conn, migrations, len(applied)); err != nil {
+			return err
+		}
+		return migrateUp(ctx, conn, migrations)
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
 }
 
-func migrate() {
-	startedAt := time.Now()
-	log.Info("Starting database migration")
-	db := api.GetDB()
-	// TODO(dana) :: implement how to automagically discover these additional
-	// structs perhaps have those structs inherit an interface or something?
-	// TODO(dana) :: Add command line options
-	db.LogMode(true)
+func mustLoadMigrations() []migration {
+	migrations, err := loadMigrations(migrationsDir())
+	if err != nil {
+		log.Fatal(err)
+	}
+	return migrations
+}
 
-	db.AutoMigrate(
-		&api.User{},
-		&api.AuthToken{},
-		&api.Address{},
-		&api.Farm{})
+func migrate(args []string) {
+	subcommand := "up"
+	if len(args) > 0 {
+		subcommand = args[0]
+	}
+
+	startedAt := time.Now()
+	var err error
+	switch {
+	case subcommand == "up" && len(args) <= 1:
+		log.Info("Starting database migration")
+		migrations := mustLoadMigrations()
+		err = withMigrationLock(api.GetDB().DB(), func(ctx context.Context, conn *sql.Conn) error {
+			return migrateUp(ctx, conn, migrations)
+		})
+	case subcommand == "down" && len(args) == 2:
+		n, parseErr := strconv.Atoi(args[1])
+		if parseErr != nil || n < 1 {
+			log.Fatal(usage)
+		}
+		log.WithField("count", n).Info("Rolling back database migrations")
+		migrations := mustLoadMigrations()
+		err = withMigrationLock(api.GetDB().DB(), func(ctx context.Context, conn *sql.Conn) error {
+			return migrateDown(ctx, conn, migrations, n)
+		})
+	case subcommand == "status" && len(args) == 1:
+		migrations := mustLoadMigrations()
+		err = withMigrationLock(api.GetDB().DB(), func(ctx context.Context, conn *sql.Conn) error {
+			applied, err := appliedMigrations(ctx, conn)
+			if err != nil {
+				return err
+			}
+			return writeMigrationStatus(os.Stdout, migrations, applied)
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	case subcommand == "create" && len(args) == 2:
+		up, down, err := createMigration(migrationsDir(), args[1])
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.WithFields(log.Fields{"up": up, "down": down}).Info("Created migration")
+		return
+	default:
+		log.Fatal(usage)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	finishedAt := time.Now()
 	duration := finishedAt.Sub(startedAt)
@@ -52,9 +132,25 @@ func migrate() {
 		"took":        duration.Seconds()}).Info("Finished database migration")
 }
 
-// chamba-database command is a cmd for controlling the database
-// at the moment we simply run migrations on the database that is specified by
-// DATABASE_URL.
+// promote gives a user a new role. It is how the first admin is created
+func promote(email, role string) {
+	if role != api.RoleWorker && role != api.RoleFarmOwner && role != api.RoleAdmin {
+		log.Fatal(usage)
+	}
+
+	db := api.GetDB()
+	result := db.Model(&api.User{}).Where(api.User{PrimaryEmail: email}).UpdateColumn("role", role)
+	if result.Error != nil {
+		log.Fatal(result.Error)
+	}
+	if result.RowsAffected == 0 {
+		log.Fatalf("No user found with email %s", email)
+	}
+	log.WithFields(log.Fields{"email": email, "role": role}).Info("Promoted user")
+}
+
+// chamba-database command is a cmd for controlling the database specified by
+// DATABASE_URL. It runs the versioned SQL migrations and manages users.
 func main() {
 	if len(os.Args) == 1 {
 		log.Fatal(usage)
@@ -63,9 +159,20 @@ func main() {
 	command := os.Args[1]
 	switch command {
 	case "nuke":
-		nuke()
+		nuke(os.Args[2:])
 	case "migrate":
-		migrate()
+		migrate(os.Args[2:])
+	case "seed":
+		seed(os.Args[2:])
+	case "export":
+		export(os.Args[2:])
+	case "import":
+		importData(os.Args[2:])
+	case "promote":
+		if len(os.Args) != 4 {
+			log.Fatal(usage)
+		}
+		promote(os.Args[2], os.Args[3])
 	default:
 		log.Fatal(usage)
 	}
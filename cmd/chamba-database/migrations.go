@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// migrationLockID is the advisory lock every chamba-database process takes
+// before touching the schema so two deploys never migrate at the same time
+const migrationLockID = 8675309
+
+// Migrations are pairs of files named like 0002_add_farm_region.up.sql and
+// 0002_add_farm_region.down.sql. The number orders them
+var migrationFilePattern = regexp.MustCompile(`^(\d+)_([a-z0-9_]+)\.(up|down)\.sql$`)
+
+// migration is a numbered change to the schema with the SQL to apply and revert it
+type migration struct {
+	Version int64
+	Name    string
+	Up      string
+	Down    string
+}
+
+// appliedMigration is a row of the schema_migrations table
+type appliedMigration struct {
+	Version   int64
+	Name      string
+	AppliedAt time.Time
+}
+
+// migrationsDir is where migration files are read from and created in
+func migrationsDir() string {
+	if dir := os.Getenv("MIGRATIONS_DIR"); dir != "" {
+		return dir
+	}
+	return "migrations"
+}
+
+// loadMigrations reads every migration in dir ordered by version. Each version
+// needs an up file, the down file is optional for changes that cannot be undone
+func loadMigrations(dir string) ([]migration, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int64]*migration{}
+	for _, file := range files {
+		match := migrationFilePattern.FindStringSubmatch(file.Name())
+		if match == nil {
+			continue
+		}
+		version, err := strconv.ParseInt(match[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", file.Name(), err)
+		}
+		contents, err := ioutil.ReadFile(filepath.Join(dir, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		}
+		if m.Name != match[2] {
+			return nil, fmt.Errorf("Migration %d is named both %s and %s", version, m.Name, match[2])
+		}
+		if match[3] == "up" {
+			m.Up = string(contents)
+		} else {
+			m.Down = string(contents)
+		}
+	}
+
+	migrations := []migration{}
+	for _, m := range byVersion {
+		if strings.TrimSpace(m.Up) == "" {
+			return nil, fmt.Errorf("Migration %d_%s has no up file", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+var migrationNameCleaner = regexp.MustCompile(`[^a-z0-9]+`)
+
+// createMigration writes empty up and down files for a new migration numbered
+// after the last one in dir and returns their paths
+func createMigration(dir, name string) (up, down string, err error) {
+	name = strings.Trim(migrationNameCleaner.ReplaceAllString(strings.ToLower(name), "_"), "_")
+	if name == "" {
+		return "", "", fmt.Errorf("Migration name must contain letters or numbers")
+	}
+
+	migrations, err := loadMigrations(dir)
+	if err != nil {
+		return
+	}
+	version := int64(1)
+	if len(migrations) > 0 {
+		version = migrations[len(migrations)-1].Version + 1
+	}
+
+	base := filepath.Join(dir, fmt.Sprintf("%04d_%s", version, name))
+	up, down = base+".up.sql", base+".down.sql"
+	for _, file := range []struct {
+		path    string
+		comment string
+	}{
+		{up, "-- Write the SQL that applies this migration here\n"},
+		{down, "-- Write the SQL that reverts this migration here. Leave it empty if it cannot be undone\n"},
+	} {
+		f, err := os.OpenFile(file.path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err != nil {
+			return "", "", err
+		}
+		_, err = io.WriteString(f, file.comment)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return "", "", err
+		}
+	}
+	return
+}
+
+// withMigrationLock runs fn holding the advisory lock. Advisory locks belong to
+// a connection so fn is handed the one the lock was taken on
+func withMigrationLock(db *sql.DB, fn func(ctx context.Context, conn *sql.Conn) error) error {
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	log.Info("Waiting for the migration lock")
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", migrationLockID); err != nil {
+		return err
+	}
+	defer conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", migrationLockID)
+
+	_, err = conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version bigint PRIMARY KEY,
+		name text NOT NULL,
+		applied_at timestamp with time zone NOT NULL DEFAULT now()
+	)`)
+	if err != nil {
+		return err
+	}
+	return fn(ctx, conn)
+}
+
+// appliedMigrations lists the migrations recorded in schema_migrations oldest first
+func appliedMigrations(ctx context.Context, conn *sql.Conn) ([]appliedMigration, error) {
+	rows, err := conn.QueryContext(ctx, "SELECT version, name, applied_at FROM schema_migrations ORDER BY version")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := []appliedMigration{}
+	for rows.Next() {
+		m := appliedMigration{}
+		if err := rows.Scan(&m.Version, &m.Name, &m.AppliedAt); err != nil {
+			return nil, err
+		}
+		applied = append(applied, m)
+	}
+	return applied, rows.Err()
+}
+
+// runMigration applies or reverts a migration and records it in a single
+// transaction so a failure leaves nothing half done
+func runMigration(ctx context.Context, conn *sql.Conn, statements, record string, args ...interface{}) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, statements); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, record, args...); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// migrateUp applies every migration that has not been applied yet in order
+func migrateUp(ctx context.Context, conn *sql.Conn, migrations []migration) error {
+	applied, err := appliedMigrations(ctx, conn)
+	if err != nil {
+		return err
+	}
+	done := map[int64]bool{}
+	for _, m := range applied {
+		done[m.Version] = true
+	}
+
+	for _, m := range migrations {
+		if done[m.Version] {
+			continue
+		}
+		startedAt := time.Now()
+		err := runMigration(ctx, conn, m.Up, "INSERT INTO schema_migrations (version, name) VALUES ($1, $2)", m.Version, m.Name)
+		if err != nil {
+			return fmt.Errorf("Migration %d_%s failed: %v", m.Version, m.Name, err)
+		}
+		log.WithFields(log.Fields{
+			"version": m.Version,
+			"name":    m.Name,
+			"took":    time.Since(startedAt).Seconds()}).Info("Applied migration")
+	}
+	return nil
+}
+
+// migrateDown reverts the last n applied migrations newest first
+func migrateDown(ctx context.Context, conn *sql.Conn, migrations []migration, n int) error {
+	applied, err := appliedMigrations(ctx, conn)
+	if err != nil {
+		return err
+	}
+	if n > len(applied) {
+		return fmt.Errorf("Only %d migrations have been applied, cannot roll back %d", len(applied), n)
+	}
+
+	files := map[int64]migration{}
+	for _, m := range migrations {
+		files[m.Version] = m
+	}
+
+	for i := len(applied) - 1; i >= len(applied)-n; i-- {
+		m, ok := files[applied[i].Version]
+		if !ok {
+			return fmt.Errorf("Migration %d_%s has no files to roll back with", applied[i].Version, applied[i].Name)
+		}
+		if strings.TrimSpace(m.Down) == "" {
+			return fmt.Errorf("Migration %d_%s cannot be rolled back", m.Version, m.Name)
+		}
+
+		startedAt := time.Now()
+		err := runMigration(ctx, conn, m.Down, "DELETE FROM schema_migrations WHERE version = $1", m.Version)
+		if err != nil {
+			return fmt.Errorf("Rolling back %d_%s failed: %v", m.Version, m.Name, err)
+		}
+		log.WithFields(log.Fields{
+			"version": m.Version,
+			"name":    m.Name,
+			"took":    time.Since(startedAt).Seconds()}).Info("Rolled back migration")
+	}
+	return nil
+}
+
+// writeMigrationStatus lists every migration and when it was applied. Versions
+// recorded in the database without a file are listed as missing
+func writeMigrationStatus(w io.Writer, migrations []migration, applied []appliedMigration) error {
+	appliedAt := map[int64]appliedMigration{}
+	for _, m := range applied {
+		appliedAt[m.Version] = m
+	}
+
+	table := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "VERSION\tNAME\tSTATUS\tAPPLIED AT")
+	for _, m := range migrations {
+		if a, ok := appliedAt[m.Version]; ok {
+			fmt.Fprintf(table, "%04d\t%s\tapplied\t%s\n", m.Version, m.Name, a.AppliedAt.Format(time.RFC3339))
+			delete(appliedAt, m.Version)
+		} else {
+			fmt.Fprintf(table, "%04d\t%s\tpending\t\n", m.Version, m.Name)
+		}
+	}
+	for _, a := range applied {
+		if _, ok := appliedAt[a.Version]; ok {
+			fmt.Fprintf(table, "%04d\t%s\tmissing\t%s\n", a.Version, a.Name, a.AppliedAt.Format(time.RFC3339))
+		}
+	}
+	return table.Flush()
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeMigrationFiles(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "migrations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, contents := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestLoadMigrationsOrdersByVersion(t *testing.T) {
+	dir := writeMigrationFiles(t, map[string]string{
+		"0010_add_farm_region.up.sql":   "ALTER TABLE farms ADD COLUMN region text;",
+		"0010_add_farm_region.down.sql": "ALTER TABLE farms DROP COLUMN region;",
+		"0002_widen_notes.up.sql":       "ALTER TABLE tasks ALTER COLUMN description TYPE text;",
+		"0001_baseline.up.sql":          "CREATE TABLE users (id serial);",
+		"0001_baseline.down.sql":        "DROP TABLE users;",
+		"README.md":                     "not a migration",
+	})
+	defer os.RemoveAll(dir)
+
+	migrations, err := loadMigrations(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var expected = []struct {
+		version int64
+		name    string
+		hasDown bool
+	}{
+		{1, "baseline", true},
+		{2, "widen_notes", false},
+		{10, "add_farm_region", true},
+	}
+	if len(migrations) != len(expected) {
+		t.Fatal("Expected 3 migrations got:", migrations)
+	}
+	for i, m := range expected {
+		if migrations[i].Version != m.version || migrations[i].Name != m.name || (migrations[i].Down != "") != m.hasDown {
+			t.Errorf("Expected migration %d_%s got %d_%s", m.version, m.name, migrations[i].Version, migrations[i].Name)
+		}
+	}
+}
+
+func TestLoadMigrationsRejectsBrokenPairs(t *testing.T) {
+	var testCases = []struct {
+		files  map[string]string
+		reason string
+	}{
+		{map[string]string{"0001_baseline.down.sql": "DROP TABLE users;"}, "No up file"},
+		{map[string]string{"0001_baseline.up.sql": "  \n"}, "Empty up file"},
+		{map[string]string{"0001_baseline.up.sql": "SELECT 1;", "0001_other.up.sql": "SELECT 1;"}, "Two names for one version"},
+	}
+
+	for _, testCase := range testCases {
+		dir := writeMigrationFiles(t, testCase.files)
+		if _, err := loadMigrations(dir); err == nil {
+			t.Error("Expected an error reason", testCase.reason)
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+func TestCreateMigrationNumbersAfterTheLast(t *testing.T) {
+	dir := writeMigrationFiles(t, map[string]string{"0007_baseline.up.sql": "SELECT 1;"})
+	defer os.RemoveAll(dir)
+
+	up, down, err := createMigration(dir, "Add Farm Region!")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Base(up) != "0008_add_farm_region.up.sql" || filepath.Base(down) != "0008_add_farm_region.down.sql" {
+		t.Error("Expected the files to be numbered 0008 got:", up, down)
+	}
+
+	migrations, err := loadMigrations(dir)
+	if err != nil || len(migrations) != 2 {
+		t.Error("Expected the new migration to load got:", migrations, err)
+	}
+
+	if _, _, err := createMigration(dir, "!!!"); err == nil {
+		t.Error("Expected a name without letters or numbers to be rejected")
+	}
+}
+
+func TestMigrationStatusListsPendingAndMissing(t *testing.T) {
+	appliedAt := time.Date(2016, 5, 1, 12, 0, 0, 0, time.UTC)
+	migrations := []migration{{Version: 1, Name: "baseline"}, {Version: 2, Name: "add_farm_region"}}
+	applied := []appliedMigration{{1, "baseline", appliedAt}, {3, "deleted_file", appliedAt}}
+
+	out := bytes.Buffer{}
+	if err := writeMigrationStatus(&out, migrations, applied); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []string{
+		"0001     baseline         applied  2016-05-01T12:00:00Z",
+		"0002     add_farm_region  pending",
+		"0003     deleted_file     missing  2016-05-01T12:00:00Z",
+	} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("Expected status to contain %q got:\n%s", expected, out.String())
+		}
+	}
+}
+
+func TestRepositoryMigrationsLoad(t *testing.T) {
+	migrations, err := loadMigrations(filepath.Join("..", "..", "migrations"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(migrations) == 0 || migrations[0].Name != "baseline" || migrations[0].Down == "" {
+		t.Error("Expected the baseline migration first got:", migrations)
+	}
+}
+
+// originalSchema is every column the first AutoMigrate based migrate command
+// created, databases from then are upgraded by the baseline
+var originalSchema = map[string][]string{
+	"users":       {"id", "created_at", "updated_at", "deleted_at", "first_name", "last_name", "user_name", "primary_email", "password", "type", "farm_id", "category"},
+	"auth_tokens": {"id", "created_at", "updated_at", "deleted_at", "user_id", "token", "expiry"},
+	"addresses":   {"id", "created_at", "updated_at", "deleted_at", "farm_id", "user_id", "latitude", "longitude", "city", "postal_or_zip_code", "province_or_state"},
+	"farms":       {"id", "created_at", "updated_at", "deleted_at", "name", "description"},
+}
+
+func TestBaselineUpgradesTheOriginalSchema(t *testing.T) {
+	migrations, err := loadMigrations(filepath.Join("..", "..", "migrations"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	baseline := migrations[0].Up
+
+	for table, original := range originalSchema {
+		existing := map[string]bool{}
+		for _, column := range original {
+			existing[column] = true
+		}
+
+		create := regexp.MustCompile(`(?s)CREATE TABLE IF NOT EXISTS ` + table + ` \((.*?)\n\);`).FindStringSubmatch(baseline)
+		if create == nil {
+			t.Fatal("Expected the baseline to create", table)
+		}
+		for _, line := range strings.Split(create[1], "\n") {
+			fields := strings.Fields(line)
+			if len(fields) == 0 || fields[0] == "PRIMARY" || existing[fields[0]] {
+				continue
+			}
+			column := fields[0]
+			definition := strings.TrimSuffix(strings.TrimSpace(line), ",")
+
+			added := regexp.MustCompile(`ALTER TABLE ` + table + `\b[^;]*ADD COLUMN (IF NOT EXISTS )?(` + column + ` [^,;]*)`).FindStringSubmatchIndex(baseline)
+			if added == nil {
+				t.Errorf("Expected %s.%s to be added to databases from the original schema", table, column)
+				continue
+			}
+			if got := baseline[added[4]:added[5]]; got != definition {
+				t.Errorf("Expected %s.%s to be added as %q got: %q", table, column, definition, got)
+			}
+			if indexed := strings.Index(baseline, "ON "+table+" ("+column); indexed != -1 && indexed < added[0] {
+				t.Errorf("Expected %s.%s to be added before it is indexed", table, column)
+			}
+		}
+	}
+
+	if !strings.Contains(baseline, "UPDATE users SET email_verified_at = created_at") {
+		t.Error("Expected users from before email verification to be marked verified")
+	}
+	// Users that already had the nullable column AutoMigrate added are given
+	// the default so their first code is accepted
+	if !strings.Contains(baseline, "UPDATE users SET totp_last_step = 0 WHERE totp_last_step IS NULL") ||
+		!strings.Contains(baseline, "ALTER COLUMN totp_last_step SET NOT NULL") {
+		t.Error("Expected users with no TOTP step to be upgraded to step 0")
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// nukeOptions are the flags nuke accepts
+type nukeOptions struct {
+	Yes    bool
+	Backup string
+}
+
+func parseNukeOptions(args []string) (nukeOptions, error) {
+	options := nukeOptions{}
+	flags := flag.NewFlagSet("nuke", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	flags.BoolVar(&options.Yes, "yes", false, "Skip the confirmation prompt")
+	flags.StringVar(&options.Backup, "backup", "", "Write a pg_dump of the database to this file first")
+	if err := flags.Parse(args); err != nil {
+		return options, err
+	}
+	if flags.NArg() > 0 {
+		return options, fmt.Errorf("Unexpected arguments %v", flags.Args())
+	}
+	return options, nil
+}
+
+// databaseTarget is the host and database a connection string points at
+type databaseTarget struct {
+	Host string
+	Name string
+}
+
+func (t databaseTarget) String() string {
+	return fmt.Sprintf("%s on %s", t.Name, t.Host)
+}
+
+// parseDatabaseTarget reads the host and database name out of a connection
+// string in either the URL or the key=value form lib/pq accepts. Anything left
+// out falls back to the PG* environment variables and defaults pq uses
+func parseDatabaseTarget(connection string) (databaseTarget, error) {
+	settings := map[string]string{}
+	if strings.HasPrefix(connection, "postgres://") || strings.HasPrefix(connection, "postgresql://") {
+		u, err := url.Parse(connection)
+		if err != nil {
+			return databaseTarget{}, err
+		}
+		settings["host"] = u.Hostname()
+		settings["dbname"] = strings.TrimPrefix(u.Path, "/")
+		if u.User != nil {
+			settings["user"] = u.User.Username()
+		}
+	} else {
+		for _, field := range strings.Fields(connection) {
+			parts := strings.SplitN(field, "=", 2)
+			if len(parts) != 2 {
+				return databaseTarget{}, fmt.Errorf("Cannot parse %q in the connection string", field)
+			}
+			settings[parts[0]] = strings.Trim(parts[1], "'")
+		}
+	}
+
+	setting := func(key, env, fallback string) string {
+		if settings[key] != "" {
+			return settings[key]
+		}
+		if value := os.Getenv(env); value != "" {
+			return value
+		}
+		return fallback
+	}
+	target := databaseTarget{Host: setting("host", "PGHOST", "localhost")}
+	target.Name = setting("dbname", "PGDATABASE", setting("user", "PGUSER", ""))
+	if target.Name == "" {
+		return target, fmt.Errorf("Cannot tell which database the connection string points at")
+	}
+	return target, nil
+}
+
+// isProduction is true when GOENV says we are running against production
+func isProduction(goenv string) bool {
+	goenv = strings.ToLower(strings.TrimSpace(goenv))
+	return goenv == "production" || goenv == "prod"
+}
+
+// confirmNuke asks whoever is at the terminal to type the name of the database
+// they are about to wipe. Anything else, including no answer at all, is a no
+func confirmNuke(in io.Reader, out io.Writer, target databaseTarget) bool {
+	fmt.Fprintf(out, "This drops every table in the database %s and migrates it back to an empty schema.\n", target)
+	fmt.Fprintf(out, "Type the database name to continue: ")
+	answer, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && answer == "" {
+		fmt.Fprintln(out)
+		return false
+	}
+	return strings.TrimSpace(answer) == target.Name
+}
+
+// backupDatabase writes a plain SQL logical backup of the database with pg_dump
+func backupDatabase(connection, path string) error {
+	if _, err := exec.LookPath("pg_dump"); err != nil {
+		return fmt.Errorf("Cannot take a backup, pg_dump was not found: %v", err)
+	}
+	cmd := exec.Command("pg_dump", "--format=plain", "--no-owner", "--file", path, "--dbname", connection)
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		os.Remove(path)
+		return fmt.Errorf("pg_dump failed: %v", err)
+	}
+	return nil
+}
+
+// guardNuke runs every check that has to pass before nuke touches the database.
+// It refuses production outright, takes the backup if one was asked for and
+// otherwise needs --yes or the database name typed back at the prompt
+func guardNuke(options nukeOptions, goenv, connection string, in io.Reader, out io.Writer) error {
+	if isProduction(goenv) {
+		return fmt.Errorf("Refusing to nuke the database with GOENV=%s", goenv)
+	}
+	target, err := parseDatabaseTarget(connection)
+	if err != nil {
+		return err
+	}
+	if !options.Yes && !confirmNuke(in, out, target) {
+		return fmt.Errorf("Not nuking %s, the database name did not match", target)
+	}
+
+	log.WithFields(log.Fields{"host": target.Host, "database": target.Name}).Warn("Nuking database")
+	if options.Backup != "" {
+		if err := backupDatabase(connection, options.Backup); err != nil {
+			return err
+		}
+		log.WithField("file", options.Backup).Info("Backed up database")
+	}
+	return nil
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/dklassen/chamba/api"
+	"github.com/jinzhu/gorm"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// seedPassword signs in as any seeded user
+const seedPassword = "chamba-seed-password"
+
+// seedEmailDomain is used for every seeded email address so seeded users are
+// easy to tell apart from real ones
+const seedEmailDomain = "seed.chamba.dev"
+
+// seedPreset decides how much data seed generates. Every farm has its own owner
+type seedPreset struct {
+	Workers            int
+	Farms              int
+	CropsPerFarm       int
+	EngagementsPerFarm int
+	TasksPerFarm       int
+}
+
+var seedPresets = map[string]seedPreset{
+	"small":  {Workers: 25, Farms: 5, CropsPerFarm: 3, EngagementsPerFarm: 4, TasksPerFarm: 6},
+	"medium": {Workers: 500, Farms: 100, CropsPerFarm: 4, EngagementsPerFarm: 8, TasksPerFarm: 10},
+	"large":  {Workers: 10000, Farms: 5000, CropsPerFarm: 5, EngagementsPerFarm: 10, TasksPerFarm: 10},
+}
+
+// seedOptions are the flags seed accepts
+type seedOptions struct {
+	Size string
+	Seed int64
+}
+
+func parseSeedOptions(args []string) (seedOptions, error) {
+	options := seedOptions{}
+	flags := flag.NewFlagSet("seed", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	flags.StringVar(&options.Size, "size", "small", "One of small, medium or large")
+	flags.Int64Var(&options.Seed, "seed", 1, "Generating with the same seed gives the same data")
+	if err := flags.Parse(args); err != nil {
+		return options, err
+	}
+	if flags.NArg() > 0 {
+		return options, fmt.Errorf("Unexpected arguments %v", flags.Args())
+	}
+	if _, ok := seedPresets[options.Size]; !ok {
+		return options, fmt.Errorf("Unknown size %q, expected small, medium or large", options.Size)
+	}
+	return options, nil
+}
+
+// seedRegion is somewhere seeded farms and workers are spread around
+type seedRegion struct {
+	City            string
+	ProvinceOrState string
+	PostalOrZipCode string
+	Latitude        float64
+	Longitude       float64
+}
+
+var (
+	seedRegions = []seedRegion{
+		{"Kelowna", "BC", "V1Y 1A1", 49.887952, -119.496011},
+		{"Abbotsford", "BC", "V2S 1A1", 49.050441, -122.304475},
+		{"Leamington", "ON", "N8H 1A1", 42.053424, -82.599870},
+		{"Niagara-on-the-Lake", "ON", "L0S 1J0", 43.254859, -79.071839},
+		{"Saint-Rémi", "QC", "J0L 2L0", 45.263390, -73.616150},
+		{"Kentville", "NS", "B4N 1A1", 45.077130, -64.495820},
+		{"Salinas", "CA", "93901", 36.677737, -121.655501},
+		{"Yakima", "WA", "98901", 46.602071, -120.505899},
+	}
+	seedFirstNames = []string{"Ana", "Luis", "Mark", "Sofia", "Jun", "Amara", "Diego", "Noor", "Emma", "Tomas", "Priya", "Kofi", "Lena", "Mateo", "Yuki", "Omar"}
+	seedLastNames  = []string{"Twain", "Garcia", "Nguyen", "Okafor", "Silva", "Kowalski", "Haddad", "Murphy", "Tanaka", "Reyes", "Larsen", "Mensah", "Dubois", "Patel"}
+	seedFarmWords  = []string{"Orchard", "Acres", "Fields", "Valley", "Ridge", "Creek", "Meadow", "Hollow", "Grove", "Vineyard"}
+	seedFarmNames  = []string{"Sunrise", "Cedar", "Blue Heron", "Red Barn", "Willow", "Stony", "Golden", "Old Mill", "Maple", "Riverbend"}
+	seedCrops      = []struct {
+		Name   string
+		Season string
+		Month  time.Month // when the harvest starts
+		Weeks  int        // how long the harvest lasts
+	}{
+		{"Strawberries", "summer", time.June, 4},
+		{"Blueberries", "summer", time.July, 6},
+		{"Cherries", "summer", time.July, 3},
+		{"Apples", "fall", time.September, 8},
+		{"Pears", "fall", time.August, 6},
+		{"Grapes", "fall", time.September, 6},
+		{"Pumpkins", "fall", time.October, 3},
+		{"Asparagus", "spring", time.May, 6},
+		{"Lettuce", "spring", time.April, 10},
+		{"Tomatoes", "summer", time.July, 10},
+	}
+	seedTaskTitles = []string{"Pick the north rows", "Prune the orchard", "Fix the irrigation line", "Pack boxes for market", "Weed the beds", "Load the truck", "Mend the fence", "Sort the harvest"}
+	seedComments   = []string{"Great to work with", "Would come back", "Long days but fair", "Well organised", "Friendly crew", ""}
+)
+
+// seedEngagement is a worker's time on a seeded farm with the reviews left after
+type seedEngagement struct {
+	Worker       int // index into seedData.Users
+	CompletedAt  *time.Time
+	FarmReview   *api.Review
+	WorkerReview *api.Review
+}
+
+// seedTask is a task on a seeded farm assigned to one of its workers
+type seedTask struct {
+	Assignee int // index into seedData.Users, -1 when unassigned
+	Task     api.Task
+}
+
+// seedFarm is a farm with its address and crops and everything that refers to
+// the users by their index until they have ids
+type seedFarm struct {
+	Owner       int // index into seedData.Users
+	Farm        api.Farm
+	Engagements []seedEngagement
+	Tasks       []seedTask
+}
+
+// seedData is everything seed inserts
+type seedData struct {
+	Users []api.User
+	Farms []seedFarm
+}
+
+// seedGenerator makes up data from a seeded source so the same seed always
+// generates the same data
+type seedGenerator struct {
+	rand *rand.Rand
+	now  time.Time
+}
+
+func (g seedGenerator) pick(choices []string) string {
+	return choices[g.rand.Intn(len(choices))]
+}
+
+// sample picks k different numbers below n without shuffling all of them since
+// n is the number of workers and can be large
+func (g seedGenerator) sample(n, k int) []int {
+	if 2*k > n {
+		return g.rand.Perm(n)[:k]
+	}
+	picked, seen := []int{}, map[int]bool{}
+	for len(picked) < k {
+		if i := g.rand.Intn(n); !seen[i] {
+			seen[i] = true
+			picked = append(picked, i)
+		}
+	}
+	return picked
+}
+
+// address is somewhere within roughly 50km of one of the regions
+func (g seedGenerator) address() api.Address {
+	region := seedRegions[g.rand.Intn(len(seedRegions))]
+	jitter := func() float64 { return math.Round((g.rand.Float64()-0.5)*1e6) / 1e6 }
+	return api.Address{
+		City:            region.City,
+		ProvinceOrState: region.ProvinceOrState,
+		PostalOrZipCode: region.PostalOrZipCode,
+		Latitude:        region.Latitude + jitter(),
+		Longitude:       region.Longitude + jitter(),
+	}
+}
+
+func (g seedGenerator) user(i int, role string) api.User {
+	first, last := g.pick(seedFirstNames), g.pick(seedLastNames)
+	userName := strings.ToLower(fmt.Sprintf("%s.%s.%d", first, last, i))
+	verifiedAt := g.now.Add(-time.Duration(g.rand.Intn(365*24)) * time.Hour)
+	return api.User{
+		FirstName:       first,
+		LastName:        last,
+		UserName:        userName,
+		PrimaryEmail:    userName + "@" + seedEmailDomain,
+		Role:            role,
+		EmailVerifiedAt: &verifiedAt,
+		Address:         g.address(),
+	}
+}
+
+// stars leans towards good reviews like real ones do
+func (g seedGenerator) stars() int {
+	return []int{1, 2, 3, 3, 4, 4, 4, 5, 5, 5}[g.rand.Intn(10)]
+}
+
+func (g seedGenerator) farm(preset seedPreset, owner int, workers []int) seedFarm {
+	farm := seedFarm{Owner: owner}
+	farm.Farm = api.Farm{
+		Name:        fmt.Sprintf("%s %s", g.pick(seedFarmNames), g.pick(seedFarmWords)),
+		Description: "A family farm looking for hands at harvest",
+		Address:     g.address(),
+	}
+
+	for _, i := range g.sample(len(seedCrops), preset.CropsPerFarm) {
+		crop := seedCrops[i]
+		start := time.Date(g.now.Year(), crop.Month, 1+g.rand.Intn(28), 0, 0, 0, 0, time.UTC)
+		end := start.AddDate(0, 0, 7*crop.Weeks)
+		farm.Farm.Crops = append(farm.Farm.Crops, api.Crop{Name: crop.Name, Season: crop.Season, HarvestStart: &start, HarvestEnd: &end})
+	}
+
+	engaged := []int{}
+	for _, i := range g.sample(len(workers), preset.EngagementsPerFarm) {
+		engagement := seedEngagement{Worker: workers[i]}
+		engaged = append(engaged, workers[i])
+		if g.rand.Intn(5) > 0 {
+			completedAt := g.now.Add(-time.Duration(1+g.rand.Intn(365*24)) * time.Hour)
+			engagement.CompletedAt = &completedAt
+			if g.rand.Intn(10) < 7 {
+				engagement.FarmReview = &api.Review{Kind: api.ReviewOfFarm, Stars: g.stars(), Comment: g.pick(seedComments)}
+			}
+			if g.rand.Intn(10) < 7 {
+				engagement.WorkerReview = &api.Review{Kind: api.ReviewOfWorker, Stars: g.stars(), Comment: g.pick(seedComments)}
+			}
+		}
+		farm.Engagements = append(farm.Engagements, engagement)
+	}
+
+	for i := 0; i < preset.TasksPerFarm; i++ {
+		task := seedTask{Assignee: -1, Task: api.Task{Title: g.pick(seedTaskTitles), Status: api.TaskOpen}}
+		if len(engaged) > 0 && g.rand.Intn(3) > 0 {
+			task.Assignee = engaged[g.rand.Intn(len(engaged))]
+			startedAt := g.now.Add(-time.Duration(24+g.rand.Intn(60*24)) * time.Hour)
+			task.Task.Status, task.Task.StartedAt = api.TaskInProgress, &startedAt
+			if g.rand.Intn(2) == 0 {
+				completedAt := startedAt.Add(time.Duration(1+g.rand.Intn(23)) * time.Hour)
+				task.Task.Status, task.Task.CompletedAt = api.TaskDone, &completedAt
+			}
+		}
+		farm.Tasks = append(farm.Tasks, task)
+	}
+	return farm
+}
+
+// generateSeedData makes up the data for a preset. Dates are relative to now so
+// harvests and engagements stay current, otherwise the same preset and seed
+// always give the same data
+func generateSeedData(preset seedPreset, seed int64, now time.Time) seedData {
+	g := seedGenerator{rand: rand.New(rand.NewSource(seed)), now: now}
+	data := seedData{}
+
+	admin := g.user(0, api.RoleAdmin)
+	admin.UserName, admin.PrimaryEmail = "admin", "admin@"+seedEmailDomain
+	data.Users = append(data.Users, admin)
+
+	workers := []int{}
+	for i := 0; i < preset.Workers; i++ {
+		workers = append(workers, len(data.Users))
+		data.Users = append(data.Users, g.user(len(data.Users), api.RoleWorker))
+	}
+	if preset.EngagementsPerFarm > len(workers) {
+		preset.EngagementsPerFarm = len(workers)
+	}
+	if preset.CropsPerFarm > len(seedCrops) {
+		preset.CropsPerFarm = len(seedCrops)
+	}
+
+	for i := 0; i < preset.Farms; i++ {
+		owner := len(data.Users)
+		data.Users = append(data.Users, g.user(owner, api.RoleFarmOwner))
+		data.Farms = append(data.Farms, g.farm(preset, owner, workers))
+	}
+	return data
+}
+
+// insertSeedData saves the data in a single transaction so a failed seed
+// leaves nothing behind
+func insertSeedData(db *gorm.DB, data seedData) error {
+	tx := db.Begin()
+	if err := insertSeedRows(tx, data); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+func insertSeedRows(tx *gorm.DB, data seedData) error {
+	for i := range data.Users {
+		// The cheapest bcrypt cost keeps large seeds quick. Every hash still gets
+		// its own salt which the unique index on passwords needs
+		hashed, err := bcrypt.GenerateFromPassword([]byte(seedPassword), bcrypt.MinCost)
+		if err != nil {
+			return err
+		}
+		data.Users[i].Password = string(hashed)
+		if err := tx.Create(&data.Users[i]).Error; err != nil {
+			return fmt.Errorf("Seeding user %s: %v", data.Users[i].PrimaryEmail, err)
+		}
+	}
+
+	for _, farm := range data.Farms {
+		owner := &data.Users[farm.Owner]
+		farm.Farm.OwnerID = owner.ID
+		if err := tx.Create(&farm.Farm).Error; err != nil {
+			return fmt.Errorf("Seeding farm %s: %v", farm.Farm.Name, err)
+		}
+		if err := tx.Model(owner).UpdateColumn("farm_id", farm.Farm.ID).Error; err != nil {
+			return err
+		}
+
+		for _, engagement := range farm.Engagements {
+			worker := data.Users[engagement.Worker]
+			row := api.Engagement{FarmID: farm.Farm.ID, WorkerID: worker.ID, CompletedAt: engagement.CompletedAt}
+			if err := tx.Create(&row).Error; err != nil {
+				return err
+			}
+			for _, review := range []struct {
+				review *api.Review
+				author uint
+			}{{engagement.FarmReview, worker.ID}, {engagement.WorkerReview, owner.ID}} {
+				if review.review == nil {
+					continue
+				}
+				review.review.EngagementID, review.review.AuthorID = row.ID, review.author
+				review.review.FarmID, review.review.WorkerID = farm.Farm.ID, worker.ID
+				if err := tx.Create(review.review).Error; err != nil {
+					return err
+				}
+			}
+		}
+
+		for _, task := range farm.Tasks {
+			task.Task.FarmID = farm.Farm.ID
+			if task.Assignee >= 0 {
+				task.Task.AssigneeID = data.Users[task.Assignee].ID
+			}
+			if err := tx.Create(&task.Task).Error; err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// seed fills the database with made up users, farms, crops, reviews and tasks
+func seed(args []string) {
+	options, err := parseSeedOptions(args)
+	if err != nil {
+		log.Fatal(err, "\n", usage)
+	}
+	if goenv := os.Getenv("GOENV"); isProduction(goenv) {
+		log.Fatalf("Refusing to seed the database with GOENV=%s", goenv)
+	}
+
+	startedAt := time.Now()
+	data := generateSeedData(seedPresets[options.Size], options.Seed, startedAt)
+	if err := insertSeedData(api.GetDB(), data); err != nil {
+		log.Fatal(err, "\nSeeded users already in the database clash with new ones, nuke it first")
+	}
+
+	log.WithFields(log.Fields{
+		"size":     options.Size,
+		"seed":     options.Seed,
+		"users":    len(data.Users),
+		"farms":    len(data.Farms),
+		"password": seedPassword,
+		"took":     time.Since(startedAt).Seconds()}).Info("Seeded database")
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/dklassen/chamba/api"
+)
+
+var seedNow = time.Date(2016, 5, 1, 12, 0, 0, 0, time.UTC)
+
+func TestGenerateSeedDataIsDeterministic(t *testing.T) {
+	preset := seedPresets["small"]
+	first := generateSeedData(preset, 42, seedNow)
+	second := generateSeedData(preset, 42, seedNow)
+	if !reflect.DeepEqual(first, second) {
+		t.Error("Expected the same seed to generate the same data")
+	}
+
+	other := generateSeedData(preset, 43, seedNow)
+	if reflect.DeepEqual(first, other) {
+		t.Error("Expected another seed to generate different data")
+	}
+}
+
+func TestGenerateSeedDataFollowsThePreset(t *testing.T) {
+	for size, preset := range seedPresets {
+		if size == "large" && testing.Short() {
+			continue
+		}
+		data := generateSeedData(preset, 1, seedNow)
+
+		// An admin, the workers and an owner per farm
+		if len(data.Users) != 1+preset.Workers+preset.Farms || len(data.Farms) != preset.Farms {
+			t.Errorf("Expected %d users and %d farms for %s got %d and %d", 1+preset.Workers+preset.Farms, preset.Farms, size, len(data.Users), len(data.Farms))
+		}
+
+		emails := map[string]bool{}
+		for _, user := range data.Users {
+			if emails[user.PrimaryEmail] {
+				t.Errorf("Expected unique emails for %s got %s twice", size, user.PrimaryEmail)
+			}
+			emails[user.PrimaryEmail] = true
+			if !user.IsVerified() {
+				t.Errorf("Expected seeded users to be verified got %s", user.PrimaryEmail)
+			}
+		}
+
+		for _, farm := range data.Farms {
+			if data.Users[farm.Owner].Role != api.RoleFarmOwner {
+				t.Error("Expected farms to be owned by farm owners got:", data.Users[farm.Owner].Role)
+			}
+			if len(farm.Farm.Crops) != preset.CropsPerFarm || len(farm.Engagements) != preset.EngagementsPerFarm || len(farm.Tasks) != preset.TasksPerFarm {
+				t.Errorf("Expected %s farms to follow the preset got %d crops, %d engagements and %d tasks", size, len(farm.Farm.Crops), len(farm.Engagements), len(farm.Tasks))
+			}
+
+			engaged := map[int]bool{}
+			for _, engagement := range farm.Engagements {
+				if engaged[engagement.Worker] || data.Users[engagement.Worker].Role != api.RoleWorker {
+					t.Error("Expected each engagement to be a different worker got:", engagement.Worker)
+				}
+				engaged[engagement.Worker] = true
+				if engagement.CompletedAt == nil && (engagement.FarmReview != nil || engagement.WorkerReview != nil) {
+					t.Error("Expected only completed engagements to be reviewed")
+				}
+			}
+			for _, task := range farm.Tasks {
+				if task.Assignee >= 0 && !engaged[task.Assignee] {
+					t.Error("Expected tasks to be assigned to workers on the farm got:", task.Assignee)
+				}
+				if (task.Task.Status == api.TaskOpen) != (task.Assignee < 0) || (task.Task.Status == api.TaskDone) != (task.Task.CompletedAt != nil) {
+					t.Error("Expected the task status to match its assignee and dates got:", task.Task.Status)
+				}
+			}
+		}
+	}
+}
+
+func TestParseSeedOptions(t *testing.T) {
+	options, err := parseSeedOptions(nil)
+	if err != nil || options.Size != "small" || options.Seed != 1 {
+		t.Error("Expected a small seed of 1 by default got:", options, err)
+	}
+
+	options, err = parseSeedOptions([]string{"--size", "large", "--seed=7"})
+	if err != nil || options.Size != "large" || options.Seed != 7 {
+		t.Error("Expected the size and seed to be parsed got:", options, err)
+	}
+
+	if _, err := parseSeedOptions([]string{"--size", "huge"}); err == nil {
+		t.Error("Expected an unknown size to be rejected")
+	}
+}
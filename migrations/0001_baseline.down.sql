@@ -0,0 +1,20 @@
+-- Rolling back the baseline drops every table along with all of its data
+
+DROP TABLE IF EXISTS oidc_states;
+DROP TABLE IF EXISTS external_identities;
+DROP TABLE IF EXISTS two_factor_challenges;
+DROP TABLE IF EXISTS recovery_codes;
+DROP TABLE IF EXISTS audit_events;
+DROP TABLE IF EXISTS login_attempts;
+DROP TABLE IF EXISTS email_verifications;
+DROP TABLE IF EXISTS password_resets;
+DROP TABLE IF EXISTS applications;
+DROP TABLE IF EXISTS job_postings;
+DROP TABLE IF EXISTS tasks;
+DROP TABLE IF EXISTS reviews;
+DROP TABLE IF EXISTS engagements;
+DROP TABLE IF EXISTS crops;
+DROP TABLE IF EXISTS farms;
+DROP TABLE IF EXISTS addresses;
+DROP TABLE IF EXISTS auth_tokens;
+DROP TABLE IF EXISTS users;
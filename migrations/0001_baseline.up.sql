@@ -0,0 +1,342 @@
+-- The schema as the AutoMigrate based migrate command last left it. Every
+-- statement is guarded so it also upgrades databases that command created at
+-- any earlier version. Tables are only created when missing, the columns added
+-- to users, auth_tokens and farms since the first version are added when
+-- missing and the data fixes AutoMigrate used to be followed by are run.
+
+CREATE TABLE IF NOT EXISTS users (
+    id serial,
+    created_at timestamp with time zone,
+    updated_at timestamp with time zone,
+    deleted_at timestamp with time zone,
+    first_name varchar(255) NOT NULL,
+    last_name varchar(255) NOT NULL,
+    user_name varchar(255) NOT NULL,
+    primary_email varchar(255) NOT NULL UNIQUE,
+    password varchar(255) NOT NULL UNIQUE,
+    role varchar(255) NOT NULL DEFAULT 'worker',
+    farm_id integer,
+    suspended_at timestamp with time zone,
+    email_verified_at timestamp with time zone,
+    totp_secret varchar(255),
+    totp_enabled_at timestamp with time zone,
+    totp_last_step bigint NOT NULL DEFAULT 0,
+    PRIMARY KEY (id)
+);
+
+-- Accounts created before email verification existed are trusted so they are
+-- marked verified when the column is added
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns
+                   WHERE table_schema = current_schema() AND table_name = 'users' AND column_name = 'email_verified_at') THEN
+        ALTER TABLE users ADD COLUMN email_verified_at timestamp with time zone;
+        UPDATE users SET email_verified_at = created_at;
+    END IF;
+END $$;
+
+ALTER TABLE users
+    ADD COLUMN IF NOT EXISTS role varchar(255) NOT NULL DEFAULT 'worker',
+    ADD COLUMN IF NOT EXISTS suspended_at timestamp with time zone,
+    ADD COLUMN IF NOT EXISTS totp_secret varchar(255),
+    ADD COLUMN IF NOT EXISTS totp_enabled_at timestamp with time zone,
+    ADD COLUMN IF NOT EXISTS totp_last_step bigint NOT NULL DEFAULT 0;
+-- AutoMigrate added totp_last_step without a default so the users it already
+-- had were left NULL, which never compares as an earlier step
+UPDATE users SET totp_last_step = 0 WHERE totp_last_step IS NULL;
+ALTER TABLE users
+    ALTER COLUMN totp_last_step SET DEFAULT 0,
+    ALTER COLUMN totp_last_step SET NOT NULL;
+CREATE INDEX IF NOT EXISTS idx_users_deleted_at ON users (deleted_at);
+
+CREATE TABLE IF NOT EXISTS auth_tokens (
+    id serial,
+    created_at timestamp with time zone,
+    updated_at timestamp with time zone,
+    deleted_at timestamp with time zone,
+    user_id integer,
+    token varchar(255) NOT NULL,
+    expiry timestamp with time zone,
+    device_label varchar(255),
+    ip varchar(255),
+    last_used_at timestamp with time zone,
+    refresh_token varchar(255) UNIQUE,
+    refresh_expiry timestamp with time zone,
+    family_id varchar(255),
+    rotated_at timestamp with time zone,
+    PRIMARY KEY (id)
+);
+ALTER TABLE auth_tokens
+    ADD COLUMN IF NOT EXISTS device_label varchar(255),
+    ADD COLUMN IF NOT EXISTS ip varchar(255),
+    ADD COLUMN IF NOT EXISTS last_used_at timestamp with time zone,
+    ADD COLUMN IF NOT EXISTS refresh_token varchar(255) UNIQUE,
+    ADD COLUMN IF NOT EXISTS refresh_expiry timestamp with time zone,
+    ADD COLUMN IF NOT EXISTS family_id varchar(255),
+    ADD COLUMN IF NOT EXISTS rotated_at timestamp with time zone;
+CREATE INDEX IF NOT EXISTS idx_auth_tokens_family_id ON auth_tokens (family_id);
+CREATE INDEX IF NOT EXISTS idx_auth_tokens_deleted_at ON auth_tokens (deleted_at);
+CREATE INDEX IF NOT EXISTS idx_auth_tokens_user_id ON auth_tokens (user_id);
+
+CREATE TABLE IF NOT EXISTS addresses (
+    id serial,
+    created_at timestamp with time zone,
+    updated_at timestamp with time zone,
+    deleted_at timestamp with time zone,
+    farm_id integer,
+    user_id integer,
+    latitude numeric(9,6),
+    longitude numeric(9,6),
+    city varchar(255),
+    postal_or_zip_code varchar(255),
+    province_or_state varchar(255),
+    PRIMARY KEY (id)
+);
+CREATE INDEX IF NOT EXISTS idx_addresses_deleted_at ON addresses (deleted_at);
+
+CREATE TABLE IF NOT EXISTS farms (
+    id serial,
+    created_at timestamp with time zone,
+    updated_at timestamp with time zone,
+    deleted_at timestamp with time zone,
+    owner_id integer,
+    name varchar(255),
+    description varchar(255),
+    PRIMARY KEY (id)
+);
+ALTER TABLE farms ADD COLUMN IF NOT EXISTS owner_id integer;
+CREATE INDEX IF NOT EXISTS idx_farms_deleted_at ON farms (deleted_at);
+CREATE INDEX IF NOT EXISTS idx_farms_owner_id ON farms (owner_id);
+
+CREATE TABLE IF NOT EXISTS crops (
+    id serial,
+    created_at timestamp with time zone,
+    updated_at timestamp with time zone,
+    deleted_at timestamp with time zone,
+    farm_id integer,
+    name varchar(255) NOT NULL,
+    season varchar(255),
+    harvest_start timestamp with time zone,
+    harvest_end timestamp with time zone,
+    PRIMARY KEY (id)
+);
+CREATE INDEX IF NOT EXISTS idx_crops_deleted_at ON crops (deleted_at);
+CREATE INDEX IF NOT EXISTS idx_crops_farm_id ON crops (farm_id);
+
+CREATE TABLE IF NOT EXISTS engagements (
+    id serial,
+    created_at timestamp with time zone,
+    updated_at timestamp with time zone,
+    deleted_at timestamp with time zone,
+    farm_id integer,
+    worker_id integer,
+    completed_at timestamp with time zone,
+    PRIMARY KEY (id)
+);
+CREATE INDEX IF NOT EXISTS idx_engagements_deleted_at ON engagements (deleted_at);
+CREATE INDEX IF NOT EXISTS idx_engagements_farm_id ON engagements (farm_id);
+CREATE INDEX IF NOT EXISTS idx_engagements_worker_id ON engagements (worker_id);
+
+CREATE TABLE IF NOT EXISTS reviews (
+    id serial,
+    created_at timestamp with time zone,
+    updated_at timestamp with time zone,
+    deleted_at timestamp with time zone,
+    engagement_id integer NOT NULL,
+    author_id integer NOT NULL,
+    farm_id integer,
+    worker_id integer,
+    kind varchar(255) NOT NULL,
+    stars integer NOT NULL,
+    comment varchar(255),
+    PRIMARY KEY (id)
+);
+CREATE INDEX IF NOT EXISTS idx_reviews_deleted_at ON reviews (deleted_at);
+CREATE INDEX IF NOT EXISTS idx_reviews_farm_id ON reviews (farm_id);
+CREATE INDEX IF NOT EXISTS idx_reviews_worker_id ON reviews (worker_id);
+CREATE UNIQUE INDEX IF NOT EXISTS uix_reviews_engagement_author ON reviews (engagement_id, author_id);
+
+CREATE TABLE IF NOT EXISTS tasks (
+    id serial,
+    created_at timestamp with time zone,
+    updated_at timestamp with time zone,
+    deleted_at timestamp with time zone,
+    farm_id integer,
+    assignee_id integer,
+    title varchar(255) NOT NULL,
+    description varchar(255),
+    status varchar(255) NOT NULL,
+    started_at timestamp with time zone,
+    completed_at timestamp with time zone,
+    PRIMARY KEY (id)
+);
+CREATE INDEX IF NOT EXISTS idx_tasks_deleted_at ON tasks (deleted_at);
+CREATE INDEX IF NOT EXISTS idx_tasks_farm_id ON tasks (farm_id);
+CREATE INDEX IF NOT EXISTS idx_tasks_assignee_id ON tasks (assignee_id);
+
+CREATE TABLE IF NOT EXISTS job_postings (
+    id serial,
+    created_at timestamp with time zone,
+    updated_at timestamp with time zone,
+    deleted_at timestamp with time zone,
+    farm_id integer,
+    role varchar(255) NOT NULL,
+    description varchar(255),
+    start_date timestamp with time zone,
+    end_date timestamp with time zone,
+    headcount integer NOT NULL,
+    compensation varchar(255) NOT NULL,
+    hourly_wage_cents integer,
+    PRIMARY KEY (id)
+);
+CREATE INDEX IF NOT EXISTS idx_job_postings_deleted_at ON job_postings (deleted_at);
+CREATE INDEX IF NOT EXISTS idx_job_postings_farm_id ON job_postings (farm_id);
+
+CREATE TABLE IF NOT EXISTS applications (
+    id serial,
+    created_at timestamp with time zone,
+    updated_at timestamp with time zone,
+    deleted_at timestamp with time zone,
+    job_posting_id integer NOT NULL,
+    applicant_id integer NOT NULL,
+    engagement_id integer,
+    status varchar(255) NOT NULL,
+    message varchar(255),
+    PRIMARY KEY (id)
+);
+CREATE INDEX IF NOT EXISTS idx_applications_deleted_at ON applications (deleted_at);
+CREATE UNIQUE INDEX IF NOT EXISTS uix_applications_posting_applicant ON applications (job_posting_id, applicant_id);
+
+CREATE TABLE IF NOT EXISTS password_resets (
+    id serial,
+    created_at timestamp with time zone,
+    updated_at timestamp with time zone,
+    deleted_at timestamp with time zone,
+    user_id integer,
+    token varchar(255) NOT NULL UNIQUE,
+    expiry timestamp with time zone NOT NULL,
+    used_at timestamp with time zone,
+    PRIMARY KEY (id)
+);
+CREATE INDEX IF NOT EXISTS idx_password_resets_deleted_at ON password_resets (deleted_at);
+CREATE INDEX IF NOT EXISTS idx_password_resets_user_id ON password_resets (user_id);
+
+CREATE TABLE IF NOT EXISTS email_verifications (
+    id serial,
+    created_at timestamp with time zone,
+    updated_at timestamp with time zone,
+    deleted_at timestamp with time zone,
+    user_id integer,
+    token varchar(255) NOT NULL UNIQUE,
+    expiry timestamp with time zone NOT NULL,
+    used_at timestamp with time zone,
+    PRIMARY KEY (id)
+);
+CREATE INDEX IF NOT EXISTS idx_email_verifications_deleted_at ON email_verifications (deleted_at);
+CREATE INDEX IF NOT EXISTS idx_email_verifications_user_id ON email_verifications (user_id);
+
+CREATE TABLE IF NOT EXISTS login_attempts (
+    id serial,
+    key varchar(255) NOT NULL UNIQUE,
+    failures integer NOT NULL,
+    locked_until timestamp with time zone,
+    updated_at timestamp with time zone,
+    PRIMARY KEY (id)
+);
+
+CREATE TABLE IF NOT EXISTS audit_events (
+    id serial,
+    created_at timestamp with time zone,
+    updated_at timestamp with time zone,
+    deleted_at timestamp with time zone,
+    action varchar(255) NOT NULL,
+    user_id integer,
+    ip varchar(255),
+    detail varchar(255),
+    PRIMARY KEY (id)
+);
+CREATE INDEX IF NOT EXISTS idx_audit_events_deleted_at ON audit_events (deleted_at);
+CREATE INDEX IF NOT EXISTS idx_audit_events_action ON audit_events (action);
+CREATE INDEX IF NOT EXISTS idx_audit_events_user_id ON audit_events (user_id);
+
+CREATE TABLE IF NOT EXISTS recovery_codes (
+    id serial,
+    created_at timestamp with time zone,
+    updated_at timestamp with time zone,
+    deleted_at timestamp with time zone,
+    user_id integer,
+    code varchar(255) NOT NULL UNIQUE,
+    used_at timestamp with time zone,
+    PRIMARY KEY (id)
+);
+CREATE INDEX IF NOT EXISTS idx_recovery_codes_deleted_at ON recovery_codes (deleted_at);
+CREATE INDEX IF NOT EXISTS idx_recovery_codes_user_id ON recovery_codes (user_id);
+
+CREATE TABLE IF NOT EXISTS two_factor_challenges (
+    id serial,
+    created_at timestamp with time zone,
+    updated_at timestamp with time zone,
+    deleted_at timestamp with time zone,
+    user_id integer,
+    token varchar(255) NOT NULL UNIQUE,
+    device varchar(255),
+    expiry timestamp with time zone NOT NULL,
+    failures integer NOT NULL,
+    used_at timestamp with time zone,
+    PRIMARY KEY (id)
+);
+CREATE INDEX IF NOT EXISTS idx_two_factor_challenges_user_id ON two_factor_challenges (user_id);
+CREATE INDEX IF NOT EXISTS idx_two_factor_challenges_deleted_at ON two_factor_challenges (deleted_at);
+
+CREATE TABLE IF NOT EXISTS external_identities (
+    id serial,
+    created_at timestamp with time zone,
+    updated_at timestamp with time zone,
+    deleted_at timestamp with time zone,
+    user_id integer,
+    issuer varchar(255) NOT NULL,
+    subject varchar(255) NOT NULL,
+    PRIMARY KEY (id)
+);
+CREATE INDEX IF NOT EXISTS idx_external_identities_deleted_at ON external_identities (deleted_at);
+CREATE INDEX IF NOT EXISTS idx_external_identities_user_id ON external_identities (user_id);
+CREATE UNIQUE INDEX IF NOT EXISTS uix_external_identities_issuer_subject ON external_identities (issuer, subject);
+
+CREATE TABLE IF NOT EXISTS oidc_states (
+    id serial,
+    created_at timestamp with time zone,
+    updated_at timestamp with time zone,
+    deleted_at timestamp with time zone,
+    state varchar(255) NOT NULL UNIQUE,
+    nonce varchar(255) NOT NULL,
+    code_verifier varchar(255) NOT NULL,
+    device varchar(255),
+    expiry timestamp with time zone NOT NULL,
+    PRIMARY KEY (id)
+);
+CREATE INDEX IF NOT EXISTS idx_oidc_states_deleted_at ON oidc_states (deleted_at);
+
+-- Coordinates were originally stored as integers which cannot hold a real
+-- location
+ALTER TABLE addresses ALTER COLUMN latitude TYPE numeric(9,6), ALTER COLUMN longitude TYPE numeric(9,6);
+
+-- Tokens used to be stored in plaintext, now only their SHA-256 digest is kept.
+-- Any row that is not a digest predates that so sign it out
+DELETE FROM auth_tokens WHERE token !~ '^[0-9a-f]{64}$';
+DELETE FROM password_resets WHERE token !~ '^[0-9a-f]{64}$';
+
+-- Roles replaced the free-form type column. Anyone who already owns a farm
+-- needs the farm owner role to keep managing it
+UPDATE users SET role = 'farm_owner' WHERE role = 'worker' AND id IN (SELECT owner_id FROM farms WHERE deleted_at IS NULL);
+
+-- Databases from before roles have the free-form type and category columns
+-- the User model no longer maps. Users whose type named them a farm owner keep
+-- that as their role. Nothing is ever converted to admin, admins are promoted
+-- by hand. Both columns are left in place so their values are not lost
+DO $$
+BEGIN
+    IF EXISTS (SELECT 1 FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = 'users' AND column_name = 'type') THEN
+        UPDATE users SET role = 'farm_owner'
+        WHERE role = 'worker' AND lower(trim(type)) IN ('farm_owner', 'farm owner', 'farmowner', 'owner', 'farmer');
+    END IF;
+END $$;
@@ -0,0 +1 @@
+DROP INDEX IF EXISTS uix_auth_tokens_token;
@@ -0,0 +1,2 @@
+-- Every authenticated request looks its session up by the token digest
+CREATE UNIQUE INDEX IF NOT EXISTS uix_auth_tokens_token ON auth_tokens (token);